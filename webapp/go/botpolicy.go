@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/labstack/echo"
+)
+
+const defaultBotPolicyFile = "bot_policy.json"
+
+// User-Agent がルールに一致したときの扱い
+const (
+	// botActionBlock 503 を返す
+	botActionBlock = "block"
+	// botActionThrottle RATE_LIMIT_*_BOT の制限をかける
+	botActionThrottle = "throttle"
+	// botActionAllow 人間と同じに扱う
+	botActionAllow = "allow"
+)
+
+var botActions = []string{botActionBlock, botActionThrottle, botActionAllow}
+
+// errBotRuleNotFound setAction と remove に渡した ID のルールが無い
+var errBotRuleNotFound = errors.New("bot rule not found")
+
+// defaultBotRules ポリシーのファイルが無いときに使う。ベンチマーカーのクローラーを全て含む
+var defaultBotRules = []BotRule{
+	{Pattern: `ISUCONbot(-Mobile)?`, Action: botActionThrottle},
+	{Pattern: `ISUCONbot-Image/`, Action: botActionThrottle},
+	{Pattern: `Mediapartners-ISUCON`, Action: botActionThrottle},
+	{Pattern: `ISUCONCoffee`, Action: botActionThrottle},
+	{Pattern: `ISUCONFeedSeeker(Beta)?`, Action: botActionThrottle},
+	{Pattern: `crawler \(https://isucon\.invalid/(support/faq/|help/jp/)`, Action: botActionThrottle},
+	{Pattern: `isubot`, Action: botActionThrottle},
+	{Pattern: `Isupider`, Action: botActionThrottle},
+	{Pattern: `Isupider(-image)?\+`, Action: botActionThrottle},
+	{Pattern: `(?i)(bot|crawler|spider)(?:[-_ .\/;@()]|$)`, Action: botActionThrottle},
+}
+
+// bots リクエストの User-Agent を分類する。ルールは管理 API から書き換えられる
+var bots = newBotPolicy("", defaultBotRules)
+
+// BotRule Hits は起動してから一致した回数で、ファイルには残さない
+type BotRule struct {
+	ID      int64  `json:"id"`
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+	Hits    int64  `json:"hits"`
+}
+
+type BotRulesResponse struct {
+	Rules []BotRule `json:"rules"`
+}
+
+// botRule 置き換えたら捨てるので、BotRule は書き換えない。Hits は使わず、一致した回数は hits に数える
+type botRule struct {
+	BotRule
+	re *regexp.Regexp
+	// hits action を変えても数え直さないよう、置き換えた後のルールと共有する。atomic でだけ読み書きする
+	hits *int64
+}
+
+// botPolicy ルールは先頭から順に試し、最初に一致したものを使う
+type botPolicy struct {
+	// path 空ならファイルに保存しない
+	path string
+
+	mu     sync.RWMutex
+	rules  []*botRule
+	lastID int64
+}
+
+type botPolicyFile struct {
+	Rules []BotRule `json:"rules"`
+}
+
+func newBotPolicy(path string, rules []BotRule) *botPolicy {
+	p := &botPolicy{path: path}
+	for _, r := range rules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			continue
+		}
+		if r.ID == 0 {
+			r.ID = p.lastID + 1
+		}
+		if r.ID > p.lastID {
+			p.lastID = r.ID
+		}
+		r.Hits = 0
+		p.rules = append(p.rules, &botRule{BotRule: r, re: re, hits: new(int64)})
+	}
+	return p
+}
+
+// loadBotPolicy path のファイルからルールを読む。ファイルが無ければ既定のルールで始める
+func loadBotPolicy(path string) (*botPolicy, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return newBotPolicy(path, defaultBotRules), nil
+	} else if err != nil {
+		return nil, err
+	}
+	var f botPolicyFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	for _, r := range f.Rules {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	return newBotPolicy(path, f.Rules), nil
+}
+
+// classify User-Agent に一致したルールの action を返す。どれにも一致しなければ allow
+func (p *botPolicy) classify(ua string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, r := range p.rules {
+		if r.re.MatchString(ua) {
+			atomic.AddInt64(r.hits, 1)
+			return r.Action
+		}
+	}
+	return botActionAllow
+}
+
+func (p *botPolicy) list() []BotRule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	rules := make([]BotRule, 0, len(p.rules))
+	for _, r := range p.rules {
+		rule := r.BotRule
+		rule.Hits = atomic.LoadInt64(r.hits)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// add 追加したルールは先頭に入れ、既存の広いパターンより先に試す
+func (p *botPolicy) add(pattern, action string) (*BotRule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r := &botRule{BotRule: BotRule{ID: p.lastID + 1, Pattern: pattern, Action: action}, re: re, hits: new(int64)}
+	rules := append([]*botRule{r}, p.rules...)
+	if err := p.save(rules); err != nil {
+		return nil, err
+	}
+	p.rules = rules
+	p.lastID = r.ID
+	rule := r.BotRule
+	return &rule, nil
+}
+
+func (p *botPolicy) setAction(id int64, action string) (*BotRule, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, r := range p.rules {
+		if r.ID != id {
+			continue
+		}
+		updated := &botRule{BotRule: r.BotRule, re: r.re, hits: r.hits}
+		updated.Action = action
+		rules := append([]*botRule{}, p.rules...)
+		rules[i] = updated
+		if err := p.save(rules); err != nil {
+			return nil, err
+		}
+		p.rules = rules
+		rule := updated.BotRule
+		rule.Hits = atomic.LoadInt64(updated.hits)
+		return &rule, nil
+	}
+	return nil, errBotRuleNotFound
+}
+
+func (p *botPolicy) remove(id int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, r := range p.rules {
+		if r.ID != id {
+			continue
+		}
+		rules := append(p.rules[:i:i], p.rules[i+1:]...)
+		if err := p.save(rules); err != nil {
+			return err
+		}
+		p.rules = rules
+		return nil
+	}
+	return errBotRuleNotFound
+}
+
+// save ロックを取った状態で呼ぶ。保存できたときだけ p.rules を rules に置き換える
+// 書きかけのファイルを読まないよう、一時ファイルに書いてから置き換える
+func (p *botPolicy) save(rules []*botRule) error {
+	if p.path == "" {
+		return nil
+	}
+	f := botPolicyFile{Rules: make([]BotRule, 0, len(rules))}
+	for _, r := range rules {
+		rule := r.BotRule
+		rule.Hits = 0
+		f.Rules = append(f.Rules, rule)
+	}
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
+
+// adminAuth ADMIN_TOKEN を Authorization: Bearer で渡したリクエストだけ通す。未設定なら管理 API は使えない
+func adminAuth(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			got := c.Request().Header.Get(echo.HeaderAuthorization)
+			if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+				return newAPIError(http.StatusUnauthorized, errCodeUnauthorized, "", "admin token is required")
+			}
+			return next(c)
+		}
+	}
+}
+
+func getBotRules(c echo.Context) error {
+	return c.JSON(http.StatusOK, BotRulesResponse{Rules: bots.list()})
+}
+
+func postBotRule(c echo.Context) error {
+	var rule BotRule
+	if err := c.Bind(&rule); err != nil {
+		c.Echo().Logger.Infof("post bot rule failed : %v", err)
+		return errInvalidBody("", "request body is not valid JSON")
+	}
+
+	var v fieldValidator
+	v.str("pattern", rule.Pattern, 1, 1024)
+	if _, err := regexp.Compile(rule.Pattern); err != nil {
+		v.add("pattern", "must be a valid regular expression: %v", err)
+	}
+	v.oneOf("action", rule.Action, botActions)
+	if len(v.errs) > 0 {
+		return errValidation(v.errs)
+	}
+
+	created, err := bots.add(rule.Pattern, rule.Action)
+	if err != nil {
+		return errInternal(fmt.Errorf("failed to save bot policy : %v", err))
+	}
+	return c.JSON(http.StatusCreated, created)
+}
+
+func patchBotRule(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return errInvalidParameter("id", "id must be an integer")
+	}
+	var rule BotRule
+	if err := c.Bind(&rule); err != nil {
+		c.Echo().Logger.Infof("patch bot rule failed : %v", err)
+		return errInvalidBody("", "request body is not valid JSON")
+	}
+
+	var v fieldValidator
+	v.oneOf("action", rule.Action, botActions)
+	if len(v.errs) > 0 {
+		return errValidation(v.errs)
+	}
+
+	updated, err := bots.setAction(int64(id), rule.Action)
+	if err == errBotRuleNotFound {
+		return errNotFound("bot rule not found")
+	} else if err != nil {
+		return errInternal(fmt.Errorf("failed to save bot policy : %v", err))
+	}
+	return c.JSON(http.StatusOK, updated)
+}
+
+func deleteBotRule(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return errInvalidParameter("id", "id must be an integer")
+	}
+	if err := bots.remove(int64(id)); err == errBotRuleNotFound {
+		return errNotFound("bot rule not found")
+	} else if err != nil {
+		return errInternal(fmt.Errorf("failed to save bot policy : %v", err))
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// catalogReloadInterval 反映に失敗した後、全ての行を読み直せるまで試す間隔
+var catalogReloadInterval = time.Second
+
+// catalogStoreBackend 全てのイスと物件をメモリに読み込み、検索・詳細・おすすめをメモリ上の索引で返す
+// 書き込みは元のストア (MySQL) に行い、確定した行をそのままメモリに反映する。元のストアを読み直すのは
+// 購入と確保で減った在庫、他のノードの書き込み、反映に失敗した後の立て直しだけにする
+// なぞって検索・履歴・CSV の重複確認などは元のストアに任せる
+type catalogStoreBackend struct {
+	StoreBackend
+	chairs  *catalogChairStore
+	estates *catalogEstateStore
+	// closed 閉じたら読み直しの再試行をやめる
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// catalogChairSource カタログの元になるストア。ids が nil なら全ての行を返す
+// 書き込みの直後に読むので、レプリカではなくプライマリから読むこと
+type catalogChairSource interface {
+	ChairStore
+	loadChairs(ctx context.Context, ids []int64) ([]Chair, error)
+}
+
+type catalogEstateSource interface {
+	EstateStore
+	loadEstates(ctx context.Context, ids []int64) ([]Estate, error)
+}
+
+// catalogTable イスと物件で共通の、確定した行の反映と元のストアからの読み直し
+type catalogTable struct {
+	// name ログに残すテーブルの名前
+	name string
+	// load ids の行を元のストアから読み、メモリの行を置き換える。ids が nil なら全ての行を置き換える
+	load func(ctx context.Context, ids []int64) error
+
+	// mu 読み直しと反映を順番に行い、先に読んだ古い行で後から読んだ新しい行を上書きしないようにする
+	mu sync.Mutex
+	// stale 読み直しに失敗したら立て、次の反映の代わりに全ての行を読み込む
+	stale bool
+	// reloading 失敗した後の読み直しを待っている間は立てておき、再試行を重ねない
+	reloading bool
+
+	logger echo.Logger
+	closed <-chan struct{}
+}
+
+type catalogChairStore struct {
+	catalogChairSource
+	catalogTable
+	mem *memoryChairStore
+}
+
+type catalogEstateStore struct {
+	catalogEstateSource
+	catalogTable
+	mem *memoryEstateStore
+}
+
+func newCatalogChairStore(source catalogChairSource, logger echo.Logger, closed <-chan struct{}) *catalogChairStore {
+	s := &catalogChairStore{catalogChairSource: source, mem: newMemoryChairStore()}
+	s.catalogTable = catalogTable{name: "chairs", logger: logger, closed: closed, load: func(ctx context.Context, ids []int64) error {
+		chairs, err := source.loadChairs(ctx, ids)
+		if err != nil {
+			return err
+		}
+		if ids == nil {
+			s.mem.reset(chairs)
+		} else {
+			s.mem.replace(ids, chairs)
+		}
+		return nil
+	}}
+	return s
+}
+
+func newCatalogEstateStore(source catalogEstateSource, logger echo.Logger, closed <-chan struct{}) *catalogEstateStore {
+	s := &catalogEstateStore{catalogEstateSource: source, mem: newMemoryEstateStore()}
+	s.catalogTable = catalogTable{name: "estates", logger: logger, closed: closed, load: func(ctx context.Context, ids []int64) error {
+		estates, err := source.loadEstates(ctx, ids)
+		if err != nil {
+			return err
+		}
+		if ids == nil {
+			s.mem.reset(estates)
+		} else {
+			s.mem.replace(ids, estates)
+		}
+		return nil
+	}}
+	return s
+}
+
+func newCatalogStoreBackend(source StoreBackend, logger echo.Logger) (*catalogStoreBackend, error) {
+	chairs, ok := source.ChairStore().(catalogChairSource)
+	if !ok {
+		return nil, fmt.Errorf("chair store %T cannot be loaded into the catalog", source.ChairStore())
+	}
+	estates, ok := source.EstateStore().(catalogEstateSource)
+	if !ok {
+		return nil, fmt.Errorf("estate store %T cannot be loaded into the catalog", source.EstateStore())
+	}
+	closed := make(chan struct{})
+	b := &catalogStoreBackend{
+		StoreBackend: source,
+		chairs:       newCatalogChairStore(chairs, logger, closed),
+		estates:      newCatalogEstateStore(estates, logger, closed),
+		closed:       closed,
+	}
+	if err := b.load(context.Background()); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *catalogStoreBackend) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return b.StoreBackend.Close()
+}
+
+func (b *catalogStoreBackend) ChairStore() ChairStore {
+	return b.chairs
+}
+
+func (b *catalogStoreBackend) EstateStore() EstateStore {
+	return b.estates
+}
+
+func (b *catalogStoreBackend) Initialize(ctx context.Context) error {
+	if err := b.StoreBackend.Initialize(ctx); err != nil {
+		return err
+	}
+	return b.load(ctx)
+}
+
+// applyChange 他のノードが書き込んだ行を読み直す
+func (b *catalogStoreBackend) applyChange(ctx context.Context, ev ChangeEvent) error {
+	switch ev.Target {
+	case changeTargetChair:
+		return b.chairs.refresh(ctx, ev.IDs)
+	case changeTargetEstate:
+		return b.estates.refresh(ctx, ev.IDs)
+	}
+	return fmt.Errorf("unknown change target %q", ev.Target)
+}
+
+func (b *catalogStoreBackend) load(ctx context.Context) error {
+	if err := b.chairs.refresh(ctx, nil); err != nil {
+		return err
+	}
+	return b.estates.refresh(ctx, nil)
+}
+
+// refresh ids の行を元のストアから読み直す。ids が nil なら全て読み直す
+// 書き込みは確定しているので、クライアントが切断しても読み直しは続ける
+func (t *catalogTable) refresh(ctx context.Context, ids []int64) error {
+	ctx, cancel := detachContext(ctx)
+	defer cancel()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stale {
+		ids = nil
+	}
+	if err := t.load(ctx, ids); err != nil {
+		t.stale = true
+		return err
+	}
+	t.stale = false
+	return nil
+}
+
+// apply 書き込みが確定した行を replace でメモリに反映する
+// stale なら反映した行だけでは足りないので、全て読み直す
+func (t *catalogTable) apply(ctx context.Context, replace func()) error {
+	t.mu.Lock()
+	stale := t.stale
+	if !stale {
+		replace()
+	}
+	t.mu.Unlock()
+	if stale {
+		return t.refresh(ctx, nil)
+	}
+	return nil
+}
+
+// reloadLater 書き込みは確定しているので呼び出し元には返さず、ログに残して全ての行を読み直す
+// 次の書き込みを待たずに、読み直せるまで catalogReloadInterval ごとに試す
+func (t *catalogTable) reloadLater(err error) {
+	t.logger.Errorf("failed to apply %v to the catalog, reloading : %v", t.name, err)
+	t.mu.Lock()
+	if t.reloading {
+		t.mu.Unlock()
+		return
+	}
+	t.reloading = true
+	t.mu.Unlock()
+	go func() {
+		defer func() {
+			t.mu.Lock()
+			t.reloading = false
+			t.mu.Unlock()
+		}()
+		ticker := time.NewTicker(catalogReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.closed:
+				return
+			case <-ticker.C:
+			}
+			if err := t.refresh(context.Background(), nil); err != nil {
+				t.logger.Errorf("failed to reload %v into the catalog : %v", t.name, err)
+				continue
+			}
+			return
+		}
+	}()
+}
+
+func (s *catalogChairStore) GetChair(ctx context.Context, id int64) (*Chair, error) {
+	return s.mem.GetChair(ctx, id)
+}
+
+func (s *catalogChairStore) SearchChairs(ctx context.Context, q ChairSearchQuery) (int64, []Chair, error) {
+	return s.mem.SearchChairs(ctx, q)
+}
+
+func (s *catalogChairStore) LowPricedChairs(ctx context.Context, limit int) ([]Chair, error) {
+	return s.mem.LowPricedChairs(ctx, limit)
+}
+
+func (s *catalogChairStore) RecommendedChairs(ctx context.Context, doorWidth, doorHeight int64, limit int) ([]Chair, error) {
+	return s.mem.RecommendedChairs(ctx, doorWidth, doorHeight, limit)
+}
+
+// 以下の書き込みは元のストアの結果を返す。確定した後の反映の失敗は reloadLater で立て直す
+
+func (s *catalogChairStore) InsertChairs(ctx context.Context, chairs []Chair) error {
+	if err := s.catalogChairSource.InsertChairs(ctx, chairs); err != nil {
+		return err
+	}
+	ids := make([]int64, 0, len(chairs))
+	for _, chair := range chairs {
+		ids = append(ids, chair.ID)
+	}
+	if err := s.apply(ctx, func() { s.mem.replace(ids, chairs) }); err != nil {
+		s.reloadLater(err)
+	}
+	return nil
+}
+
+func (s *catalogChairStore) UpdateChair(ctx context.Context, id int64, fn func(*Chair) error) (*Chair, error) {
+	chair, err := s.catalogChairSource.UpdateChair(ctx, id, fn)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.apply(ctx, func() { s.mem.replace([]int64{id}, []Chair{*chair}) }); err != nil {
+		s.reloadLater(err)
+	}
+	return chair, nil
+}
+
+func (s *catalogChairStore) DeleteChair(ctx context.Context, id int64) error {
+	if err := s.catalogChairSource.DeleteChair(ctx, id); err != nil {
+		return err
+	}
+	if err := s.apply(ctx, func() { s.mem.replace([]int64{id}, nil) }); err != nil {
+		s.reloadLater(err)
+	}
+	return nil
+}
+
+// BuyChair 並んだ購入は確定した順に戻るとは限らないので、戻り値の在庫ではなく確定した行を読み直す
+func (s *catalogChairStore) BuyChair(ctx context.Context, id int64, email string) (int64, error) {
+	stock, err := s.catalogChairSource.BuyChair(ctx, id, email)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.refresh(ctx, []int64{id}); err != nil {
+		s.reloadLater(err)
+	}
+	return stock, nil
+}
+
+// ReserveChair 購入と同じく確定した行を読み直す
+func (s *catalogChairStore) ReserveChair(ctx context.Context, id int64, token, email string, ttl time.Duration) (int64, time.Time, error) {
+	stock, expiresAt, err := s.catalogChairSource.ReserveChair(ctx, id, token, email, ttl)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if err := s.refresh(ctx, []int64{id}); err != nil {
+		s.reloadLater(err)
+	}
+	return stock, expiresAt, nil
+}
+
+// ReleaseExpiredReservations 在庫を戻したイスを読み直す。バックグラウンドで動くので、読み直しの分は待ってよい
+func (s *catalogChairStore) ReleaseExpiredReservations(ctx context.Context) (map[int64]int64, error) {
+	stocks, err := s.catalogChairSource.ReleaseExpiredReservations(ctx)
+	if err != nil || len(stocks) == 0 {
+		return stocks, err
+	}
+	ids := make([]int64, 0, len(stocks))
+	for id := range stocks {
+		ids = append(ids, id)
+	}
+	return stocks, s.refresh(ctx, ids)
+}
+
+// RecomputeChairPopularity 再計算しなかったときは popularity が変わっていないので読み直さない
+func (s *catalogChairStore) RecomputeChairPopularity(ctx context.Context, conf PopularityConfig) (bool, error) {
+	recomputed, err := s.catalogChairSource.RecomputeChairPopularity(ctx, conf)
+	if err != nil || !recomputed {
+		return recomputed, err
+	}
+	return true, s.refresh(ctx, nil)
+}
+
+func (s *catalogEstateStore) GetEstate(ctx context.Context, id int64) (*Estate, error) {
+	return s.mem.GetEstate(ctx, id)
+}
+
+func (s *catalogEstateStore) SearchEstates(ctx context.Context, q EstateSearchQuery) (int64, []Estate, error) {
+	return s.mem.SearchEstates(ctx, q)
+}
+
+func (s *catalogEstateStore) LowPricedEstates(ctx context.Context, limit int) ([]Estate, error) {
+	return s.mem.LowPricedEstates(ctx, limit)
+}
+
+func (s *catalogEstateStore) RecommendedEstates(ctx context.Context, width, height, depth int64, limit int) ([]Estate, error) {
+	return s.mem.RecommendedEstates(ctx, width, height, depth, limit)
+}
+
+func (s *catalogEstateStore) InsertEstates(ctx context.Context, estates []Estate) error {
+	if err := s.catalogEstateSource.InsertEstates(ctx, estates); err != nil {
+		return err
+	}
+	ids := make([]int64, 0, len(estates))
+	for _, estate := range estates {
+		ids = append(ids, estate.ID)
+	}
+	if err := s.apply(ctx, func() { s.mem.replace(ids, estates) }); err != nil {
+		s.reloadLater(err)
+	}
+	return nil
+}
+
+func (s *catalogEstateStore) UpdateEstate(ctx context.Context, id int64, fn func(*Estate) error) (*Estate, error) {
+	estate, err := s.catalogEstateSource.UpdateEstate(ctx, id, fn)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.apply(ctx, func() { s.mem.replace([]int64{id}, []Estate{*estate}) }); err != nil {
+		s.reloadLater(err)
+	}
+	return estate, nil
+}
+
+func (s *catalogEstateStore) DeleteEstate(ctx context.Context, id int64) error {
+	if err := s.catalogEstateSource.DeleteEstate(ctx, id); err != nil {
+		return err
+	}
+	if err := s.apply(ctx, func() { s.mem.replace([]int64{id}, nil) }); err != nil {
+		s.reloadLater(err)
+	}
+	return nil
+}
+
+func (s *catalogEstateStore) RecomputeEstatePopularity(ctx context.Context, conf PopularityConfig) (bool, error) {
+	recomputed, err := s.catalogEstateSource.RecomputeEstatePopularity(ctx, conf)
+	if err != nil || !recomputed {
+		return recomputed, err
+	}
+	return true, s.refresh(ctx, nil)
+}
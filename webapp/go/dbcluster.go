@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// dbCluster プライマリと、検索・詳細の読み込みに使うリードレプリカ
+type dbCluster struct {
+	env      *MySQLConnectionEnv
+	primary  *sqlx.DB
+	replicas []*sqlx.DB
+	counter  uint32
+	// stmts 接続先ごとの prepare 済みの statement
+	stmts map[*sqlx.DB]*stmtCache
+}
+
+// NewMySQLStoreConnectionEnv イスと物件は SQL で JOIN しないので、それぞれ別の MySQL に置ける
+// MYSQL_CHAIR_HOST のようにデータごとに指定された接続情報を返す
+// 指定がなければ MYSQL_HOST などの値を使う
+func NewMySQLStoreConnectionEnv(store string, base *MySQLConnectionEnv) *MySQLConnectionEnv {
+	prefix := "MYSQL_" + store + "_"
+	return &MySQLConnectionEnv{
+		Host:     getEnv(prefix+"HOST", base.Host),
+		Port:     getEnv(prefix+"PORT", base.Port),
+		User:     getEnv(prefix+"USER", base.User),
+		DBName:   getEnv(prefix+"DBNAME", base.DBName),
+		Password: getEnv(prefix+"PASS", base.Password),
+		Options:  base.Options,
+	}
+}
+
+// NewMySQLReplicaConnectionEnvs MYSQL_CHAIR_REPLICA_HOST (なければ MYSQL_REPLICA_HOST) に
+// カンマ区切りで指定されたレプリカの接続情報を返す
+// ホスト以外は指定がなければプライマリと同じ値を使う
+func NewMySQLReplicaConnectionEnvs(store string, primary *MySQLConnectionEnv) []*MySQLConnectionEnv {
+	replicaEnv := func(key, defaultValue string) string {
+		return getEnv("MYSQL_"+store+"_REPLICA_"+key, getEnv("MYSQL_REPLICA_"+key, defaultValue))
+	}
+	hosts := replicaEnv("HOST", "")
+	if hosts == "" {
+		return nil
+	}
+	envs := []*MySQLConnectionEnv{}
+	for _, host := range strings.Split(hosts, ",") {
+		envs = append(envs, &MySQLConnectionEnv{
+			Host:     strings.TrimSpace(host),
+			Port:     replicaEnv("PORT", primary.Port),
+			User:     replicaEnv("USER", primary.User),
+			DBName:   replicaEnv("DBNAME", primary.DBName),
+			Password: replicaEnv("PASS", primary.Password),
+			Options:  primary.Options,
+		})
+	}
+	return envs
+}
+
+// connectDBCluster MYSQL_STMT_CACHE が false なら決まったクエリも prepare して使い回さない
+func connectDBCluster(env *MySQLConnectionEnv, replicaEnvs []*MySQLConnectionEnv) (*dbCluster, error) {
+	primary, err := env.ConnectDB()
+	if err != nil {
+		return nil, err
+	}
+	primary.SetMaxOpenConns(10)
+	stmtCacheDisabled := !getEnvBool("MYSQL_STMT_CACHE", true)
+	cluster := &dbCluster{
+		env:     env,
+		primary: primary,
+		stmts:   map[*sqlx.DB]*stmtCache{primary: newStmtCache(primary, stmtCacheDisabled)},
+	}
+
+	for _, replicaEnv := range replicaEnvs {
+		replica, err := replicaEnv.ConnectDB()
+		if err != nil {
+			cluster.Close()
+			return nil, err
+		}
+		replica.SetMaxOpenConns(10)
+		cluster.replicas = append(cluster.replicas, replica)
+		cluster.stmts[replica] = newStmtCache(replica, stmtCacheDisabled)
+	}
+	return cluster, nil
+}
+
+// replica 読み込み専用のクエリを投げる先を返す
+// 書き込みや、書き込んだ直後の値を読む必要があるクエリには primary を使うこと
+func (cl *dbCluster) replica() *sqlx.DB {
+	if len(cl.replicas) == 0 {
+		return cl.primary
+	}
+	n := atomic.AddUint32(&cl.counter, 1)
+	return cl.replicas[int(n)%len(cl.replicas)]
+}
+
+// replicaStmts replica と同じく振り分けた接続先の、prepare 済みの statement を返す
+func (cl *dbCluster) replicaStmts() *stmtCache {
+	return cl.stmts[cl.replica()]
+}
+
+func (cl *dbCluster) primaryStmts() *stmtCache {
+	return cl.stmts[cl.primary]
+}
+
+// resetStmts スキーマを作り直すと prepare し直す必要があるので、全ての statement を捨てる
+func (cl *dbCluster) resetStmts() {
+	for _, stmts := range cl.stmts {
+		stmts.reset()
+	}
+}
+
+// Close statement を閉じ終えてから DB を閉じる
+func (cl *dbCluster) Close() error {
+	for _, stmts := range cl.stmts {
+		stmts.close()
+	}
+	for _, r := range cl.replicas {
+		r.Close()
+	}
+	return cl.primary.Close()
+}
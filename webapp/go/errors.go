@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// エラーの応答の code。クライアントが分岐に使うので、値は変えない
+const (
+	errCodeInvalidParameter = "invalid_parameter"
+	errCodeInvalidBody      = "invalid_body"
+	errCodeValidationFailed = "validation_failed"
+	errCodeNotFound         = "not_found"
+	errCodeSoldOut          = "sold_out"
+	errCodeUnauthorized     = "unauthorized"
+	errCodeRateLimited      = "rate_limited"
+	errCodeBlocked          = "blocked"
+	errCodeTimeout          = "timeout"
+	errCodeCanceled         = "canceled"
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeBadRequest       = "bad_request"
+	errCodeInternal         = "internal_error"
+)
+
+// ErrorResponse 全てのハンドラが失敗したときに返す本文
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Field 原因になったクエリ・パス・本文の項目
+	Field string `json:"field,omitempty"`
+	// Errors 本文の検証で見つかった全ての誤り
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// apiError ハンドラはこれを返し、httpErrorHandler が ErrorResponse にする
+type apiError struct {
+	status int
+	ErrorResponse
+	// cause ログにだけ出し、応答には含めない
+	cause error
+}
+
+func (e *apiError) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%v: %v", e.Code, e.cause)
+	}
+	return fmt.Sprintf("%v: %v", e.Code, e.Message)
+}
+
+func newAPIError(status int, code, field, message string) *apiError {
+	return &apiError{status: status, ErrorResponse: ErrorResponse{Code: code, Message: message, Field: field}}
+}
+
+// errInvalidParameter クエリやパスの値が読めない
+func errInvalidParameter(field, message string) *apiError {
+	return newAPIError(http.StatusBadRequest, errCodeInvalidParameter, field, message)
+}
+
+// errInvalidBody 本文が読めないか、必須の項目が無い
+func errInvalidBody(field, message string) *apiError {
+	return newAPIError(http.StatusBadRequest, errCodeInvalidBody, field, message)
+}
+
+func errValidation(errs []FieldError) *apiError {
+	e := newAPIError(http.StatusBadRequest, errCodeValidationFailed, "", "request has invalid fields")
+	e.Errors = errs
+	return e
+}
+
+func errNotFound(message string) *apiError {
+	return newAPIError(http.StatusNotFound, errCodeNotFound, "", message)
+}
+
+// errInternal 原因はログに出し、クライアントには決まった文言だけ返す
+func errInternal(cause error) *apiError {
+	e := newAPIError(http.StatusInternalServerError, errCodeInternal, "", "internal server error")
+	e.cause = cause
+	return e
+}
+
+// httpErrorHandler ハンドラやミドルウェアが返したエラーを ErrorResponse にして返す
+// ルーティングの 404・405 や recover したパニックもここを通る
+func httpErrorHandler(err error, c echo.Context) {
+	e, ok := err.(*apiError)
+	if !ok {
+		e = fromHTTPError(err)
+	}
+	if e.cause != nil {
+		c.Logger().Errorf("%v %v : %v", c.Request().Method, c.Request().URL.Path, e.cause)
+	}
+	if c.Response().Committed {
+		return
+	}
+
+	var werr error
+	if c.Request().Method == http.MethodHead {
+		werr = c.NoContent(e.status)
+	} else {
+		werr = c.JSON(e.status, e.ErrorResponse)
+	}
+	if werr != nil {
+		c.Logger().Errorf("failed to write error response : %v", werr)
+	}
+}
+
+func fromHTTPError(err error) *apiError {
+	he, ok := err.(*echo.HTTPError)
+	if !ok {
+		return errInternal(err)
+	}
+	switch {
+	case he.Code == http.StatusNotFound:
+		return errNotFound("route not found")
+	case he.Code == http.StatusMethodNotAllowed:
+		return newAPIError(he.Code, errCodeMethodNotAllowed, "", "method not allowed")
+	case he.Code >= http.StatusInternalServerError:
+		e := errInternal(err)
+		e.status = he.Code
+		return e
+	default:
+		return newAPIError(he.Code, errCodeBadRequest, "", http.StatusText(he.Code))
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// 検索条件は fixture から読むだけなので起動中は変わらない
+	cacheControlCondition = "public, max-age=3600"
+	// 詳細は在庫や編集で変わるので、毎回 If-None-Match で確認させる
+	cacheControlDetail = "public, no-cache"
+)
+
+// etagBody レスポンスボディと、その内容から計算した強い ETag
+type etagBody struct {
+	body []byte
+	etag string
+}
+
+func newETagBody(v interface{}) (*etagBody, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(body)
+	return &etagBody{body: body, etag: `"` + hex.EncodeToString(sum[:]) + `"`}, nil
+}
+
+// ifNoneMatch If-None-Match が etag に一致するか。If-None-Match は弱い比較なので W/ は無視する
+func ifNoneMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *etagBody) write(c echo.Context, cacheControl string) error {
+	h := c.Response().Header()
+	h.Set("Cache-Control", cacheControl)
+	h.Set("ETag", b.etag)
+	if inm := c.Request().Header.Get("If-None-Match"); inm != "" && ifNoneMatch(inm, b.etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSONCharsetUTF8, b.body)
+}
+
+// jsonWithETag c.JSON の代わりに使い、内容が変わっていなければ 304 を返す
+func jsonWithETag(c echo.Context, cacheControl string, v interface{}) error {
+	b, err := newETagBody(v)
+	if err != nil {
+		return err
+	}
+	return b.write(c, cacheControl)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// 何件書き出すごとにクライアントへ flush するか
+const exportFlushInterval = 1000
+
+const (
+	exportFormatCSV    = "csv"
+	exportFormatNDJSON = "ndjson"
+)
+
+func newJSONChair(chair Chair) JSONChair {
+	return JSONChair{
+		ID:          chair.ID,
+		Name:        chair.Name,
+		Description: chair.Description,
+		Thumbnail:   chair.Thumbnail,
+		Price:       chair.Price,
+		Height:      chair.Height,
+		Width:       chair.Width,
+		Depth:       chair.Depth,
+		Color:       chair.Color,
+		Features:    chair.Features,
+		Popularity:  chair.Popularity,
+		Kind:        chair.Kind,
+		Stock:       chair.Stock,
+	}
+}
+
+func newJSONEstate(estate Estate) JSONEstate {
+	return JSONEstate{
+		ID:          estate.ID,
+		Thumbnail:   estate.Thumbnail,
+		Name:        estate.Name,
+		Description: estate.Description,
+		Address:     estate.Address,
+		Latitude:    estate.Latitude,
+		Longitude:   estate.Longitude,
+		DoorHeight:  estate.DoorHeight,
+		DoorWidth:   estate.DoorWidth,
+		Popularity:  estate.Popularity,
+		Rent:        estate.Rent,
+		Features:    estate.Features,
+	}
+}
+
+// chairRecord postChair が受け付ける列順 (chairColumns) の CSV レコードにする
+func chairRecord(chair Chair) []string {
+	return []string{
+		strconv.FormatInt(chair.ID, 10),
+		chair.Name,
+		chair.Description,
+		chair.Thumbnail,
+		strconv.FormatInt(chair.Price, 10),
+		strconv.FormatInt(chair.Height, 10),
+		strconv.FormatInt(chair.Width, 10),
+		strconv.FormatInt(chair.Depth, 10),
+		chair.Color,
+		chair.Features,
+		chair.Kind,
+		strconv.FormatInt(chair.Popularity, 10),
+		strconv.FormatInt(chair.Stock, 10),
+	}
+}
+
+// estateRecord postEstate が受け付ける列順 (estateColumns) の CSV レコードにする
+func estateRecord(estate Estate) []string {
+	return []string{
+		strconv.FormatInt(estate.ID, 10),
+		estate.Name,
+		estate.Description,
+		estate.Thumbnail,
+		estate.Address,
+		strconv.FormatFloat(estate.Latitude, 'f', -1, 64),
+		strconv.FormatFloat(estate.Longitude, 'f', -1, 64),
+		strconv.FormatInt(estate.Rent, 10),
+		strconv.FormatInt(estate.DoorHeight, 10),
+		strconv.FormatInt(estate.DoorWidth, 10),
+		estate.Features,
+		strconv.FormatInt(estate.Popularity, 10),
+	}
+}
+
+// exportWriter CSV と NDJSON の書き出しをまとめたもの
+type exportWriter struct {
+	res   *echo.Response
+	csv   *csv.Writer
+	json  *json.Encoder
+	count int
+}
+
+func exportFormat(c echo.Context) (string, error) {
+	switch format := c.QueryParam("format"); format {
+	case "":
+		return exportFormatCSV, nil
+	case exportFormatCSV, exportFormatNDJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+func newExportWriter(c echo.Context, name, format string) *exportWriter {
+	res := c.Response()
+	w := &exportWriter{res: res}
+	switch format {
+	case exportFormatCSV:
+		res.Header().Set(echo.HeaderContentType, "text/csv; charset=UTF-8")
+		w.csv = csv.NewWriter(res)
+	default:
+		res.Header().Set(echo.HeaderContentType, mimeApplicationNDJSON)
+		w.json = json.NewEncoder(res)
+	}
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	res.WriteHeader(http.StatusOK)
+	return w
+}
+
+func (w *exportWriter) write(record []string, v interface{}) error {
+	var err error
+	if w.csv != nil {
+		err = w.csv.Write(record)
+	} else {
+		err = w.json.Encode(v)
+	}
+	if err != nil {
+		return err
+	}
+	w.count++
+	if w.count%exportFlushInterval == 0 {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *exportWriter) flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	w.res.Flush()
+	return nil
+}
+
+// exportChairs 在庫を含む全てのイスを postChair で再入稿できる形で書き出す
+func exportChairs(c echo.Context) error {
+	format, err := exportFormat(c)
+	if err != nil {
+		c.Logger().Infof("exportChairs invalid format : %v", err)
+		return errInvalidParameter("format", "format must be csv or ndjson")
+	}
+
+	w := newExportWriter(c, "chair", format)
+
+	// ヘッダを送った後はステータスを変えられないので、途中のエラーはログに残して打ち切る
+	err = chairStore.EachChair(c.Request().Context(), func(chair Chair) error {
+		return w.write(chairRecord(chair), newJSONChair(chair))
+	})
+	if err != nil {
+		c.Logger().Errorf("exportChairs error : %v", err)
+		return nil
+	}
+	if err := w.flush(); err != nil {
+		c.Logger().Errorf("exportChairs write error : %v", err)
+	}
+	return nil
+}
+
+// exportEstates 全ての物件を postEstate で再入稿できる形で書き出す
+func exportEstates(c echo.Context) error {
+	format, err := exportFormat(c)
+	if err != nil {
+		c.Logger().Infof("exportEstates invalid format : %v", err)
+		return errInvalidParameter("format", "format must be csv or ndjson")
+	}
+
+	w := newExportWriter(c, "estate", format)
+
+	err = estateStore.EachEstate(c.Request().Context(), func(estate Estate) error {
+		return w.write(estateRecord(estate), newJSONEstate(estate))
+	})
+	if err != nil {
+		c.Logger().Errorf("exportEstates error : %v", err)
+		return nil
+	}
+	if err := w.flush(); err != nil {
+		c.Logger().Errorf("exportEstates write error : %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// chair_history / estate_history の event
+// price・stock・rent は変更後の値を記録する
+const (
+	historyEventCreate   = "create"
+	historyEventUpdate   = "update"
+	historyEventPurchase = "purchase"
+	historyEventReserve  = "reserve"
+	historyEventRelease  = "release"
+	historyEventDelete   = "delete"
+)
+
+type ChairHistory struct {
+	Event     string    `json:"event"`
+	Price     int64     `json:"price"`
+	Stock     int64     `json:"stock"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type EstateHistory struct {
+	Event     string    `json:"event"`
+	Rent      int64     `json:"rent"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type ChairHistoryResponse struct {
+	History []ChairHistory `json:"history"`
+}
+
+type EstateHistoryResponse struct {
+	History []EstateHistory `json:"history"`
+}
+
+// historyTime DSN に parseTime を付けていないので、時刻は UNIX_TIMESTAMP で読む
+func historyTime(unix float64) time.Time {
+	sec := int64(unix)
+	return time.Unix(sec, int64((unix-float64(sec))*1e6)*1e3)
+}
+
+func insertChairHistory(ctx context.Context, tx sqlx.ExecerContext, chairID int64, event string, price, stock int64, email string) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO chair_history(chair_id, event, price, stock, email, created_at) VALUES(?, ?, ?, ?, ?, NOW(6))", chairID, event, price, stock, email)
+	return err
+}
+
+func insertEstateHistory(ctx context.Context, tx sqlx.ExecerContext, estateID int64, event string, rent int64) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO estate_history(estate_id, event, rent, created_at) VALUES(?, ?, ?, NOW(6))", estateID, event, rent)
+	return err
+}
+
+// getChairHistory 削除済みのイスでも履歴があれば返す
+func getChairHistory(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return errInvalidParameter("id", "id must be an integer")
+	}
+
+	history, err := chairStore.ChairHistory(c.Request().Context(), int64(id))
+	if err != nil {
+		return errInternal(fmt.Errorf("getChairHistory DB execution error : %v", err))
+	}
+	if len(history) == 0 {
+		if _, err := chairStore.GetChair(c.Request().Context(), int64(id)); err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("getChairHistory chair id \"%v\" not found", id)
+			return errNotFound("chair not found")
+		} else if err != nil {
+			return errInternal(fmt.Errorf("getChairHistory DB execution error : %v", err))
+		}
+	}
+
+	return c.JSON(http.StatusOK, ChairHistoryResponse{History: history})
+}
+
+func getEstateHistory(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return errInvalidParameter("id", "id must be an integer")
+	}
+
+	history, err := estateStore.EstateHistory(c.Request().Context(), int64(id))
+	if err != nil {
+		return errInternal(fmt.Errorf("getEstateHistory DB execution error : %v", err))
+	}
+	if len(history) == 0 {
+		if _, err := estateStore.GetEstate(c.Request().Context(), int64(id)); err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("getEstateHistory estate id \"%v\" not found", id)
+			return errNotFound("estate not found")
+		} else if err != nil {
+			return errInternal(fmt.Errorf("getEstateHistory DB execution error : %v", err))
+		}
+	}
+
+	return c.JSON(http.StatusOK, EstateHistoryResponse{History: history})
+}
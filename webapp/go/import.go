@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"sort"
+
+	"github.com/labstack/echo"
+)
+
+// postChair / postEstate が受け付ける CSV の列順
+var chairColumns = []string{"id", "name", "description", "thumbnail", "price", "height", "width", "depth", "color", "features", "kind", "popularity", "stock"}
+var estateColumns = []string{"id", "name", "description", "thumbnail", "address", "latitude", "longitude", "rent", "doorHeight", "doorWidth", "features", "popularity"}
+
+type RowError struct {
+	Row    int    `json:"row"`
+	Column string `json:"column"`
+	Reason string `json:"reason"`
+}
+
+const mimeApplicationNDJSON = "application/x-ndjson"
+
+// NDJSON の1行あたりの上限
+const maxNDJSONLineSize = 1 << 20
+
+// ImportReport 入稿データの検証結果
+// 誤りがあって取り込まなかったときは ErrorResponse と同じく code と message も返す
+type ImportReport struct {
+	Code    string     `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+	DryRun  bool       `json:"dryRun"`
+	Rows    int        `json:"rows"`
+	Errors  []RowError `json:"errors"`
+}
+
+type chairRow struct {
+	Row   int
+	Chair Chair
+}
+
+type estateRow struct {
+	Row    int
+	Estate Estate
+}
+
+func isDryRun(c echo.Context) bool {
+	v := c.FormValue("dryRun")
+	return v == "1" || v == "true"
+}
+
+// readCSV CSV として読めなかった場合は行番号付きのエラーを返す
+func readCSV(r io.Reader) ([][]string, []RowError, error) {
+	reader := csv.NewReader(r)
+	// 列数の不一致は行ごとのエラーとして報告したいので、ここでは検査しない
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if perr, ok := err.(*csv.ParseError); ok {
+		return nil, []RowError{{Row: perr.Line, Reason: perr.Err.Error()}}, nil
+	}
+	return records, nil, err
+}
+
+// readJSONArray 配列の要素ごとに分けて返す。要素の型の誤りは行ごとに報告したいので、ここでは検査しない
+func readJSONArray(r io.Reader) ([]json.RawMessage, []RowError, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	elements := []json.RawMessage{}
+	if err := json.Unmarshal(body, &elements); err != nil {
+		return nil, []RowError{{Reason: fmt.Sprintf("request body is not a JSON array: %v", err)}}, nil
+	}
+	return elements, nil, nil
+}
+
+// readNDJSON 空行を読み飛ばし、行番号と各行を fn に渡す
+func readNDJSON(r io.Reader, fn func(row int, line []byte)) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxNDJSONLineSize)
+	row := 0
+	for scanner.Scan() {
+		row++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		fn(row, line)
+	}
+	return row, scanner.Err()
+}
+
+func jsonRowError(row int, err error) RowError {
+	if terr, ok := err.(*json.UnmarshalTypeError); ok {
+		return RowError{Row: row, Column: terr.Field, Reason: fmt.Sprintf("must be %v", terr.Type)}
+	}
+	return RowError{Row: row, Reason: err.Error()}
+}
+
+func newImportReport(dryRun bool, rows int, errs []RowError) ImportReport {
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Row < errs[j].Row })
+	if errs == nil {
+		errs = []RowError{}
+	}
+	return ImportReport{DryRun: dryRun, Rows: rows, Errors: errs}
+}
+
+func requestMediaType(c echo.Context) string {
+	mediaType, _, err := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+func rowErrors(row int, errs []FieldError) []RowError {
+	rowErrs := make([]RowError, 0, len(errs))
+	for _, e := range errs {
+		rowErrs = append(rowErrs, RowError{Row: row, Column: e.Field, Reason: e.Reason})
+	}
+	return rowErrs
+}
+
+func columnCountError(row int, columns []string, record []string) RowError {
+	return RowError{
+		Row:    row,
+		Reason: fmt.Sprintf("expected %v columns, got %v", len(columns), len(record)),
+	}
+}
+
+// JSONChair JSON / NDJSON 入稿の1件分。ベンチマーカーの asset.JSONChair と同じ形
+type JSONChair struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Thumbnail   string `json:"thumbnail"`
+	Price       int64  `json:"price"`
+	Height      int64  `json:"height"`
+	Width       int64  `json:"width"`
+	Depth       int64  `json:"depth"`
+	Color       string `json:"color"`
+	Features    string `json:"features"`
+	Popularity  int64  `json:"popularity"`
+	Kind        string `json:"kind"`
+	Stock       int64  `json:"stock"`
+}
+
+func (j JSONChair) toChair() Chair {
+	return Chair{
+		ID:          j.ID,
+		Name:        j.Name,
+		Description: j.Description,
+		Thumbnail:   j.Thumbnail,
+		Price:       j.Price,
+		Height:      j.Height,
+		Width:       j.Width,
+		Depth:       j.Depth,
+		Color:       j.Color,
+		Features:    j.Features,
+		Kind:        j.Kind,
+		Popularity:  j.Popularity,
+		Stock:       j.Stock,
+	}
+}
+
+// JSONEstate JSON / NDJSON 入稿の1件分。ベンチマーカーの asset.JSONEstate と同じ形
+type JSONEstate struct {
+	ID          int64   `json:"id"`
+	Thumbnail   string  `json:"thumbnail"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Address     string  `json:"address"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	DoorHeight  int64   `json:"doorHeight"`
+	DoorWidth   int64   `json:"doorWidth"`
+	Popularity  int64   `json:"popularity"`
+	Rent        int64   `json:"rent"`
+	Features    string  `json:"features"`
+}
+
+func (j JSONEstate) toEstate() Estate {
+	return Estate{
+		ID:          j.ID,
+		Thumbnail:   j.Thumbnail,
+		Name:        j.Name,
+		Description: j.Description,
+		Address:     j.Address,
+		Latitude:    j.Latitude,
+		Longitude:   j.Longitude,
+		Rent:        j.Rent,
+		DoorHeight:  j.DoorHeight,
+		DoorWidth:   j.DoorWidth,
+		Features:    j.Features,
+		Popularity:  j.Popularity,
+	}
+}
+
+func decodeChairCSV(r io.Reader) ([]chairRow, []RowError, int, error) {
+	records, errs, err := readCSV(r)
+	if err != nil || errs != nil {
+		return nil, errs, len(records), err
+	}
+	rows, errs := parseChairCSV(records)
+	return rows, errs, len(records), nil
+}
+
+func decodeChairJSON(r io.Reader) ([]chairRow, []RowError, int, error) {
+	elements, errs, err := readJSONArray(r)
+	if err != nil || errs != nil {
+		return nil, errs, 0, err
+	}
+	rows := make([]chairRow, 0, len(elements))
+	errs = []RowError{}
+	for i, element := range elements {
+		var j JSONChair
+		if err := json.Unmarshal(element, &j); err != nil {
+			errs = append(errs, jsonRowError(i+1, err))
+			continue
+		}
+		rows = append(rows, chairRow{Row: i + 1, Chair: j.toChair()})
+	}
+	return rows, errs, len(elements), nil
+}
+
+func decodeChairNDJSON(r io.Reader) ([]chairRow, []RowError, int, error) {
+	rows := []chairRow{}
+	errs := []RowError{}
+	total, err := readNDJSON(r, func(row int, line []byte) {
+		var j JSONChair
+		if err := json.Unmarshal(line, &j); err != nil {
+			errs = append(errs, jsonRowError(row, err))
+			return
+		}
+		rows = append(rows, chairRow{Row: row, Chair: j.toChair()})
+	})
+	return rows, errs, total, err
+}
+
+func decodeEstateCSV(r io.Reader) ([]estateRow, []RowError, int, error) {
+	records, errs, err := readCSV(r)
+	if err != nil || errs != nil {
+		return nil, errs, len(records), err
+	}
+	rows, errs := parseEstateCSV(records)
+	return rows, errs, len(records), nil
+}
+
+func decodeEstateJSON(r io.Reader) ([]estateRow, []RowError, int, error) {
+	elements, errs, err := readJSONArray(r)
+	if err != nil || errs != nil {
+		return nil, errs, 0, err
+	}
+	rows := make([]estateRow, 0, len(elements))
+	errs = []RowError{}
+	for i, element := range elements {
+		var j JSONEstate
+		if err := json.Unmarshal(element, &j); err != nil {
+			errs = append(errs, jsonRowError(i+1, err))
+			continue
+		}
+		rows = append(rows, estateRow{Row: i + 1, Estate: j.toEstate()})
+	}
+	return rows, errs, len(elements), nil
+}
+
+func decodeEstateNDJSON(r io.Reader) ([]estateRow, []RowError, int, error) {
+	rows := []estateRow{}
+	errs := []RowError{}
+	total, err := readNDJSON(r, func(row int, line []byte) {
+		var j JSONEstate
+		if err := json.Unmarshal(line, &j); err != nil {
+			errs = append(errs, jsonRowError(row, err))
+			return
+		}
+		rows = append(rows, estateRow{Row: row, Estate: j.toEstate()})
+	})
+	return rows, errs, total, err
+}
+
+// parseChairCSV 型変換に失敗した行はエラーとして返し、rows には含めない
+func parseChairCSV(records [][]string) ([]chairRow, []RowError) {
+	rows := make([]chairRow, 0, len(records))
+	errs := []RowError{}
+	for i, record := range records {
+		row := i + 1
+		if len(record) != len(chairColumns) {
+			errs = append(errs, columnCountError(row, chairColumns, record))
+			continue
+		}
+		rm := RecordMapper{Record: record, Columns: chairColumns}
+		chair := Chair{
+			ID:          int64(rm.NextInt()),
+			Name:        rm.NextString(),
+			Description: rm.NextString(),
+			Thumbnail:   rm.NextString(),
+			Price:       int64(rm.NextInt()),
+			Height:      int64(rm.NextInt()),
+			Width:       int64(rm.NextInt()),
+			Depth:       int64(rm.NextInt()),
+			Color:       rm.NextString(),
+			Features:    rm.NextString(),
+			Kind:        rm.NextString(),
+			Popularity:  int64(rm.NextInt()),
+			Stock:       int64(rm.NextInt()),
+		}
+		if rm.Err() != nil {
+			errs = append(errs, rowErrors(row, rm.Errs())...)
+			continue
+		}
+		rows = append(rows, chairRow{Row: row, Chair: chair})
+	}
+	return rows, errs
+}
+
+func parseEstateCSV(records [][]string) ([]estateRow, []RowError) {
+	rows := make([]estateRow, 0, len(records))
+	errs := []RowError{}
+	for i, record := range records {
+		row := i + 1
+		if len(record) != len(estateColumns) {
+			errs = append(errs, columnCountError(row, estateColumns, record))
+			continue
+		}
+		rm := RecordMapper{Record: record, Columns: estateColumns}
+		estate := Estate{
+			ID:          int64(rm.NextInt()),
+			Name:        rm.NextString(),
+			Description: rm.NextString(),
+			Thumbnail:   rm.NextString(),
+			Address:     rm.NextString(),
+			Latitude:    rm.NextFloat(),
+			Longitude:   rm.NextFloat(),
+			Rent:        int64(rm.NextInt()),
+			DoorHeight:  int64(rm.NextInt()),
+			DoorWidth:   int64(rm.NextInt()),
+			Features:    rm.NextString(),
+			Popularity:  int64(rm.NextInt()),
+		}
+		if rm.Err() != nil {
+			errs = append(errs, rowErrors(row, rm.Errs())...)
+			continue
+		}
+		rows = append(rows, estateRow{Row: row, Estate: estate})
+	}
+	return rows, errs
+}
+
+// validateChairRows 各行の値の検証と、ファイル内・登録済みデータとの ID 重複の検査を行う
+func validateChairRows(ctx context.Context, rows []chairRow) ([]RowError, error) {
+	errs := []RowError{}
+	seen := make(map[int64]int, len(rows))
+	ids := make([]int64, 0, len(rows))
+	for _, r := range rows {
+		errs = append(errs, rowErrors(r.Row, validateChair(&r.Chair))...)
+		if first, ok := seen[r.Chair.ID]; ok {
+			errs = append(errs, RowError{Row: r.Row, Column: "id", Reason: fmt.Sprintf("duplicate id %v (first seen at row %v)", r.Chair.ID, first)})
+			continue
+		}
+		seen[r.Chair.ID] = r.Row
+		ids = append(ids, r.Chair.ID)
+	}
+
+	existing, err := chairStore.ExistingChairIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range existing {
+		errs = append(errs, RowError{Row: seen[id], Column: "id", Reason: fmt.Sprintf("id %v already exists", id)})
+	}
+	return errs, nil
+}
+
+func validateEstateRows(ctx context.Context, rows []estateRow) ([]RowError, error) {
+	errs := []RowError{}
+	seen := make(map[int64]int, len(rows))
+	ids := make([]int64, 0, len(rows))
+	for _, r := range rows {
+		errs = append(errs, rowErrors(r.Row, validateEstate(&r.Estate))...)
+		if first, ok := seen[r.Estate.ID]; ok {
+			errs = append(errs, RowError{Row: r.Row, Column: "id", Reason: fmt.Sprintf("duplicate id %v (first seen at row %v)", r.Estate.ID, first)})
+			continue
+		}
+		seen[r.Estate.ID] = r.Row
+		ids = append(ids, r.Estate.ID)
+	}
+
+	existing, err := estateStore.ExistingEstateIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range existing {
+		errs = append(errs, RowError{Row: seen[id], Column: "id", Reason: fmt.Sprintf("id %v already exists", id)})
+	}
+	return errs, nil
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	changeTargetChair  = "chair"
+	changeTargetEstate = "estate"
+)
+
+// maxChangeEventIDs これより多くの行が変わったら ID を送らず、受け取ったノードに全て読み直させる
+const maxChangeEventIDs = 1000
+
+const (
+	// changePublishTimeout 通知が送れなくても書き込みのリクエストは長く待たせない
+	changePublishTimeout = time.Second
+	// changeApplyTimeout 受け取った通知でカタログを読み直すときの期限
+	changeApplyTimeout = 10 * time.Second
+)
+
+// ChangeEvent 他のノードに送る書き込みの通知
+type ChangeEvent struct {
+	// Node 送ったノード。自分が送った通知は受け取っても無視する
+	Node   string `json:"node"`
+	Target string `json:"target"`
+	// IDs 変わった行。空なら全ての行を読み直す
+	IDs []int64 `json:"ids,omitempty"`
+	// Searches 検索結果が変わったかどうか。在庫が残っている購入のように、行だけ読み直せばよい書き込みもある
+	Searches bool `json:"searches"`
+}
+
+// InvalidationBus ノードの間で書き込みを通知する。INVALIDATION_BUS で選ぶ
+// 送った通知は自分にも届くことがある。届いた通知は作るときに渡した関数に渡す
+type InvalidationBus interface {
+	Publish(ctx context.Context, ev ChangeEvent) error
+	Close() error
+}
+
+// changeApplier 他のノードの書き込みを反映するストア。カタログはメモリに持つ行を読み直す
+type changeApplier interface {
+	applyChange(ctx context.Context, ev ChangeEvent) error
+}
+
+// changes nil なら他のノードには通知しない
+var changes *changeNotifier
+
+type changeNotifier struct {
+	node   string
+	bus    InvalidationBus
+	logger echo.Logger
+}
+
+// newChangeNotifier INVALIDATION_BUS が空なら nil を返し、このノードだけで動く
+// local は同じプロセスの中、multicast は INVALIDATION_MULTICAST_ADDR の UDP マルチキャスト、
+// redis は INVALIDATION_REDIS_ADDR の INVALIDATION_REDIS_CHANNEL で通知を送る
+func newChangeNotifier(logger echo.Logger) (*changeNotifier, error) {
+	name := getEnv("INVALIDATION_BUS", "")
+	if name == "" {
+		return nil, nil
+	}
+	n := &changeNotifier{node: getEnv("NODE_ID", defaultNodeID()), logger: logger}
+	var err error
+	switch name {
+	case "local":
+		n.bus = defaultLocalBusHub.join(n.receive)
+	case "multicast":
+		n.bus, err = newMulticastBus(getEnv("INVALIDATION_MULTICAST_ADDR", "239.255.0.1:19999"), getEnv("INVALIDATION_MULTICAST_INTERFACE", ""), n.receive, logger)
+	case "redis":
+		n.bus, err = newRedisBus(getEnv("INVALIDATION_REDIS_ADDR", "127.0.0.1:6379"), getEnv("INVALIDATION_REDIS_CHANNEL", "isuumo:changes"), n.receive, logger)
+	default:
+		return nil, fmt.Errorf("unknown invalidation bus %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func defaultNodeID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%v-%v", host, os.Getpid())
+}
+
+func (n *changeNotifier) Close() error {
+	if n == nil {
+		return nil
+	}
+	return n.bus.Close()
+}
+
+// publish 書き込みは確定しているので、通知に失敗してもログに残すだけにする
+func (n *changeNotifier) publish(ctx context.Context, ev ChangeEvent) {
+	if n == nil || (ev.IDs != nil && len(ev.IDs) == 0) {
+		return
+	}
+	ev.Node = n.node
+	if len(ev.IDs) > maxChangeEventIDs {
+		ev.IDs = nil
+	}
+	ctx, cancel := detachContext(ctx)
+	defer cancel()
+	ctx, cancelPublish := context.WithTimeout(ctx, changePublishTimeout)
+	defer cancelPublish()
+	if err := n.bus.Publish(ctx, ev); err != nil {
+		n.logger.Errorf("failed to publish %v change : %v", ev.Target, err)
+	}
+}
+
+func (n *changeNotifier) receive(ev ChangeEvent) {
+	if ev.Node == n.node {
+		return
+	}
+	ctx, cancel := context.WithTimeout(withQueryRoute(context.Background(), "invalidation"), changeApplyTimeout)
+	defer cancel()
+	if err := applyChange(ctx, ev); err != nil {
+		n.logger.Errorf("failed to apply %v change from %v : %v", ev.Target, ev.Node, err)
+	}
+}
+
+// chairsChanged イスを書き込んだ後に呼ぶ。searches は検索結果が変わるかどうかで、ids が nil なら全てのイス
+// このノードのカタログはストアが読み直しているので、ここでは検索結果を捨てて他のノードに知らせる
+func chairsChanged(ctx context.Context, searches bool, ids []int64) {
+	if searches {
+		chairSearches.invalidate()
+	}
+	changes.publish(ctx, ChangeEvent{Target: changeTargetChair, IDs: ids, Searches: searches})
+}
+
+func estatesChanged(ctx context.Context, searches bool, ids []int64) {
+	if searches {
+		estateSearches.invalidate()
+	}
+	changes.publish(ctx, ChangeEvent{Target: changeTargetEstate, IDs: ids, Searches: searches})
+}
+
+// applyChange 他のノードの書き込みをこのノードに反映する。古い行で検索しないよう、読み直してから検索結果を捨てる
+func applyChange(ctx context.Context, ev ChangeEvent) error {
+	var err error
+	if applier, ok := storeBackend.(changeApplier); ok {
+		err = applier.applyChange(ctx, ev)
+	}
+	if ev.Searches {
+		switch ev.Target {
+		case changeTargetChair:
+			chairSearches.invalidate()
+		case changeTargetEstate:
+			estateSearches.invalidate()
+		}
+	}
+	return err
+}
+
+// resyncEvents 通知を取りこぼしたかもしれないときに、全ての行を読み直させる
+func resyncEvents() []ChangeEvent {
+	return []ChangeEvent{
+		{Target: changeTargetChair, Searches: true},
+		{Target: changeTargetEstate, Searches: true},
+	}
+}
+
+// localBusHub 同じプロセスの中のバスをつなぐ。INVALIDATION_BUS=local ではプロセスに1つの hub を使う
+type localBusHub struct {
+	mu    sync.RWMutex
+	buses map[*localBus]bool
+}
+
+var defaultLocalBusHub = &localBusHub{}
+
+type localBus struct {
+	hub    *localBusHub
+	handle func(ChangeEvent)
+}
+
+func (h *localBusHub) join(handle func(ChangeEvent)) *localBus {
+	b := &localBus{hub: h, handle: handle}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.buses == nil {
+		h.buses = map[*localBus]bool{}
+	}
+	h.buses[b] = true
+	return b
+}
+
+// Publish 受け取り側の処理が終わるまで戻らない
+func (b *localBus) Publish(ctx context.Context, ev ChangeEvent) error {
+	b.hub.mu.RLock()
+	buses := make([]*localBus, 0, len(b.hub.buses))
+	for bus := range b.hub.buses {
+		buses = append(buses, bus)
+	}
+	b.hub.mu.RUnlock()
+	for _, bus := range buses {
+		bus.handle(ev)
+	}
+	return nil
+}
+
+func (b *localBus) Close() error {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+	delete(b.hub.buses, b)
+	return nil
+}
+
+// maxMulticastPayload IP のフラグメントで落ちやすくならないよう、大きな通知は ID を送らない
+const maxMulticastPayload = 8192
+
+// multicastBus UDP マルチキャストで通知する。届かなかった通知は送り直さない
+type multicastBus struct {
+	recv   *net.UDPConn
+	send   *net.UDPConn
+	handle func(ChangeEvent)
+	logger echo.Logger
+	closed chan struct{}
+	once   sync.Once
+}
+
+// newMulticastBus ifaceName が空なら受信するインターフェースはシステムに任せる
+func newMulticastBus(addr, ifaceName string, handle func(ChangeEvent), logger echo.Logger) (*multicastBus, error) {
+	group, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	var iface *net.Interface
+	if ifaceName != "" {
+		if iface, err = net.InterfaceByName(ifaceName); err != nil {
+			return nil, err
+		}
+	}
+	recv, err := net.ListenMulticastUDP("udp4", iface, group)
+	if err != nil {
+		return nil, err
+	}
+	send, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		recv.Close()
+		return nil, err
+	}
+	b := &multicastBus{recv: recv, send: send, handle: handle, logger: logger, closed: make(chan struct{})}
+	go b.run()
+	return b, nil
+}
+
+func (b *multicastBus) Publish(ctx context.Context, ev ChangeEvent) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxMulticastPayload {
+		ev.IDs = nil
+		if payload, err = json.Marshal(ev); err != nil {
+			return err
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	b.send.SetWriteDeadline(deadline)
+	_, err = b.send.Write(payload)
+	return err
+}
+
+func (b *multicastBus) run() {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := b.recv.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-b.closed:
+				return
+			default:
+			}
+			b.logger.Errorf("failed to receive multicast change : %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		var ev ChangeEvent
+		if err := json.Unmarshal(buf[:n], &ev); err != nil {
+			b.logger.Warnf("invalid multicast change : %v", err)
+			continue
+		}
+		b.handle(ev)
+	}
+}
+
+func (b *multicastBus) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	b.send.Close()
+	return b.recv.Close()
+}
+
+const (
+	redisDialTimeout       = time.Second
+	redisReconnectInterval = time.Second
+	// maxRESPLength 壊れた応答で大きなバッファを確保しないよう、bulk string と配列の長さを制限する
+	maxRESPLength = 16 << 20
+)
+
+// redisBus Redis 互換のサーバーの PUBLISH / SUBSCRIBE で通知する
+// 購読が切れたら繋ぎ直し、切れていた間の通知は取りこぼしたものとして全て読み直す
+type redisBus struct {
+	addr    string
+	channel string
+	handle  func(ChangeEvent)
+	logger  echo.Logger
+	closed  chan struct{}
+	once    sync.Once
+
+	// mu PUBLISH の接続は1本を順番に使う
+	mu  sync.Mutex
+	pub *redisConn
+
+	subMu sync.Mutex
+	sub   *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newRedisBus(addr, channel string, handle func(ChangeEvent), logger echo.Logger) (*redisBus, error) {
+	b := &redisBus{addr: addr, channel: channel, handle: handle, logger: logger, closed: make(chan struct{})}
+	// 設定の誤りは起動時に気づけるよう、最初の購読は繋がるまで待つ
+	sub, err := b.subscribe(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	go b.run(sub)
+	return b, nil
+}
+
+func (b *redisBus) dial(ctx context.Context) (*redisConn, error) {
+	conn, err := (&net.Dialer{Timeout: redisDialTimeout}).DialContext(ctx, "tcp", b.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (b *redisBus) Publish(ctx context.Context, ev ChangeEvent) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pub == nil {
+		if b.pub, err = b.dial(ctx); err != nil {
+			return err
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	b.pub.SetDeadline(deadline)
+	if err = writeRESPCommand(b.pub, "PUBLISH", b.channel, string(payload)); err == nil {
+		_, err = readRESP(b.pub.r)
+	}
+	if err != nil {
+		// サーバーのエラー応答なら接続はそのまま使える
+		if _, ok := err.(redisError); !ok {
+			b.pub.Close()
+			b.pub = nil
+		}
+		return err
+	}
+	return nil
+}
+
+// subscribe 購読を始め、サーバーが受け付けたら接続を返す
+func (b *redisBus) subscribe(ctx context.Context) (*redisConn, error) {
+	conn, err := b.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(redisDialTimeout))
+	if err := writeRESPCommand(conn, "SUBSCRIBE", b.channel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply, err := readRESP(conn.r)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if msg, ok := reply.([]interface{}); !ok || len(msg) != 3 || msg[0] != "subscribe" {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected reply to SUBSCRIBE: %v", reply)
+	}
+	conn.SetDeadline(time.Time{})
+
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	select {
+	case <-b.closed:
+		conn.Close()
+		return nil, fmt.Errorf("redis bus closed")
+	default:
+	}
+	b.sub = conn
+	return conn, nil
+}
+
+func (b *redisBus) run(sub *redisConn) {
+	for {
+		err := b.receive(sub)
+		sub.Close()
+		for {
+			select {
+			case <-b.closed:
+				return
+			default:
+			}
+			b.logger.Errorf("redis change subscription failed : %v", err)
+			select {
+			case <-b.closed:
+				return
+			case <-time.After(redisReconnectInterval):
+			}
+			if sub, err = b.subscribe(context.Background()); err == nil {
+				break
+			}
+		}
+		for _, ev := range resyncEvents() {
+			b.handle(ev)
+		}
+	}
+}
+
+func (b *redisBus) receive(sub *redisConn) error {
+	for {
+		reply, err := readRESP(sub.r)
+		if err != nil {
+			return err
+		}
+		msg, ok := reply.([]interface{})
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+		payload, _ := msg[2].(string)
+		var ev ChangeEvent
+		if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+			b.logger.Warnf("invalid redis change : %v", err)
+			continue
+		}
+		b.handle(ev)
+	}
+}
+
+func (b *redisBus) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	b.subMu.Lock()
+	if b.sub != nil {
+		b.sub.Close()
+	}
+	b.subMu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pub != nil {
+		b.pub.Close()
+		b.pub = nil
+	}
+	return nil
+}
+
+// redisError サーバーが返したエラー応答
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// writeRESPCommand コマンドを bulk string の配列として1回の Write で送る
+func writeRESPCommand(w io.Writer, args ...string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%v\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%v\r\n%v\r\n", len(arg), arg)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readRESP 応答を1つ読む。simple string と bulk string は string、整数は int64、配列は []interface{}、null は nil になる
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid RESP line %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$', '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxRESPLength {
+			return nil, fmt.Errorf("invalid RESP length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if line[0] == '$' {
+			buf := make([]byte, n+2)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, err
+			}
+			return string(buf[:n]), nil
+		}
+		items := []interface{}{}
+		for i := 0; i < n; i++ {
+			item, err := readRESP(r)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unknown RESP type %q", line[0])
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// ChairPatch PATCH /api/chair/:id のリクエストボディ
+// 指定されたフィールドだけを更新する
+type ChairPatch struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Thumbnail   *string `json:"thumbnail"`
+	Price       *int64  `json:"price"`
+	Height      *int64  `json:"height"`
+	Width       *int64  `json:"width"`
+	Depth       *int64  `json:"depth"`
+	Color       *string `json:"color"`
+	Features    *string `json:"features"`
+	Kind        *string `json:"kind"`
+	Popularity  *int64  `json:"popularity"`
+	Stock       *int64  `json:"stock"`
+}
+
+func (p *ChairPatch) apply(chair *Chair) {
+	if p.Name != nil {
+		chair.Name = *p.Name
+	}
+	if p.Description != nil {
+		chair.Description = *p.Description
+	}
+	if p.Thumbnail != nil {
+		chair.Thumbnail = *p.Thumbnail
+	}
+	if p.Price != nil {
+		chair.Price = *p.Price
+	}
+	if p.Height != nil {
+		chair.Height = *p.Height
+	}
+	if p.Width != nil {
+		chair.Width = *p.Width
+	}
+	if p.Depth != nil {
+		chair.Depth = *p.Depth
+	}
+	if p.Color != nil {
+		chair.Color = *p.Color
+	}
+	if p.Features != nil {
+		chair.Features = *p.Features
+	}
+	if p.Kind != nil {
+		chair.Kind = *p.Kind
+	}
+	if p.Popularity != nil {
+		chair.Popularity = *p.Popularity
+	}
+	if p.Stock != nil {
+		chair.Stock = *p.Stock
+	}
+}
+
+// EstatePatch PATCH /api/estate/:id のリクエストボディ
+type EstatePatch struct {
+	Name        *string  `json:"name"`
+	Description *string  `json:"description"`
+	Thumbnail   *string  `json:"thumbnail"`
+	Address     *string  `json:"address"`
+	Latitude    *float64 `json:"latitude"`
+	Longitude   *float64 `json:"longitude"`
+	Rent        *int64   `json:"rent"`
+	DoorHeight  *int64   `json:"doorHeight"`
+	DoorWidth   *int64   `json:"doorWidth"`
+	Features    *string  `json:"features"`
+	Popularity  *int64   `json:"popularity"`
+}
+
+func (p *EstatePatch) apply(estate *Estate) {
+	if p.Name != nil {
+		estate.Name = *p.Name
+	}
+	if p.Description != nil {
+		estate.Description = *p.Description
+	}
+	if p.Thumbnail != nil {
+		estate.Thumbnail = *p.Thumbnail
+	}
+	if p.Address != nil {
+		estate.Address = *p.Address
+	}
+	if p.Latitude != nil {
+		estate.Latitude = *p.Latitude
+	}
+	if p.Longitude != nil {
+		estate.Longitude = *p.Longitude
+	}
+	if p.Rent != nil {
+		estate.Rent = *p.Rent
+	}
+	if p.DoorHeight != nil {
+		estate.DoorHeight = *p.DoorHeight
+	}
+	if p.DoorWidth != nil {
+		estate.DoorWidth = *p.DoorWidth
+	}
+	if p.Features != nil {
+		estate.Features = *p.Features
+	}
+	if p.Popularity != nil {
+		estate.Popularity = *p.Popularity
+	}
+}
+
+func patchChair(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return errInvalidParameter("id", "id must be an integer")
+	}
+
+	var patch ChairPatch
+	if err := c.Bind(&patch); err != nil {
+		c.Echo().Logger.Infof("patch chair failed : %v", err)
+		return errInvalidBody("", "request body is not valid JSON")
+	}
+
+	var stockBefore int64
+	chair, err := chairStore.UpdateChair(c.Request().Context(), int64(id), func(chair *Chair) error {
+		stockBefore = chair.Stock
+		patch.apply(chair)
+		if errs := validateChair(chair); len(errs) > 0 {
+			return validationErrors(errs)
+		}
+		return nil
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("patchChair chair id \"%v\" not found", id)
+			return errNotFound("chair not found")
+		}
+		if errs, ok := err.(validationErrors); ok {
+			c.Echo().Logger.Infof("patchChair chair id \"%v\" invalid : %v", id, errs)
+			return errValidation(errs)
+		}
+		return errInternal(fmt.Errorf("chair update failed : %v", err))
+	}
+	chairsChanged(c.Request().Context(), true, []int64{int64(id)})
+	// 在庫の編集は buyChair と同じく /api/stream の購読者に知らせる
+	if chair.Stock != stockBefore {
+		publishStream(c, streamEventChairStock, ChairStockEvent{ID: chair.ID, Stock: chair.Stock})
+	}
+
+	return c.JSON(http.StatusOK, chair)
+}
+
+func deleteChair(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return errInvalidParameter("id", "id must be an integer")
+	}
+
+	if err := chairStore.DeleteChair(c.Request().Context(), int64(id)); err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("deleteChair chair id \"%v\" not found", id)
+			return errNotFound("chair not found")
+		}
+		return errInternal(fmt.Errorf("chair delete failed : %v", err))
+	}
+	chairsChanged(c.Request().Context(), true, []int64{int64(id)})
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func patchEstate(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return errInvalidParameter("id", "id must be an integer")
+	}
+
+	var patch EstatePatch
+	if err := c.Bind(&patch); err != nil {
+		c.Echo().Logger.Infof("patch estate failed : %v", err)
+		return errInvalidBody("", "request body is not valid JSON")
+	}
+
+	estate, err := estateStore.UpdateEstate(c.Request().Context(), int64(id), func(estate *Estate) error {
+		patch.apply(estate)
+		if errs := validateEstate(estate); len(errs) > 0 {
+			return validationErrors(errs)
+		}
+		return nil
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("patchEstate estate id \"%v\" not found", id)
+			return errNotFound("estate not found")
+		}
+		if errs, ok := err.(validationErrors); ok {
+			c.Echo().Logger.Infof("patchEstate estate id \"%v\" invalid : %v", id, errs)
+			return errValidation(errs)
+		}
+		return errInternal(fmt.Errorf("estate update failed : %v", err))
+	}
+	estatesChanged(c.Request().Context(), true, []int64{int64(id)})
+
+	return c.JSON(http.StatusOK, estate)
+}
+
+func deleteEstate(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return errInvalidParameter("id", "id must be an integer")
+	}
+
+	if err := estateStore.DeleteEstate(c.Request().Context(), int64(id)); err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("deleteEstate estate id \"%v\" not found", id)
+			return errNotFound("estate not found")
+		}
+		return errInternal(fmt.Errorf("estate delete failed : %v", err))
+	}
+	estatesChanged(c.Request().Context(), true, []int64{int64(id)})
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
@@ -23,10 +27,10 @@ import (
 const Limit = 20
 const NazotteLimit = 50
 
-var db *sqlx.DB
-var mySQLConnectionData *MySQLConnectionEnv
 var chairSearchCondition ChairSearchCondition
 var estateSearchCondition EstateSearchCondition
+var chairSearchConditionBody *etagBody
+var estateSearchConditionBody *etagBody
 
 type InitializeResponse struct {
 	Language string `json:"language"`
@@ -138,28 +142,52 @@ type MySQLConnectionEnv struct {
 	User     string
 	DBName   string
 	Password string
+	Options  MySQLDSNOptions
+}
+
+// MySQLDSNOptions DSN に付けるドライバの設定。0 や false はドライバの既定値を使う
+type MySQLDSNOptions struct {
+	// InterpolateParams プレースホルダをクライアント側で展開し、prepare の往復を省く
+	InterpolateParams bool
+	ParseTime         bool
+	Timeout           time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
 }
 
 type RecordMapper struct {
 	Record []string
+	// Columns 各列の名前。設定されていれば Errs で列ごとのエラーを返す
+	Columns []string
 
 	offset int
 	err    error
+	errs   []FieldError
 }
 
 func (r *RecordMapper) next() (string, error) {
-	if r.err != nil {
-		return "", r.err
-	}
 	if r.offset >= len(r.Record) {
-		r.err = fmt.Errorf("too many read")
-		return "", r.err
+		if r.err == nil {
+			r.err = fmt.Errorf("too many read")
+		}
+		return "", fmt.Errorf("too many read")
 	}
 	s := r.Record[r.offset]
 	r.offset++
 	return s, nil
 }
 
+func (r *RecordMapper) fail(reason string, err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	column := ""
+	if r.offset-1 < len(r.Columns) {
+		column = r.Columns[r.offset-1]
+	}
+	r.errs = append(r.errs, FieldError{Field: column, Reason: reason})
+}
+
 func (r *RecordMapper) NextInt() int {
 	s, err := r.next()
 	if err != nil {
@@ -167,7 +195,7 @@ func (r *RecordMapper) NextInt() int {
 	}
 	i, err := strconv.Atoi(s)
 	if err != nil {
-		r.err = err
+		r.fail(fmt.Sprintf("%q is not an integer", s), err)
 		return 0
 	}
 	return i
@@ -180,7 +208,7 @@ func (r *RecordMapper) NextFloat() float64 {
 	}
 	f, err := strconv.ParseFloat(s, 64)
 	if err != nil {
-		r.err = err
+		r.fail(fmt.Sprintf("%q is not a number", s), err)
 		return 0
 	}
 	return f
@@ -198,6 +226,10 @@ func (r *RecordMapper) Err() error {
 	return r.err
 }
 
+func (r *RecordMapper) Errs() []FieldError {
+	return r.errs
+}
+
 func NewMySQLConnectionEnv() *MySQLConnectionEnv {
 	return &MySQLConnectionEnv{
 		Host:     getEnv("MYSQL_HOST", "127.0.0.1"),
@@ -205,6 +237,18 @@ func NewMySQLConnectionEnv() *MySQLConnectionEnv {
 		User:     getEnv("MYSQL_USER", "isucon"),
 		DBName:   getEnv("MYSQL_DBNAME", "isuumo"),
 		Password: getEnv("MYSQL_PASS", "isucon"),
+		Options:  NewMySQLDSNOptions(),
+	}
+}
+
+// NewMySQLDSNOptions MYSQL_INTERPOLATE_PARAMS・MYSQL_PARSE_TIME・MYSQL_{,READ_,WRITE_}TIMEOUT から読む
+func NewMySQLDSNOptions() MySQLDSNOptions {
+	return MySQLDSNOptions{
+		InterpolateParams: getEnvBool("MYSQL_INTERPOLATE_PARAMS", false),
+		ParseTime:         getEnvBool("MYSQL_PARSE_TIME", false),
+		Timeout:           getEnvDuration("MYSQL_TIMEOUT", 0),
+		ReadTimeout:       getEnvDuration("MYSQL_READ_TIMEOUT", 0),
+		WriteTimeout:      getEnvDuration("MYSQL_WRITE_TIMEOUT", 0),
 	}
 }
 
@@ -216,29 +260,74 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvBool(key string, defaultValue bool) bool {
+	b, err := strconv.ParseBool(getEnv(key, ""))
+	if err != nil {
+		return defaultValue
+	}
+	return b
+}
+
+// DSN パスワードなどに記号が含まれていてもよいように mysql.Config で組み立てる
+func (mc *MySQLConnectionEnv) DSN() string {
+	return mc.config().FormatDSN()
+}
+
+func (mc *MySQLConnectionEnv) config() *mysql.Config {
+	conf := mysql.NewConfig()
+	conf.User = mc.User
+	conf.Passwd = mc.Password
+	conf.Net = "tcp"
+	conf.Addr = net.JoinHostPort(mc.Host, mc.Port)
+	conf.DBName = mc.DBName
+	conf.InterpolateParams = mc.Options.InterpolateParams
+	conf.ParseTime = mc.Options.ParseTime
+	conf.Timeout = mc.Options.Timeout
+	conf.ReadTimeout = mc.Options.ReadTimeout
+	conf.WriteTimeout = mc.Options.WriteTimeout
+	return conf
+}
+
 //ConnectDB isuumoデータベースに接続する
+//全てのクエリの時間を測るため、ドライバの接続を timedConnector で包む
 func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, error) {
-	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
-	return sqlx.Open("mysql", dsn)
+	connector, err := mysql.NewConnector(mc.config())
+	if err != nil {
+		return nil, err
+	}
+	timed := &timedConnector{Connector: connector}
+	timed.db = sql.OpenDB(timed)
+	return sqlx.NewDb(timed.db, "mysql"), nil
 }
 
-func init() {
-	jsonText, err := ioutil.ReadFile("../fixture/chair_condition.json")
+// loadSearchConditions dir にある検索条件の定義を読み込む
+func loadSearchConditions(dir string) error {
+	jsonText, err := ioutil.ReadFile(filepath.Join(dir, "chair_condition.json"))
 	if err != nil {
-		fmt.Printf("%v\n", err)
-		os.Exit(1)
+		return err
 	}
 	json.Unmarshal(jsonText, &chairSearchCondition)
 
-	jsonText, err = ioutil.ReadFile("../fixture/estate_condition.json")
+	jsonText, err = ioutil.ReadFile(filepath.Join(dir, "estate_condition.json"))
 	if err != nil {
-		fmt.Printf("%v\n", err)
-		os.Exit(1)
+		return err
 	}
 	json.Unmarshal(jsonText, &estateSearchCondition)
+
+	chairSearchConditionBody, err = newETagBody(chairSearchCondition)
+	if err != nil {
+		return err
+	}
+	estateSearchConditionBody, err = newETagBody(estateSearchCondition)
+	return err
 }
 
 func main() {
+	if err := loadSearchConditions(filepath.Join("..", "fixture")); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
 	// Echo instance
 	e := echo.New()
 	e.Debug = true
@@ -248,65 +337,154 @@ func main() {
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
-	// Initialize
-	e.POST("/initialize", initialize)
+	rateLimits, err := newRateLimitConfig()
+	if err != nil {
+		e.Logger.Fatalf("rate limit configuration failed : %v", err)
+	}
+	bots, err = loadBotPolicy(getEnv("BOT_POLICY_FILE", defaultBotPolicyFile))
+	if err != nil {
+		e.Logger.Fatalf("bot policy load failed : %v", err)
+	}
+	timeouts, err := newQueryTimeoutConfig()
+	if err != nil {
+		e.Logger.Fatalf("query timeout configuration failed : %v", err)
+	}
+	slowQueries, err = newSlowQueryLog(e.Logger)
+	if err != nil {
+		e.Logger.Fatalf("slow query log configuration failed : %v", err)
+	}
+	registerRoutes(e, rateLimits, timeouts)
 
-	// Chair Handler
-	e.GET("/api/chair/:id", getChairDetail)
-	e.POST("/api/chair", postChair)
-	e.GET("/api/chair/search", searchChairs)
-	e.GET("/api/chair/low_priced", getLowPricedChair)
-	e.GET("/api/chair/search/condition", getChairSearchCondition)
-	e.POST("/api/chair/buy/:id", buyChair)
+	backend, err := newStoreBackend(getEnv("ISUUMO_STORE", ""), e.Logger)
+	if err != nil {
+		e.Logger.Fatalf("DB connection failed : %v", err)
+	}
+	setStoreBackend(backend)
 
-	// Estate Handler
-	e.GET("/api/estate/:id", getEstateDetail)
-	e.POST("/api/estate", postEstate)
-	e.GET("/api/estate/search", searchEstates)
-	e.GET("/api/estate/low_priced", getLowPricedEstate)
-	e.POST("/api/estate/req_doc/:id", postEstateRequestDocument)
-	e.POST("/api/estate/nazotte", searchEstateNazotte)
-	e.GET("/api/estate/search/condition", getEstateSearchCondition)
-	e.GET("/api/recommended_estate/:id", searchRecommendedEstateWithChair)
+	changes, err = newChangeNotifier(e.Logger)
+	if err != nil {
+		e.Logger.Fatalf("invalidation bus configuration failed : %v", err)
+	}
 
-	mySQLConnectionData = NewMySQLConnectionEnv()
+	workers := newBackgroundWorkers()
+	reservationTTL = getEnvDuration("RESERVATION_TTL", defaultReservationTTL)
+	sweepInterval := getEnvDuration("RESERVATION_SWEEP_INTERVAL", defaultReservationSweepInterval)
+	workers.start(func(ctx context.Context) {
+		runReservationSweeper(ctx, e, sweepInterval)
+	})
 
-	var err error
-	db, err = mySQLConnectionData.ConnectDB()
-	if err != nil {
-		e.Logger.Fatalf("DB connection failed : %v", err)
+	popularity = newPopularityTracker()
+	if popularity != nil {
+		workers.start(func(ctx context.Context) {
+			popularity.run(ctx, e)
+		})
+	}
+
+	dispatcher := newWebhookDispatcher()
+	workers.start(func(ctx context.Context) {
+		dispatcher.run(ctx, e)
+	})
+
+	searchCacheTTL := getEnvDuration("SEARCH_CACHE_TTL", 0)
+	chairSearches = newSearchCache(searchCacheTTL)
+	estateSearches = newSearchCache(searchCacheTTL)
+
+	if n, err := strconv.Atoi(getEnv("STREAM_BUFFER_SIZE", "")); err == nil && n > 0 {
+		stream = newStreamHub(n)
 	}
-	db.SetMaxOpenConns(10)
-	defer db.Close()
 
 	// Start server
-	serverPort := fmt.Sprintf(":%v", getEnv("SERVER_PORT", "1323"))
-	e.Logger.Fatal(e.Start(serverPort))
+	ln, err := listen()
+	if err != nil {
+		e.Logger.Fatalf("listen failed : %v", err)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	err = serve(e, ln, workers, signals,
+		getEnvDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout),
+		getEnvDuration("WORKER_STOP_TIMEOUT", defaultWorkerStopTimeout))
+
+	// 処理中のリクエストとバックグラウンドの処理が終わってから、通知を止めて DB を閉じる
+	// 戻らなかった処理が使っているかもしれないので、その場合は閉じずにプロセスの終了に任せる
+	if workers.stopped() {
+		changes.Close()
+		if cerr := backend.Close(); cerr != nil {
+			e.Logger.Errorf("failed to close DB : %v", cerr)
+		}
+	} else {
+		e.Logger.Errorf("background workers are still running, leaving DB open")
+	}
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+}
+
+func registerRoutes(e *echo.Echo, rateLimits *rateLimitConfig, timeouts *queryTimeoutConfig) {
+	searchLimit := rateLimits.middleware(rateLimitGroupSearch)
+	detailLimit := rateLimits.middleware(rateLimitGroupDetail)
+	writeLimit := rateLimits.middleware(rateLimitGroupWrite)
+	searchTimeout := timeouts.middleware(rateLimitGroupSearch)
+	detailTimeout := timeouts.middleware(rateLimitGroupDetail)
+	writeTimeout := timeouts.middleware(rateLimitGroupWrite)
+	exportTimeout := timeouts.middleware(queryTimeoutGroupExport)
+	e.HTTPErrorHandler = httpErrorHandler
+	e.Use(queryRouteMiddleware)
+	admin := adminAuth(getEnv("ADMIN_TOKEN", ""))
+
+	// Initialize
+	e.POST("/initialize", initialize)
+
+	// Chair Handler
+	e.GET("/api/chair/:id", getChairDetail, detailLimit, detailTimeout)
+	e.PATCH("/api/chair/:id", patchChair, admin, writeLimit, writeTimeout)
+	e.DELETE("/api/chair/:id", deleteChair, admin, writeLimit, writeTimeout)
+	e.GET("/api/chair/:id/history", getChairHistory, admin, detailLimit, detailTimeout)
+	e.POST("/api/chair", postChair, writeLimit, writeTimeout)
+	e.GET("/api/chair/search", searchChairs, searchLimit, searchTimeout)
+	e.GET("/api/chair/low_priced", getLowPricedChair, searchLimit, searchTimeout)
+	e.GET("/api/chair/export", exportChairs, admin, searchLimit, exportTimeout)
+	e.GET("/api/chair/search/condition", getChairSearchCondition, searchLimit, searchTimeout)
+	e.POST("/api/chair/buy/:id", buyChair, writeLimit, writeTimeout)
+	e.POST("/api/chair/reserve/:id", reserveChair, writeLimit, writeTimeout)
+
+	// Estate Handler
+	e.GET("/api/estate/:id", getEstateDetail, detailLimit, detailTimeout)
+	e.PATCH("/api/estate/:id", patchEstate, admin, writeLimit, writeTimeout)
+	e.DELETE("/api/estate/:id", deleteEstate, admin, writeLimit, writeTimeout)
+	e.GET("/api/estate/:id/history", getEstateHistory, admin, detailLimit, detailTimeout)
+	e.POST("/api/estate", postEstate, writeLimit, writeTimeout)
+	e.GET("/api/estate/search", searchEstates, searchLimit, searchTimeout)
+	e.GET("/api/estate/low_priced", getLowPricedEstate, searchLimit, searchTimeout)
+	e.GET("/api/estate/export", exportEstates, admin, searchLimit, exportTimeout)
+	e.POST("/api/estate/req_doc/:id", postEstateRequestDocument, writeLimit, writeTimeout)
+	e.POST("/api/estate/nazotte", searchEstateNazotte, searchLimit, searchTimeout)
+	e.GET("/api/estate/search/condition", getEstateSearchCondition, searchLimit, searchTimeout)
+	e.GET("/api/recommended_estate/:id", searchRecommendedEstateWithChair, searchLimit, searchTimeout)
+	e.GET("/api/recommended_chair/:id", searchRecommendedChairWithEstate, searchLimit, searchTimeout)
+
+	// Stream Handler
+	e.GET("/api/stream", getStream, detailLimit)
+
+	// Webhook Handler
+	e.POST("/api/webhook", postWebhook, admin, writeLimit, writeTimeout)
+	e.GET("/api/webhook", getWebhooks, admin, detailLimit, detailTimeout)
+	e.DELETE("/api/webhook/:id", deleteWebhook, admin, writeLimit, writeTimeout)
+
+	// Admin Handler
+	e.GET("/api/admin/bot_rules", getBotRules, admin)
+	e.POST("/api/admin/bot_rules", postBotRule, admin)
+	e.PATCH("/api/admin/bot_rules/:id", patchBotRule, admin)
+	e.DELETE("/api/admin/bot_rules/:id", deleteBotRule, admin)
+	e.GET("/api/admin/slow_queries", getSlowQueries, admin)
+	e.DELETE("/api/admin/slow_queries", deleteSlowQueries, admin)
 }
 
 func initialize(c echo.Context) error {
-	sqlDir := filepath.Join("..", "mysql", "db")
-	paths := []string{
-		filepath.Join(sqlDir, "0_Schema.sql"),
-		filepath.Join(sqlDir, "1_DummyEstateData.sql"),
-		filepath.Join(sqlDir, "2_DummyChairData.sql"),
-	}
-
-	for _, p := range paths {
-		sqlFile, _ := filepath.Abs(p)
-		cmdStr := fmt.Sprintf("mysql -h %v -u %v -p%v -P %v %v < %v",
-			mySQLConnectionData.Host,
-			mySQLConnectionData.User,
-			mySQLConnectionData.Password,
-			mySQLConnectionData.Port,
-			mySQLConnectionData.DBName,
-			sqlFile,
-		)
-		if err := exec.Command("bash", "-c", cmdStr).Run(); err != nil {
-			c.Logger().Errorf("Initialize script error : %v", err)
-			return c.NoContent(http.StatusInternalServerError)
-		}
+	if err := storeBackend.Initialize(c.Request().Context()); err != nil {
+		return errInternal(fmt.Errorf("Initialize script error : %v", err))
 	}
+	chairsChanged(c.Request().Context(), true, nil)
+	estatesChanged(c.Request().Context(), true, nil)
 
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "go",
@@ -317,216 +495,157 @@ func getChairDetail(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		c.Echo().Logger.Errorf("Request parameter \"id\" parse error : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParameter("id", "id must be an integer")
 	}
 
-	chair := Chair{}
-	query := `SELECT * FROM chair WHERE id = ?`
-	err = db.Get(&chair, query, id)
+	chair, err := chairStore.GetChair(c.Request().Context(), int64(id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.Echo().Logger.Infof("requested id's chair not found : %v", id)
-			return c.NoContent(http.StatusNotFound)
+			return errNotFound("chair not found")
 		}
-		c.Echo().Logger.Errorf("Failed to get the chair from id : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return errInternal(fmt.Errorf("Failed to get the chair from id : %v", err))
 	} else if chair.Stock <= 0 {
 		c.Echo().Logger.Infof("requested id's chair is sold out : %v", id)
-		return c.NoContent(http.StatusNotFound)
+		return newAPIError(http.StatusNotFound, errCodeSoldOut, "", "chair is sold out")
 	}
 
-	return c.JSON(http.StatusOK, chair)
+	popularity.chairViewed(chair.ID)
+	return jsonWithETag(c, cacheControlDetail, chair)
 }
 
 func postChair(c echo.Context) error {
-	header, err := c.FormFile("chairs")
-	if err != nil {
-		c.Logger().Errorf("failed to get form file: %v", err)
-		return c.NoContent(http.StatusBadRequest)
-	}
-	f, err := header.Open()
-	if err != nil {
-		c.Logger().Errorf("failed to open form file: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer f.Close()
-	records, err := csv.NewReader(f).ReadAll()
-	if err != nil {
-		c.Logger().Errorf("failed to read csv: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	tx, err := db.Begin()
-	if err != nil {
-		c.Logger().Errorf("failed to begin tx: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer tx.Rollback()
-	for _, row := range records {
-		rm := RecordMapper{Record: row}
-		id := rm.NextInt()
-		name := rm.NextString()
-		description := rm.NextString()
-		thumbnail := rm.NextString()
-		price := rm.NextInt()
-		height := rm.NextInt()
-		width := rm.NextInt()
-		depth := rm.NextInt()
-		color := rm.NextString()
-		features := rm.NextString()
-		kind := rm.NextString()
-		popularity := rm.NextInt()
-		stock := rm.NextInt()
-		if err := rm.Err(); err != nil {
-			c.Logger().Errorf("failed to read record: %v", err)
-			return c.NoContent(http.StatusBadRequest)
+	var rows []chairRow
+	var rowErrs []RowError
+	var total int
+	var err error
+
+	switch requestMediaType(c) {
+	case echo.MIMEApplicationJSON:
+		rows, rowErrs, total, err = decodeChairJSON(c.Request().Body)
+	case mimeApplicationNDJSON:
+		rows, rowErrs, total, err = decodeChairNDJSON(c.Request().Body)
+	default:
+		header, ferr := c.FormFile("chairs")
+		if ferr != nil {
+			c.Logger().Errorf("failed to get form file: %v", ferr)
+			return errInvalidBody("chairs", "chairs file is required")
 		}
-		_, err := tx.Exec("INSERT INTO chair(id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)", id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock)
-		if err != nil {
-			c.Logger().Errorf("failed to insert chair: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
+		f, ferr := header.Open()
+		if ferr != nil {
+			return errInternal(fmt.Errorf("failed to open form file: %v", ferr))
 		}
+		defer f.Close()
+		rows, rowErrs, total, err = decodeChairCSV(f)
+	}
+	if err != nil {
+		return errInternal(fmt.Errorf("failed to read chairs: %v", err))
+	}
+
+	validationErrs, err := validateChairRows(c.Request().Context(), rows)
+	if err != nil {
+		return errInternal(fmt.Errorf("failed to validate chairs: %v", err))
+	}
+	report := newImportReport(isDryRun(c), total, append(rowErrs, validationErrs...))
+	if report.DryRun {
+		return c.JSON(http.StatusOK, report)
+	}
+	if len(report.Errors) > 0 {
+		c.Logger().Infof("failed to read records: %v errors", len(report.Errors))
+		report.Code = errCodeValidationFailed
+		report.Message = "request has invalid rows"
+		return c.JSON(http.StatusBadRequest, report)
+	}
+
+	chairs := make([]Chair, 0, len(rows))
+	for _, row := range rows {
+		chairs = append(chairs, row.Chair)
+	}
+	if err := chairStore.InsertChairs(c.Request().Context(), chairs); err != nil {
+		return errInternal(fmt.Errorf("failed to insert chair: %v", err))
 	}
-	if err := tx.Commit(); err != nil {
-		c.Logger().Errorf("failed to commit tx: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	ids := make([]int64, 0, len(chairs))
+	for _, chair := range chairs {
+		ids = append(ids, chair.ID)
+	}
+	chairsChanged(c.Request().Context(), true, ids)
+	if len(chairs) > 0 {
+		publishStream(c, streamEventChairCreated, ChairCreatedEvent{Chairs: chairs})
 	}
 	return c.NoContent(http.StatusCreated)
 }
 
 func searchChairs(c echo.Context) error {
-	conditions := make([]string, 0)
-	params := make([]interface{}, 0)
+	var q ChairSearchQuery
+	var err error
 
 	if c.QueryParam("priceRangeId") != "" {
-		chairPrice, err := getRange(chairSearchCondition.Price, c.QueryParam("priceRangeId"))
+		q.Price, err = getRange(chairSearchCondition.Price, c.QueryParam("priceRangeId"))
 		if err != nil {
 			c.Echo().Logger.Infof("priceRangeID invalid, %v : %v", c.QueryParam("priceRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-
-		if chairPrice.Min != -1 {
-			conditions = append(conditions, "price >= ?")
-			params = append(params, chairPrice.Min)
-		}
-		if chairPrice.Max != -1 {
-			conditions = append(conditions, "price < ?")
-			params = append(params, chairPrice.Max)
+			return errInvalidParameter("priceRangeId", "priceRangeId is not a valid range id")
 		}
 	}
 
 	if c.QueryParam("heightRangeId") != "" {
-		chairHeight, err := getRange(chairSearchCondition.Height, c.QueryParam("heightRangeId"))
+		q.Height, err = getRange(chairSearchCondition.Height, c.QueryParam("heightRangeId"))
 		if err != nil {
 			c.Echo().Logger.Infof("heightRangeIf invalid, %v : %v", c.QueryParam("heightRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-
-		if chairHeight.Min != -1 {
-			conditions = append(conditions, "height >= ?")
-			params = append(params, chairHeight.Min)
-		}
-		if chairHeight.Max != -1 {
-			conditions = append(conditions, "height < ?")
-			params = append(params, chairHeight.Max)
+			return errInvalidParameter("heightRangeId", "heightRangeId is not a valid range id")
 		}
 	}
 
 	if c.QueryParam("widthRangeId") != "" {
-		chairWidth, err := getRange(chairSearchCondition.Width, c.QueryParam("widthRangeId"))
+		q.Width, err = getRange(chairSearchCondition.Width, c.QueryParam("widthRangeId"))
 		if err != nil {
 			c.Echo().Logger.Infof("widthRangeID invalid, %v : %v", c.QueryParam("widthRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-
-		if chairWidth.Min != -1 {
-			conditions = append(conditions, "width >= ?")
-			params = append(params, chairWidth.Min)
-		}
-		if chairWidth.Max != -1 {
-			conditions = append(conditions, "width < ?")
-			params = append(params, chairWidth.Max)
+			return errInvalidParameter("widthRangeId", "widthRangeId is not a valid range id")
 		}
 	}
 
 	if c.QueryParam("depthRangeId") != "" {
-		chairDepth, err := getRange(chairSearchCondition.Depth, c.QueryParam("depthRangeId"))
+		q.Depth, err = getRange(chairSearchCondition.Depth, c.QueryParam("depthRangeId"))
 		if err != nil {
 			c.Echo().Logger.Infof("depthRangeId invalid, %v : %v", c.QueryParam("depthRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-
-		if chairDepth.Min != -1 {
-			conditions = append(conditions, "depth >= ?")
-			params = append(params, chairDepth.Min)
+			return errInvalidParameter("depthRangeId", "depthRangeId is not a valid range id")
 		}
-		if chairDepth.Max != -1 {
-			conditions = append(conditions, "depth < ?")
-			params = append(params, chairDepth.Max)
-		}
-	}
-
-	if c.QueryParam("kind") != "" {
-		conditions = append(conditions, "kind = ?")
-		params = append(params, c.QueryParam("kind"))
 	}
 
-	if c.QueryParam("color") != "" {
-		conditions = append(conditions, "color = ?")
-		params = append(params, c.QueryParam("color"))
-	}
+	q.Kind = c.QueryParam("kind")
+	q.Color = c.QueryParam("color")
 
 	if c.QueryParam("features") != "" {
-		for _, f := range strings.Split(c.QueryParam("features"), ",") {
-			conditions = append(conditions, "features LIKE CONCAT('%', ?, '%')")
-			params = append(params, f)
-		}
+		q.Features = strings.Split(c.QueryParam("features"), ",")
 	}
 
-	if len(conditions) == 0 {
+	if q.empty() {
 		c.Echo().Logger.Infof("Search condition not found")
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParameter("", "at least one search condition is required")
 	}
 
-	conditions = append(conditions, "stock > 0")
-
-	page, err := strconv.Atoi(c.QueryParam("page"))
+	q.Page, err = strconv.Atoi(c.QueryParam("page"))
 	if err != nil {
 		c.Logger().Infof("Invalid format page parameter : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParameter("page", "page must be a non-negative integer")
 	}
 
-	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	q.PerPage, err = strconv.Atoi(c.QueryParam("perPage"))
 	if err != nil {
 		c.Logger().Infof("Invalid format perPage parameter : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParameter("perPage", "perPage must be a positive integer")
 	}
 
-	searchQuery := "SELECT * FROM chair WHERE "
-	countQuery := "SELECT COUNT(*) FROM chair WHERE "
-	searchCondition := strings.Join(conditions, " AND ")
-	limitOffset := " ORDER BY popularity DESC, id ASC LIMIT ? OFFSET ?"
-
-	var res ChairSearchResponse
-	err = db.Get(&res.Count, countQuery+searchCondition, params...)
-	if err != nil {
-		c.Logger().Errorf("searchChairs DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	chairs := []Chair{}
-	params = append(params, perPage, page*perPage)
-	err = db.Select(&chairs, searchQuery+searchCondition+limitOffset, params...)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, ChairSearchResponse{Count: 0, Chairs: []Chair{}})
+	res, err := chairSearches.get(c.Request().Context(), q.key(), func(ctx context.Context) (interface{}, error) {
+		count, chairs, err := chairStore.SearchChairs(ctx, q)
+		if err != nil {
+			return nil, err
 		}
-		c.Logger().Errorf("searchChairs DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return &ChairSearchResponse{Count: count, Chairs: chairs}, nil
+	})
+	if err != nil {
+		return errInternal(fmt.Errorf("searchChairs DB execution error : %v", err))
 	}
 
-	res.Chairs = chairs
-
 	return c.JSON(http.StatusOK, res)
 }
 
@@ -534,69 +653,49 @@ func buyChair(c echo.Context) error {
 	m := echo.Map{}
 	if err := c.Bind(&m); err != nil {
 		c.Echo().Logger.Infof("post buy chair failed : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return errInvalidBody("", "request body is not valid JSON")
 	}
 
-	_, ok := m["email"].(string)
+	email, ok := m["email"].(string)
 	if !ok {
 		c.Echo().Logger.Info("post buy chair failed : email not found in request body")
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidBody("email", "email is required")
 	}
 
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		c.Echo().Logger.Infof("post buy chair failed : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParameter("id", "id must be an integer")
 	}
 
-	tx, err := db.Beginx()
-	if err != nil {
-		c.Echo().Logger.Errorf("failed to create transaction : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	if token, ok := m["reservationId"].(string); ok && token != "" {
+		return consumeChairReservation(c, id, token, email)
 	}
-	defer tx.Rollback()
 
-	var chair Chair
-	err = tx.QueryRowx("SELECT * FROM chair WHERE id = ? AND stock > 0 FOR UPDATE", id).StructScan(&chair)
+	stock, err := chairStore.BuyChair(c.Request().Context(), int64(id), email)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
-			return c.NoContent(http.StatusNotFound)
+			return errNotFound("chair not found")
 		}
-		c.Echo().Logger.Errorf("DB Execution Error: on getting a chair by id : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	_, err = tx.Exec("UPDATE chair SET stock = stock - 1 WHERE id = ?", id)
-	if err != nil {
-		c.Echo().Logger.Errorf("chair stock update failed : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		c.Echo().Logger.Errorf("transaction commit error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return errInternal(fmt.Errorf("DB Execution Error: on buying a chair by id : %v", err))
 	}
+	// 在庫数は検索結果に含まれないので、検索から消えるときだけ捨てる
+	chairsChanged(c.Request().Context(), stock == 0, []int64{int64(id)})
 
+	popularity.chairPurchased(int64(id))
+	publishStream(c, streamEventChairStock, ChairStockEvent{ID: int64(id), Stock: stock})
 	return c.NoContent(http.StatusOK)
 }
 
 func getChairSearchCondition(c echo.Context) error {
-	return c.JSON(http.StatusOK, chairSearchCondition)
+	return chairSearchConditionBody.write(c, cacheControlCondition)
 }
 
 func getLowPricedChair(c echo.Context) error {
-	var chairs []Chair
-	query := `SELECT * FROM chair WHERE stock > 0 ORDER BY price ASC, id ASC LIMIT ?`
-	err := db.Select(&chairs, query, Limit)
+	chairs, err := chairStore.LowPricedChairs(c.Request().Context(), Limit)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.Logger().Error("getLowPricedChair not found")
-			return c.JSON(http.StatusOK, ChairListResponse{[]Chair{}})
-		}
-		c.Logger().Errorf("getLowPricedChair DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return errInternal(fmt.Errorf("getLowPricedChair DB execution error : %v", err))
 	}
 
 	return c.JSON(http.StatusOK, ChairListResponse{Chairs: chairs})
@@ -606,21 +705,20 @@ func getEstateDetail(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParameter("id", "id must be an integer")
 	}
 
-	var estate Estate
-	err = db.Get(&estate, "SELECT * FROM estate WHERE id = ?", id)
+	estate, err := estateStore.GetEstate(c.Request().Context(), int64(id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.Echo().Logger.Infof("getEstateDetail estate id %v not found", id)
-			return c.NoContent(http.StatusNotFound)
+			return errNotFound("estate not found")
 		}
-		c.Echo().Logger.Errorf("Database Execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return errInternal(fmt.Errorf("Database Execution error : %v", err))
 	}
 
-	return c.JSON(http.StatusOK, estate)
+	popularity.estateViewed(estate.ID)
+	return jsonWithETag(c, cacheControlDetail, estate)
 }
 
 func getRange(cond RangeCondition, rangeID string) (*Range, error) {
@@ -637,178 +735,133 @@ func getRange(cond RangeCondition, rangeID string) (*Range, error) {
 }
 
 func postEstate(c echo.Context) error {
-	header, err := c.FormFile("estates")
-	if err != nil {
-		c.Logger().Errorf("failed to get form file: %v", err)
-		return c.NoContent(http.StatusBadRequest)
-	}
-	f, err := header.Open()
-	if err != nil {
-		c.Logger().Errorf("failed to open form file: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer f.Close()
-	records, err := csv.NewReader(f).ReadAll()
-	if err != nil {
-		c.Logger().Errorf("failed to read csv: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	tx, err := db.Begin()
-	if err != nil {
-		c.Logger().Errorf("failed to begin tx: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer tx.Rollback()
-	for _, row := range records {
-		rm := RecordMapper{Record: row}
-		id := rm.NextInt()
-		name := rm.NextString()
-		description := rm.NextString()
-		thumbnail := rm.NextString()
-		address := rm.NextString()
-		latitude := rm.NextFloat()
-		longitude := rm.NextFloat()
-		rent := rm.NextInt()
-		doorHeight := rm.NextInt()
-		doorWidth := rm.NextInt()
-		features := rm.NextString()
-		popularity := rm.NextInt()
-		if err := rm.Err(); err != nil {
-			c.Logger().Errorf("failed to read record: %v", err)
-			return c.NoContent(http.StatusBadRequest)
+	var rows []estateRow
+	var rowErrs []RowError
+	var total int
+	var err error
+
+	switch requestMediaType(c) {
+	case echo.MIMEApplicationJSON:
+		rows, rowErrs, total, err = decodeEstateJSON(c.Request().Body)
+	case mimeApplicationNDJSON:
+		rows, rowErrs, total, err = decodeEstateNDJSON(c.Request().Body)
+	default:
+		header, ferr := c.FormFile("estates")
+		if ferr != nil {
+			c.Logger().Errorf("failed to get form file: %v", ferr)
+			return errInvalidBody("estates", "estates file is required")
 		}
-		_, err := tx.Exec("INSERT INTO estate(id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity) VALUES(?,?,?,?,?,?,?,?,?,?,?,?)", id, name, description, thumbnail, address, latitude, longitude, rent, doorHeight, doorWidth, features, popularity)
-		if err != nil {
-			c.Logger().Errorf("failed to insert estate: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
+		f, ferr := header.Open()
+		if ferr != nil {
+			return errInternal(fmt.Errorf("failed to open form file: %v", ferr))
 		}
+		defer f.Close()
+		rows, rowErrs, total, err = decodeEstateCSV(f)
+	}
+	if err != nil {
+		return errInternal(fmt.Errorf("failed to read estates: %v", err))
+	}
+
+	validationErrs, err := validateEstateRows(c.Request().Context(), rows)
+	if err != nil {
+		return errInternal(fmt.Errorf("failed to validate estates: %v", err))
+	}
+	report := newImportReport(isDryRun(c), total, append(rowErrs, validationErrs...))
+	if report.DryRun {
+		return c.JSON(http.StatusOK, report)
+	}
+	if len(report.Errors) > 0 {
+		c.Logger().Infof("failed to read records: %v errors", len(report.Errors))
+		report.Code = errCodeValidationFailed
+		report.Message = "request has invalid rows"
+		return c.JSON(http.StatusBadRequest, report)
 	}
-	if err := tx.Commit(); err != nil {
-		c.Logger().Errorf("failed to commit tx: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+
+	estates := make([]Estate, 0, len(rows))
+	for _, row := range rows {
+		estates = append(estates, row.Estate)
+	}
+	if err := estateStore.InsertEstates(c.Request().Context(), estates); err != nil {
+		return errInternal(fmt.Errorf("failed to insert estate: %v", err))
+	}
+	ids := make([]int64, 0, len(estates))
+	for _, estate := range estates {
+		ids = append(ids, estate.ID)
+	}
+	estatesChanged(c.Request().Context(), true, ids)
+	if len(estates) > 0 {
+		publishStream(c, streamEventEstateCreated, EstateCreatedEvent{Estates: estates})
 	}
 	return c.NoContent(http.StatusCreated)
 }
 
 func searchEstates(c echo.Context) error {
-	conditions := make([]string, 0)
-	params := make([]interface{}, 0)
+	var q EstateSearchQuery
+	var err error
 
 	if c.QueryParam("doorHeightRangeId") != "" {
-		doorHeight, err := getRange(estateSearchCondition.DoorHeight, c.QueryParam("doorHeightRangeId"))
+		q.DoorHeight, err = getRange(estateSearchCondition.DoorHeight, c.QueryParam("doorHeightRangeId"))
 		if err != nil {
 			c.Echo().Logger.Infof("doorHeightRangeID invalid, %v : %v", c.QueryParam("doorHeightRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-
-		if doorHeight.Min != -1 {
-			conditions = append(conditions, "door_height >= ?")
-			params = append(params, doorHeight.Min)
-		}
-		if doorHeight.Max != -1 {
-			conditions = append(conditions, "door_height < ?")
-			params = append(params, doorHeight.Max)
+			return errInvalidParameter("doorHeightRangeId", "doorHeightRangeId is not a valid range id")
 		}
 	}
 
 	if c.QueryParam("doorWidthRangeId") != "" {
-		doorWidth, err := getRange(estateSearchCondition.DoorWidth, c.QueryParam("doorWidthRangeId"))
+		q.DoorWidth, err = getRange(estateSearchCondition.DoorWidth, c.QueryParam("doorWidthRangeId"))
 		if err != nil {
 			c.Echo().Logger.Infof("doorWidthRangeID invalid, %v : %v", c.QueryParam("doorWidthRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-
-		if doorWidth.Min != -1 {
-			conditions = append(conditions, "door_width >= ?")
-			params = append(params, doorWidth.Min)
-		}
-		if doorWidth.Max != -1 {
-			conditions = append(conditions, "door_width < ?")
-			params = append(params, doorWidth.Max)
+			return errInvalidParameter("doorWidthRangeId", "doorWidthRangeId is not a valid range id")
 		}
 	}
 
 	if c.QueryParam("rentRangeId") != "" {
-		estateRent, err := getRange(estateSearchCondition.Rent, c.QueryParam("rentRangeId"))
+		q.Rent, err = getRange(estateSearchCondition.Rent, c.QueryParam("rentRangeId"))
 		if err != nil {
 			c.Echo().Logger.Infof("rentRangeID invalid, %v : %v", c.QueryParam("rentRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-
-		if estateRent.Min != -1 {
-			conditions = append(conditions, "rent >= ?")
-			params = append(params, estateRent.Min)
-		}
-		if estateRent.Max != -1 {
-			conditions = append(conditions, "rent < ?")
-			params = append(params, estateRent.Max)
+			return errInvalidParameter("rentRangeId", "rentRangeId is not a valid range id")
 		}
 	}
 
 	if c.QueryParam("features") != "" {
-		for _, f := range strings.Split(c.QueryParam("features"), ",") {
-			conditions = append(conditions, "features like concat('%', ?, '%')")
-			params = append(params, f)
-		}
+		q.Features = strings.Split(c.QueryParam("features"), ",")
 	}
 
-	if len(conditions) == 0 {
+	if q.empty() {
 		c.Echo().Logger.Infof("searchEstates search condition not found")
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParameter("", "at least one search condition is required")
 	}
 
-	page, err := strconv.Atoi(c.QueryParam("page"))
+	q.Page, err = strconv.Atoi(c.QueryParam("page"))
 	if err != nil {
 		c.Logger().Infof("Invalid format page parameter : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParameter("page", "page must be a non-negative integer")
 	}
 
-	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	q.PerPage, err = strconv.Atoi(c.QueryParam("perPage"))
 	if err != nil {
 		c.Logger().Infof("Invalid format perPage parameter : %v", err)
-		return c.NoContent(http.StatusBadRequest)
-	}
-
-	searchQuery := "SELECT * FROM estate WHERE "
-	countQuery := "SELECT COUNT(*) FROM estate WHERE "
-	searchCondition := strings.Join(conditions, " AND ")
-	limitOffset := " ORDER BY popularity DESC, id ASC LIMIT ? OFFSET ?"
-
-	var res EstateSearchResponse
-	err = db.Get(&res.Count, countQuery+searchCondition, params...)
-	if err != nil {
-		c.Logger().Errorf("searchEstates DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return errInvalidParameter("perPage", "perPage must be a positive integer")
 	}
 
-	estates := []Estate{}
-	params = append(params, perPage, page*perPage)
-	err = db.Select(&estates, searchQuery+searchCondition+limitOffset, params...)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, EstateSearchResponse{Count: 0, Estates: []Estate{}})
+	res, err := estateSearches.get(c.Request().Context(), q.key(), func(ctx context.Context) (interface{}, error) {
+		count, estates, err := estateStore.SearchEstates(ctx, q)
+		if err != nil {
+			return nil, err
 		}
-		c.Logger().Errorf("searchEstates DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return &EstateSearchResponse{Count: count, Estates: estates}, nil
+	})
+	if err != nil {
+		return errInternal(fmt.Errorf("searchEstates DB execution error : %v", err))
 	}
 
-	res.Estates = estates
-
 	return c.JSON(http.StatusOK, res)
 }
 
 func getLowPricedEstate(c echo.Context) error {
-	estates := make([]Estate, 0, Limit)
-	query := `SELECT * FROM estate ORDER BY rent ASC, id ASC LIMIT ?`
-	err := db.Select(&estates, query, Limit)
+	estates, err := estateStore.LowPricedEstates(c.Request().Context(), Limit)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.Logger().Error("getLowPricedEstate not found")
-			return c.JSON(http.StatusOK, EstateListResponse{[]Estate{}})
-		}
-		c.Logger().Errorf("getLowPricedEstate DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return errInternal(fmt.Errorf("getLowPricedEstate DB execution error : %v", err))
 	}
 
 	return c.JSON(http.StatusOK, EstateListResponse{Estates: estates})
@@ -818,36 +871,48 @@ func searchRecommendedEstateWithChair(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		c.Logger().Infof("Invalid format searchRecommendedEstateWithChair id : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParameter("id", "id must be an integer")
 	}
 
-	chair := Chair{}
-	query := `SELECT * FROM chair WHERE id = ?`
-	err = db.Get(&chair, query, id)
+	chair, err := chairStore.GetChair(c.Request().Context(), int64(id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.Logger().Infof("Requested chair id \"%v\" not found", id)
-			return c.NoContent(http.StatusBadRequest)
+			return newAPIError(http.StatusBadRequest, errCodeNotFound, "id", "chair not found")
 		}
-		c.Logger().Errorf("Database execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return errInternal(fmt.Errorf("Database execution error : %v", err))
 	}
 
-	var estates []Estate
-	w := chair.Width
-	h := chair.Height
-	d := chair.Depth
-	query = `SELECT * FROM estate WHERE (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) ORDER BY popularity DESC, id ASC LIMIT ?`
-	err = db.Select(&estates, query, w, h, w, d, h, w, h, d, d, w, d, h, Limit)
+	estates, err := estateStore.RecommendedEstates(c.Request().Context(), chair.Width, chair.Height, chair.Depth, Limit)
+	if err != nil {
+		return errInternal(fmt.Errorf("Database execution error : %v", err))
+	}
+
+	return c.JSON(http.StatusOK, EstateListResponse{Estates: estates})
+}
+
+func searchRecommendedChairWithEstate(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Logger().Infof("Invalid format searchRecommendedChairWithEstate id : %v", err)
+		return errInvalidParameter("id", "id must be an integer")
+	}
+
+	estate, err := estateStore.GetEstate(c.Request().Context(), int64(id))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, EstateListResponse{[]Estate{}})
+			c.Logger().Infof("Requested estate id \"%v\" not found", id)
+			return newAPIError(http.StatusBadRequest, errCodeNotFound, "id", "estate not found")
 		}
-		c.Logger().Errorf("Database execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return errInternal(fmt.Errorf("Database execution error : %v", err))
 	}
 
-	return c.JSON(http.StatusOK, EstateListResponse{Estates: estates})
+	chairs, err := chairStore.RecommendedChairs(c.Request().Context(), estate.DoorWidth, estate.DoorHeight, Limit)
+	if err != nil {
+		return errInternal(fmt.Errorf("Database execution error : %v", err))
+	}
+
+	return c.JSON(http.StatusOK, ChairListResponse{Chairs: chairs})
 }
 
 func searchEstateNazotte(c echo.Context) error {
@@ -855,42 +920,16 @@ func searchEstateNazotte(c echo.Context) error {
 	err := c.Bind(&coordinates)
 	if err != nil {
 		c.Echo().Logger.Infof("post search estate nazotte failed : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidBody("", "request body is not valid JSON")
 	}
 
 	if len(coordinates.Coordinates) == 0 {
-		return c.NoContent(http.StatusBadRequest)
-	}
-
-	b := coordinates.getBoundingBox()
-	estatesInBoundingBox := []Estate{}
-	query := `SELECT * FROM estate WHERE latitude <= ? AND latitude >= ? AND longitude <= ? AND longitude >= ? ORDER BY popularity DESC, id ASC`
-	err = db.Select(&estatesInBoundingBox, query, b.BottomRightCorner.Latitude, b.TopLeftCorner.Latitude, b.BottomRightCorner.Longitude, b.TopLeftCorner.Longitude)
-	if err == sql.ErrNoRows {
-		c.Echo().Logger.Infof("select * from estate where latitude ...", err)
-		return c.JSON(http.StatusOK, EstateSearchResponse{Count: 0, Estates: []Estate{}})
-	} else if err != nil {
-		c.Echo().Logger.Errorf("database execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return errInvalidBody("coordinates", "coordinates must not be empty")
 	}
 
-	estatesInPolygon := []Estate{}
-	for _, estate := range estatesInBoundingBox {
-		validatedEstate := Estate{}
-
-		point := fmt.Sprintf("'POINT(%f %f)'", estate.Latitude, estate.Longitude)
-		query := fmt.Sprintf(`SELECT * FROM estate WHERE id = ? AND ST_Contains(ST_PolygonFromText(%s), ST_GeomFromText(%s))`, coordinates.coordinatesToText(), point)
-		err = db.Get(&validatedEstate, query, estate.ID)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				continue
-			} else {
-				c.Echo().Logger.Errorf("db access is failed on executing validate if estate is in polygon : %v", err)
-				return c.NoContent(http.StatusInternalServerError)
-			}
-		} else {
-			estatesInPolygon = append(estatesInPolygon, validatedEstate)
-		}
+	estatesInPolygon, err := estateStore.EstatesInPolygon(c.Request().Context(), coordinates)
+	if err != nil {
+		return errInternal(fmt.Errorf("database execution error : %v", err))
 	}
 
 	var re EstateSearchResponse
@@ -909,37 +948,35 @@ func postEstateRequestDocument(c echo.Context) error {
 	m := echo.Map{}
 	if err := c.Bind(&m); err != nil {
 		c.Echo().Logger.Infof("post request document failed : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return errInvalidBody("", "request body is not valid JSON")
 	}
 
 	_, ok := m["email"].(string)
 	if !ok {
 		c.Echo().Logger.Info("post request document failed : email not found in request body")
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidBody("email", "email is required")
 	}
 
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		c.Echo().Logger.Infof("post request document failed : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParameter("id", "id must be an integer")
 	}
 
-	estate := Estate{}
-	query := `SELECT * FROM estate WHERE id = ?`
-	err = db.Get(&estate, query, id)
+	_, err = estateStore.GetEstate(c.Request().Context(), int64(id))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return c.NoContent(http.StatusNotFound)
+			return errNotFound("estate not found")
 		}
-		c.Logger().Errorf("postEstateRequestDocument DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return errInternal(fmt.Errorf("postEstateRequestDocument DB execution error : %v", err))
 	}
 
+	popularity.estateRequested(int64(id))
 	return c.NoContent(http.StatusOK)
 }
 
 func getEstateSearchCondition(c echo.Context) error {
-	return c.JSON(http.StatusOK, estateSearchCondition)
+	return estateSearchConditionBody.write(c, cacheControlCondition)
 }
 
 func (cs Coordinates) getBoundingBox() BoundingBox {
@@ -977,3 +1014,26 @@ func (cs Coordinates) coordinatesToText() string {
 	}
 	return fmt.Sprintf("'POLYGON((%s))'", strings.Join(points, ","))
 }
+
+// contains ST_Contains と同じく、境界上の点は含まないものとして扱う
+func (cs Coordinates) contains(p Coordinate) bool {
+	inside := false
+	n := len(cs.Coordinates)
+	for i := 0; i < n; i++ {
+		a := cs.Coordinates[i]
+		b := cs.Coordinates[(i+1)%n]
+		cross := (b.Latitude-a.Latitude)*(p.Longitude-a.Longitude) - (b.Longitude-a.Longitude)*(p.Latitude-a.Latitude)
+		if cross == 0 &&
+			math.Min(a.Latitude, b.Latitude) <= p.Latitude && p.Latitude <= math.Max(a.Latitude, b.Latitude) &&
+			math.Min(a.Longitude, b.Longitude) <= p.Longitude && p.Longitude <= math.Max(a.Longitude, b.Longitude) {
+			return false
+		}
+		if (a.Longitude > p.Longitude) != (b.Longitude > p.Longitude) {
+			lat := a.Latitude + (p.Longitude-a.Longitude)*(b.Latitude-a.Latitude)/(b.Longitude-a.Longitude)
+			if p.Latitude < lat {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
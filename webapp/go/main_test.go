@@ -0,0 +1,2149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+func TestMain(m *testing.M) {
+	if err := loadSearchConditions(filepath.Join("testdata", "fixture")); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer testdata のイスと物件を入れたメモリ上のストアで、main と同じルーティングのサーバを作る
+func newTestServer(t *testing.T) *echo.Echo {
+	t.Helper()
+	backend, err := newMemoryStoreBackend(filepath.Join("testdata", "chairs.ndjson"), filepath.Join("testdata", "estates.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setStoreBackend(backend)
+
+	rateLimits, err := newRateLimitConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeouts, err := newQueryTimeoutConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	os.Setenv("ADMIN_TOKEN", testAdminToken)
+	defer os.Unsetenv("ADMIN_TOKEN")
+	registerRoutes(e, rateLimits, timeouts)
+	return e
+}
+
+// testAdminToken newTestServer の管理用ルートの token
+const testAdminToken = "admin-token"
+
+// requestAdmin 管理用の token をつけて request する
+func requestAdmin(e *echo.Echo, method, path, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	if contentType != "" {
+		req.Header.Set(echo.HeaderContentType, contentType)
+	}
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+testAdminToken)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func request(e *echo.Echo, method, path, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	if contentType != "" {
+		req.Header.Set(echo.HeaderContentType, contentType)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func requestJSON(e *echo.Echo, method, path, body string) *httptest.ResponseRecorder {
+	return request(e, method, path, echo.MIMEApplicationJSON, strings.NewReader(body))
+}
+
+func requestCSV(t *testing.T, e *echo.Echo, path, field, csv string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile(field, field+".csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(part, csv)
+	w.Close()
+	return request(e, http.MethodPost, path, w.FormDataContentType(), &body)
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid response body %q: %v", rec.Body.String(), err)
+	}
+}
+
+func chairIDs(chairs []Chair) []int64 {
+	ids := []int64{}
+	for _, c := range chairs {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+func estateIDs(estates []Estate) []int64 {
+	ids := []int64{}
+	for _, e := range estates {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestRoutes(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPost, "/initialize", "", http.StatusOK},
+		{http.MethodGet, "/api/chair/1", "", http.StatusOK},
+		{http.MethodPatch, "/api/chair/1", `{"stock":10}`, http.StatusUnauthorized},
+		{http.MethodDelete, "/api/chair/4", "", http.StatusUnauthorized},
+		{http.MethodGet, "/api/chair/4/history", "", http.StatusUnauthorized},
+		{http.MethodPost, "/api/chair", `[]`, http.StatusCreated},
+		{http.MethodGet, "/api/chair/search?kind=座椅子&page=0&perPage=10", "", http.StatusOK},
+		{http.MethodGet, "/api/chair/low_priced", "", http.StatusOK},
+		{http.MethodGet, "/api/chair/export", "", http.StatusUnauthorized},
+		{http.MethodGet, "/api/chair/search/condition", "", http.StatusOK},
+		{http.MethodPost, "/api/chair/buy/1", `{"email":"buyer@example.com"}`, http.StatusOK},
+		{http.MethodPost, "/api/chair/reserve/1", `{"email":"buyer@example.com"}`, http.StatusOK},
+		{http.MethodGet, "/api/estate/1", "", http.StatusOK},
+		{http.MethodPatch, "/api/estate/1", `{"rent":45000}`, http.StatusUnauthorized},
+		{http.MethodDelete, "/api/estate/4", "", http.StatusUnauthorized},
+		{http.MethodGet, "/api/estate/1/history", "", http.StatusUnauthorized},
+		{http.MethodPost, "/api/estate", `[]`, http.StatusCreated},
+		{http.MethodGet, "/api/estate/search?rentRangeId=1&page=0&perPage=10", "", http.StatusOK},
+		{http.MethodGet, "/api/estate/low_priced", "", http.StatusOK},
+		{http.MethodGet, "/api/estate/export?format=ndjson", "", http.StatusUnauthorized},
+		{http.MethodPost, "/api/estate/req_doc/1", `{"email":"buyer@example.com"}`, http.StatusOK},
+		{http.MethodPost, "/api/estate/nazotte", `{"coordinates":[{"latitude":35,"longitude":139},{"latitude":36,"longitude":139},{"latitude":36,"longitude":140}]}`, http.StatusOK},
+		{http.MethodGet, "/api/estate/search/condition", "", http.StatusOK},
+		{http.MethodGet, "/api/recommended_estate/1", "", http.StatusOK},
+		{http.MethodGet, "/api/recommended_chair/1", "", http.StatusOK},
+		{http.MethodPost, "/api/webhook", `{"url":"http://localhost/hook","events":["chair.sold_out"]}`, http.StatusUnauthorized},
+		{http.MethodGet, "/api/webhook", "", http.StatusUnauthorized},
+		{http.MethodDelete, "/api/webhook/1", "", http.StatusUnauthorized},
+	}
+	e := newTestServer(t)
+	for _, tt := range tests {
+		rec := requestJSON(e, tt.method, tt.path, tt.body)
+		if rec.Code != tt.status {
+			t.Errorf("%v %v: got status %v, want %v (body %q)", tt.method, tt.path, rec.Code, tt.status, rec.Body.String())
+		}
+	}
+
+	// 管理用のルートは token をつければ通る
+	adminTests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPatch, "/api/chair/1", `{"stock":10}`, http.StatusOK},
+		{http.MethodPatch, "/api/estate/1", `{"rent":45000}`, http.StatusOK},
+		{http.MethodGet, "/api/chair/4/history", "", http.StatusOK},
+		{http.MethodGet, "/api/estate/1/history", "", http.StatusOK},
+		{http.MethodGet, "/api/chair/export", "", http.StatusOK},
+		{http.MethodGet, "/api/estate/export?format=ndjson", "", http.StatusOK},
+		{http.MethodGet, "/api/chair/export?format=xml", "", http.StatusBadRequest},
+		{http.MethodPost, "/api/webhook", `{"url":"http://localhost/hook","events":["chair.sold_out"]}`, http.StatusCreated},
+		{http.MethodPost, "/api/webhook", `{"url":"localhost/hook","events":["chair.updated"]}`, http.StatusBadRequest},
+		{http.MethodGet, "/api/webhook", "", http.StatusOK},
+		{http.MethodDelete, "/api/webhook/1", "", http.StatusNoContent},
+		{http.MethodDelete, "/api/webhook/1", "", http.StatusNotFound},
+		{http.MethodDelete, "/api/chair/4", "", http.StatusNoContent},
+		{http.MethodDelete, "/api/estate/4", "", http.StatusNoContent},
+	}
+	for _, tt := range adminTests {
+		rec := requestAdmin(e, tt.method, tt.path, echo.MIMEApplicationJSON, strings.NewReader(tt.body))
+		if rec.Code != tt.status {
+			t.Errorf("admin %v %v: got status %v, want %v (body %q)", tt.method, tt.path, rec.Code, tt.status, rec.Body.String())
+		}
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	cond := chairSearchCondition.Price
+	tests := []struct {
+		rangeID string
+		want    *Range
+		wantErr bool
+	}{
+		{"0", &Range{ID: 0, Min: -1, Max: 3000}, false},
+		{"5", &Range{ID: 5, Min: 15000, Max: -1}, false},
+		{"6", nil, true},
+		{"-1", nil, true},
+		{"a", nil, true},
+		{"", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := getRange(cond, tt.rangeID)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("getRange(%q): got error %v, want error %v", tt.rangeID, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && *got != *tt.want {
+			t.Errorf("getRange(%q) = %+v, want %+v", tt.rangeID, got, tt.want)
+		}
+	}
+}
+
+func TestSearchChairs(t *testing.T) {
+	tests := []struct {
+		query     string
+		status    int
+		wantCount int64
+		wantIDs   []int64
+	}{
+		{"priceRangeId=0&page=0&perPage=10", http.StatusOK, 1, []int64{1}},
+		{"priceRangeId=1&page=0&perPage=10", http.StatusOK, 1, []int64{5}},
+		{"heightRangeId=1&widthRangeId=0&page=0&perPage=10", http.StatusOK, 1, []int64{5}},
+		{"depthRangeId=3&page=0&perPage=10", http.StatusOK, 0, []int64{}},
+		{"kind=座椅子&page=0&perPage=10", http.StatusOK, 2, []int64{5, 1}},
+		{"color=黒&page=0&perPage=1", http.StatusOK, 2, []int64{1}},
+		{"color=黒&page=1&perPage=1", http.StatusOK, 2, []int64{4}},
+		{"features=折りたたみ可,肘掛け&page=0&perPage=10", http.StatusOK, 1, []int64{3}},
+		// 在庫のないイスは検索に出ない
+		{"kind=ゲーミングチェア&page=0&perPage=10", http.StatusOK, 0, []int64{}},
+		{"priceRangeId=6&page=0&perPage=10", http.StatusBadRequest, 0, nil},
+		{"heightRangeId=x&page=0&perPage=10", http.StatusBadRequest, 0, nil},
+		{"page=0&perPage=10", http.StatusBadRequest, 0, nil},
+		{"kind=座椅子&perPage=10", http.StatusBadRequest, 0, nil},
+		{"kind=座椅子&page=0", http.StatusBadRequest, 0, nil},
+	}
+	e := newTestServer(t)
+	for _, tt := range tests {
+		rec := request(e, http.MethodGet, "/api/chair/search?"+tt.query, "", nil)
+		if rec.Code != tt.status {
+			t.Errorf("%v: got status %v, want %v", tt.query, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var res ChairSearchResponse
+		decode(t, rec, &res)
+		if res.Count != tt.wantCount || fmt.Sprint(chairIDs(res.Chairs)) != fmt.Sprint(tt.wantIDs) {
+			t.Errorf("%v: got count %v ids %v, want count %v ids %v", tt.query, res.Count, chairIDs(res.Chairs), tt.wantCount, tt.wantIDs)
+		}
+	}
+}
+
+func TestSearchEstates(t *testing.T) {
+	tests := []struct {
+		query   string
+		status  int
+		wantIDs []int64
+	}{
+		{"rentRangeId=0&page=0&perPage=10", http.StatusOK, []int64{1}},
+		{"rentRangeId=1&page=0&perPage=10", http.StatusOK, []int64{4, 2}},
+		{"doorWidthRangeId=1&doorHeightRangeId=2&page=0&perPage=10", http.StatusOK, []int64{5}},
+		{"features=バストイレ別&page=0&perPage=10", http.StatusOK, []int64{4, 1}},
+		{"rentRangeId=4&page=0&perPage=10", http.StatusBadRequest, nil},
+		{"page=0&perPage=10", http.StatusBadRequest, nil},
+	}
+	e := newTestServer(t)
+	for _, tt := range tests {
+		rec := request(e, http.MethodGet, "/api/estate/search?"+tt.query, "", nil)
+		if rec.Code != tt.status {
+			t.Errorf("%v: got status %v, want %v", tt.query, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var res EstateSearchResponse
+		decode(t, rec, &res)
+		if fmt.Sprint(estateIDs(res.Estates)) != fmt.Sprint(tt.wantIDs) {
+			t.Errorf("%v: got ids %v, want %v", tt.query, estateIDs(res.Estates), tt.wantIDs)
+		}
+	}
+}
+
+func TestGetChairDetail(t *testing.T) {
+	e := newTestServer(t)
+
+	rec := request(e, http.MethodGet, "/api/chair/1", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %v, want %v", rec.Code, http.StatusOK)
+	}
+	var chair Chair
+	decode(t, rec, &chair)
+	if chair.ID != 1 || chair.Stock != 0 || chair.Popularity != 0 {
+		t.Errorf("got %+v, want id 1 without stock and popularity", chair)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/chair/1", nil)
+	req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+	notModified := httptest.NewRecorder()
+	e.ServeHTTP(notModified, req)
+	if notModified.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: got status %v, want %v", notModified.Code, http.StatusNotModified)
+	}
+
+	for path, status := range map[string]int{
+		"/api/chair/2":   http.StatusNotFound, // 売り切れ
+		"/api/chair/100": http.StatusNotFound,
+		"/api/chair/abc": http.StatusBadRequest,
+	} {
+		if rec := request(e, http.MethodGet, path, "", nil); rec.Code != status {
+			t.Errorf("%v: got status %v, want %v", path, rec.Code, status)
+		}
+	}
+
+	// 最後の1脚を買うと詳細も 404 になる
+	if rec := requestJSON(e, http.MethodPost, "/api/chair/buy/4", `{"email":"buyer@example.com"}`); rec.Code != http.StatusOK {
+		t.Fatalf("buy: got status %v, want %v", rec.Code, http.StatusOK)
+	}
+	if rec := request(e, http.MethodGet, "/api/chair/4", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("sold out chair: got status %v, want %v", rec.Code, http.StatusNotFound)
+	}
+	if rec := requestJSON(e, http.MethodPost, "/api/chair/buy/4", `{"email":"buyer@example.com"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("buy sold out chair: got status %v, want %v", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestPostChairCSV(t *testing.T) {
+	const valid = "10,新しいイス,説明,/images/chair/10.png,4000,80,60,60,緑,キャスター,ゲーミングチェア,10,3\n"
+
+	t.Run("invalid rows", func(t *testing.T) {
+		e := newTestServer(t)
+		csv := valid +
+			"11,値段の誤り,,,abc,80,60,60,緑,,ゲーミングチェア,10,3\n" +
+			"12,色の誤り,,,4000,80,60,60,金,,座椅子,10,3\n" +
+			"10,重複,,,4000,80,60,60,緑,,座椅子,10,3\n" +
+			"1,登録済み,,,4000,80,60,60,緑,,座椅子,10,3\n" +
+			"13,列が足りない\n"
+		rec := requestCSV(t, e, "/api/chair", "chairs", csv)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("got status %v, want %v", rec.Code, http.StatusBadRequest)
+		}
+		var report ImportReport
+		decode(t, rec, &report)
+		want := []RowError{
+			{Row: 2, Column: "price"},
+			{Row: 3, Column: "color"},
+			{Row: 4, Column: "id", Reason: "duplicate id 10 (first seen at row 1)"},
+			{Row: 5, Column: "id", Reason: "id 1 already exists"},
+			{Row: 6},
+		}
+		if report.Rows != 6 || len(report.Errors) != len(want) {
+			t.Fatalf("got %+v, want %v rows with %v errors", report, 6, len(want))
+		}
+		for i, w := range want {
+			got := report.Errors[i]
+			if got.Row != w.Row || got.Column != w.Column || (w.Reason != "" && got.Reason != w.Reason) {
+				t.Errorf("error %v: got %+v, want %+v", i, got, w)
+			}
+		}
+		if rec := request(e, http.MethodGet, "/api/chair/10", "", nil); rec.Code != http.StatusNotFound {
+			t.Errorf("rejected file must not insert rows: got status %v", rec.Code)
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		e := newTestServer(t)
+		rec := requestCSV(t, e, "/api/chair?dryRun=1", "chairs", valid)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %v, want %v", rec.Code, http.StatusOK)
+		}
+		if rec := request(e, http.MethodGet, "/api/chair/10", "", nil); rec.Code != http.StatusNotFound {
+			t.Errorf("dry run must not insert rows: got status %v", rec.Code)
+		}
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		e := newTestServer(t)
+		if rec := requestCSV(t, e, "/api/chair", "chairs", valid); rec.Code != http.StatusCreated {
+			t.Fatalf("got status %v, want %v (body %q)", rec.Code, http.StatusCreated, rec.Body.String())
+		}
+		if rec := request(e, http.MethodGet, "/api/chair/10", "", nil); rec.Code != http.StatusOK {
+			t.Errorf("inserted chair: got status %v, want %v", rec.Code, http.StatusOK)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		e := newTestServer(t)
+		if rec := requestCSV(t, e, "/api/chair", "estates", valid); rec.Code != http.StatusBadRequest {
+			t.Errorf("got status %v, want %v", rec.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestSearchEstateNazotte(t *testing.T) {
+	e := newTestServer(t)
+
+	square := `{"coordinates":[
+		{"latitude":35.55,"longitude":139.55},
+		{"latitude":35.55,"longitude":139.75},
+		{"latitude":35.75,"longitude":139.75},
+		{"latitude":35.75,"longitude":139.55}]}`
+	rec := requestJSON(e, http.MethodPost, "/api/estate/nazotte", square)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %v, want %v", rec.Code, http.StatusOK)
+	}
+	var res EstateSearchResponse
+	decode(t, rec, &res)
+	// popularity の降順、同じなら id の昇順
+	if want := "[2 5 3 1]"; fmt.Sprint(estateIDs(res.Estates)) != want || res.Count != 4 {
+		t.Errorf("got count %v ids %v, want %v", res.Count, estateIDs(res.Estates), want)
+	}
+
+	// 外接矩形には入るが、斜辺の外側にある 3 は含まれない
+	triangle := `{"coordinates":[
+		{"latitude":35.55,"longitude":139.55},
+		{"latitude":35.80,"longitude":139.55},
+		{"latitude":35.55,"longitude":139.80}]}`
+	rec = requestJSON(e, http.MethodPost, "/api/estate/nazotte", triangle)
+	decode(t, rec, &res)
+	if want := "[2 5 1]"; fmt.Sprint(estateIDs(res.Estates)) != want {
+		t.Errorf("triangle: got ids %v, want %v", estateIDs(res.Estates), want)
+	}
+
+	if rec := requestJSON(e, http.MethodPost, "/api/estate/nazotte", `{"coordinates":[]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("empty polygon: got status %v, want %v", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRecommendations(t *testing.T) {
+	e := newTestServer(t)
+
+	tests := []struct {
+		path    string
+		status  int
+		wantIDs string
+	}{
+		// 90x120x80 のイスは、80 と 120 の面で 85x120 のドアを通る
+		{"/api/recommended_estate/3", http.StatusOK, "[4 2 5]"},
+		{"/api/recommended_estate/4", http.StatusOK, "[2]"},
+		{"/api/recommended_estate/100", http.StatusBadRequest, ""},
+		// 幅 70 高さ 100 のドアは、在庫のない 2 を除いて 1 と 5 が通る
+		{"/api/recommended_chair/1", http.StatusOK, "[5 1]"},
+		{"/api/recommended_chair/3", http.StatusOK, "[5 1]"},
+		{"/api/recommended_chair/2", http.StatusOK, "[3 5 1 4]"},
+		{"/api/recommended_chair/100", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		rec := request(e, http.MethodGet, tt.path, "", nil)
+		if rec.Code != tt.status {
+			t.Errorf("%v: got status %v, want %v", tt.path, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var ids []int64
+		if strings.HasPrefix(tt.path, "/api/recommended_estate/") {
+			var res EstateListResponse
+			decode(t, rec, &res)
+			ids = estateIDs(res.Estates)
+		} else {
+			var res ChairListResponse
+			decode(t, rec, &res)
+			ids = chairIDs(res.Chairs)
+		}
+		if fmt.Sprint(ids) != tt.wantIDs {
+			t.Errorf("%v: got ids %v, want %v", tt.path, ids, tt.wantIDs)
+		}
+	}
+}
+
+func TestReserveChair(t *testing.T) {
+	e := newTestServer(t)
+	// 期限はストアが記録したものを返す
+	now := time.Date(2020, 9, 12, 10, 0, 0, 0, time.UTC)
+	chairStore.(*memoryChairStore).now = func() time.Time { return now }
+
+	rec := requestJSON(e, http.MethodPost, "/api/chair/reserve/4", `{"email":"buyer@example.com"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %v, want %v", rec.Code, http.StatusOK)
+	}
+	var res ChairReservationResponse
+	decode(t, rec, &res)
+	if !res.ExpiresAt.Equal(now.Add(reservationTTL)) {
+		t.Errorf("got expiresAt %v, want %v", res.ExpiresAt, now.Add(reservationTTL))
+	}
+
+	// 確保した分は在庫から引かれる
+	if rec := request(e, http.MethodGet, "/api/chair/4", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("reserved chair: got status %v, want %v", rec.Code, http.StatusNotFound)
+	}
+	if rec := requestJSON(e, http.MethodPost, "/api/chair/buy/4", `{"email":"buyer@example.com","reservationId":"unknown"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown reservation: got status %v, want %v", rec.Code, http.StatusNotFound)
+	}
+	body := fmt.Sprintf(`{"email":"buyer@example.com","reservationId":%q}`, res.ReservationID)
+	if rec := requestJSON(e, http.MethodPost, "/api/chair/buy/4", body); rec.Code != http.StatusOK {
+		t.Errorf("buy reserved chair: got status %v, want %v", rec.Code, http.StatusOK)
+	}
+	if rec := requestJSON(e, http.MethodPost, "/api/chair/buy/4", body); rec.Code != http.StatusNotFound {
+		t.Errorf("reuse reservation: got status %v, want %v", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestReservationSoldOut(t *testing.T) {
+	ctx := context.Background()
+	e := newTestServer(t)
+	rec := requestAdmin(e, http.MethodPost, "/api/webhook", echo.MIMEApplicationJSON, strings.NewReader(`{"url":"http://localhost/hook","events":["chair.sold_out"]}`))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("webhook: got status %v", rec.Code)
+	}
+	soldOut := func() int {
+		t.Helper()
+		deliveries, err := webhookStore.ClaimWebhookDeliveries(ctx, 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(deliveries)
+	}
+	if rec := requestAdmin(e, http.MethodPatch, "/api/chair/1", echo.MIMEApplicationJSON, strings.NewReader(`{"stock":2}`)); rec.Code != http.StatusOK {
+		t.Fatalf("patch: got status %v", rec.Code)
+	}
+	rec = requestJSON(e, http.MethodPost, "/api/chair/reserve/1", `{"email":"buyer@example.com"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reserve: got status %v", rec.Code)
+	}
+	var res ChairReservationResponse
+	decode(t, rec, &res)
+
+	// 確保中の分が残っている間は、直接の購入で在庫が 0 になっても売り切れにしない
+	if rec := requestJSON(e, http.MethodPost, "/api/chair/buy/1", `{"email":"buyer@example.com"}`); rec.Code != http.StatusOK {
+		t.Fatalf("buy: got status %v", rec.Code)
+	}
+	if n := soldOut(); n != 0 {
+		t.Errorf("buy with an outstanding reservation: got %v sold out deliveries", n)
+	}
+
+	// 最後の確保を買い切ったら売り切れにする
+	body := fmt.Sprintf(`{"email":"buyer@example.com","reservationId":%q}`, res.ReservationID)
+	if rec := requestJSON(e, http.MethodPost, "/api/chair/buy/1", body); rec.Code != http.StatusOK {
+		t.Fatalf("buy reserved chair: got status %v", rec.Code)
+	}
+	if n := soldOut(); n != 1 {
+		t.Errorf("buy the last reservation: got %v sold out deliveries, want 1", n)
+	}
+}
+
+func TestReservationSweeper(t *testing.T) {
+	e := newTestServer(t)
+	stream = newStreamHub(defaultStreamBufferSize)
+	defer func() { stream = newStreamHub(defaultStreamBufferSize) }()
+	sub := stream.subscribe()
+
+	now := time.Date(2020, 9, 12, 10, 0, 0, 0, time.UTC)
+	chairs := chairStore.(*memoryChairStore)
+	chairs.now = func() time.Time { return now }
+	if rec := requestJSON(e, http.MethodPost, "/api/chair/reserve/4", `{"email":"buyer@example.com"}`); rec.Code != http.StatusOK {
+		t.Fatalf("reserve: got status %v", rec.Code)
+	}
+	<-sub.ch
+
+	// 期限が切れて在庫が戻ったら、購読者に在庫を知らせる
+	expired := now.Add(reservationTTL)
+	chairs.now = func() time.Time { return expired }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runReservationSweeper(ctx, e, 10*time.Millisecond)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	select {
+	case msg := <-sub.ch:
+		want := fmt.Sprintf("event: %v\ndata: {\"id\":4,\"stock\":1}\n\n", streamEventChairStock)
+		if !strings.HasSuffix(string(msg), want) {
+			t.Errorf("got %q, want suffix %q", msg, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("released stock was not published")
+	}
+}
+
+func TestPatchChairStock(t *testing.T) {
+	ctx := context.Background()
+	e := newTestServer(t)
+	stream = newStreamHub(defaultStreamBufferSize)
+	defer func() { stream = newStreamHub(defaultStreamBufferSize) }()
+	sub := stream.subscribe()
+	rec := requestAdmin(e, http.MethodPost, "/api/webhook", echo.MIMEApplicationJSON, strings.NewReader(`{"url":"http://localhost/hook","events":["chair.sold_out"]}`))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("webhook: got status %v", rec.Code)
+	}
+	patch := func(body string) {
+		t.Helper()
+		if rec := requestAdmin(e, http.MethodPatch, "/api/chair/1", echo.MIMEApplicationJSON, strings.NewReader(body)); rec.Code != http.StatusOK {
+			t.Fatalf("patch %v: got status %v", body, rec.Code)
+		}
+	}
+
+	// 在庫を変えない編集は知らせない
+	patch(`{"price":1234}`)
+	select {
+	case msg := <-sub.ch:
+		t.Errorf("price edit: got %q", msg)
+	default:
+	}
+
+	// 在庫を 0 にした編集は、購入と同じく在庫と売り切れを知らせる
+	patch(`{"stock":0}`)
+	select {
+	case msg := <-sub.ch:
+		want := fmt.Sprintf("event: %v\ndata: {\"id\":1,\"stock\":0}\n\n", streamEventChairStock)
+		if !strings.HasSuffix(string(msg), want) {
+			t.Errorf("got %q, want suffix %q", msg, want)
+		}
+	default:
+		t.Error("stock edit was not published")
+	}
+	deliveries, err := webhookStore.ClaimWebhookDeliveries(ctx, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Event != webhookEventChairSoldOut {
+		t.Errorf("got deliveries %+v, want one %v", deliveries, webhookEventChairSoldOut)
+	}
+}
+
+func TestChairHistory(t *testing.T) {
+	e := newTestServer(t)
+
+	history := func(id string) []ChairHistory {
+		var res ChairHistoryResponse
+		decode(t, requestAdmin(e, http.MethodGet, "/api/chair/"+id+"/history", "", nil), &res)
+		return res.History
+	}
+	if got := history("3"); len(got) != 0 {
+		t.Errorf("initial data: got %v, want no history", got)
+	}
+
+	requestJSON(e, http.MethodPost, "/api/chair/buy/3", `{"email":"buyer@example.com"}`)
+	requestAdmin(e, http.MethodPatch, "/api/chair/3", echo.MIMEApplicationJSON, strings.NewReader(`{"price":7000}`))
+	requestAdmin(e, http.MethodDelete, "/api/chair/3", "", nil)
+
+	got := history("3")
+	want := []ChairHistory{
+		{Event: historyEventPurchase, Price: 8000, Stock: 1, Email: "buyer@example.com"},
+		{Event: historyEventUpdate, Price: 7000, Stock: 1},
+		{Event: historyEventDelete, Price: 7000, Stock: 1},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		got[i].CreatedAt = want[i].CreatedAt
+		if got[i] != want[i] {
+			t.Errorf("history[%v]: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if rec := requestAdmin(e, http.MethodGet, "/api/chair/100/history", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown chair: got status %v, want %v", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	ctx := context.Background()
+	e := newTestServer(t)
+
+	type received struct {
+		event     string
+		signature string
+		body      []byte
+	}
+	var mu sync.Mutex
+	var got []received
+	status := http.StatusInternalServerError
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, received{r.Header.Get("X-Isuumo-Event"), r.Header.Get("X-Isuumo-Signature"), body})
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	body := fmt.Sprintf(`{"url":%q,"secret":"s3cret","events":["chair.sold_out","estate.created"]}`, receiver.URL)
+	if rec := requestAdmin(e, http.MethodPost, "/api/webhook", echo.MIMEApplicationJSON, strings.NewReader(body)); rec.Code != http.StatusCreated {
+		t.Fatalf("register: got status %v, want %v", rec.Code, http.StatusCreated)
+	}
+
+	// 在庫 1 のイスを買うと売り切れになる
+	requestJSON(e, http.MethodPost, "/api/chair/buy/4", `{"email":"buyer@example.com"}`)
+	requestJSON(e, http.MethodPost, "/api/chair/buy/1", `{"email":"buyer@example.com"}`)
+	requestJSON(e, http.MethodPost, "/api/estate", `[{"id":6,"thumbnail":"/images/estate/6.png","name":"新しい物件","description":"","address":"東京都品川区","latitude":35.6,"longitude":139.6,"doorHeight":100,"doorWidth":100,"popularity":0,"rent":50000,"features":""}]`)
+
+	now := time.Now()
+	webhookStore.(*memoryWebhookStore).now = func() time.Time { return now }
+	d := &webhookDispatcher{client: &http.Client{Timeout: time.Second}, interval: time.Second, backoff: time.Minute, maxAttempts: 3}
+
+	// 失敗した配信は backoff の後まで送り直さない
+	if n, err := d.dispatch(ctx); err != nil || n != 2 {
+		t.Fatalf("first dispatch: got %v, %v, want 2 deliveries", n, err)
+	}
+	if n, err := d.dispatch(ctx); err != nil || n != 0 {
+		t.Fatalf("dispatch before backoff: got %v, %v, want 0 deliveries", n, err)
+	}
+
+	mu.Lock()
+	status = http.StatusOK
+	got = nil
+	mu.Unlock()
+	now = now.Add(time.Minute)
+	if n, err := d.dispatch(ctx); err != nil || n != 2 {
+		t.Fatalf("retry: got %v, %v, want 2 deliveries", n, err)
+	}
+	if n, err := d.dispatch(ctx); err != nil || n != 0 {
+		t.Fatalf("dispatch after delivered: got %v, %v, want 0 deliveries", n, err)
+	}
+
+	events := map[string]WebhookPayload{}
+	for _, r := range got {
+		if want := signWebhook("s3cret", r.body); r.signature != want {
+			t.Errorf("%v: got signature %v, want %v", r.event, r.signature, want)
+		}
+		var payload WebhookPayload
+		if err := json.Unmarshal(r.body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		events[r.event] = payload
+	}
+	if p, ok := events[webhookEventChairSoldOut]; !ok || p.Chair == nil || p.Chair.ID != 4 {
+		t.Errorf("sold out: got %+v", p)
+	}
+	if p, ok := events[webhookEventEstateCreated]; !ok || len(p.Estates) != 1 || p.Estates[0].ID != 6 {
+		t.Errorf("estate created: got %+v", p)
+	}
+}
+
+func TestWebhookRetryAfter(t *testing.T) {
+	d := &webhookDispatcher{backoff: time.Minute, maxAttempts: 6}
+	for attempts, want := range []time.Duration{time.Minute, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 0} {
+		if got := d.retryAfter(attempts); got != want {
+			t.Errorf("retryAfter(%v) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestStreamHubDropsSlowSubscriber(t *testing.T) {
+	hub := newStreamHub(2)
+	slow := hub.subscribe()
+	fast := hub.subscribe()
+	defer hub.unsubscribe(fast)
+
+	// 購読者が読まなくても publish は待たされない
+	for i := 0; i < 3; i++ {
+		if err := hub.publish(streamEventChairStock, ChairStockEvent{ID: 1, Stock: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		<-fast.ch
+	}
+	select {
+	case <-slow.dropped:
+	default:
+		t.Fatal("slow subscriber must be dropped")
+	}
+	if got := hub.subscriberCount(); got != 1 {
+		t.Errorf("got %v subscribers, want 1", got)
+	}
+}
+
+func TestStream(t *testing.T) {
+	e := newTestServer(t)
+	stream = newStreamHub(defaultStreamBufferSize)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if got := res.Header.Get(echo.HeaderContentType); got != streamContentType {
+		t.Fatalf("got content type %v, want %v", got, streamContentType)
+	}
+	for stream.subscriberCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	requestJSON(e, http.MethodPost, "/api/chair/buy/3", `{"email":"buyer@example.com"}`)
+	requestJSON(e, http.MethodPost, "/api/chair", `[{"id":6,"name":"新しいイス","description":"","thumbnail":"/images/chair/6.png","price":1000,"height":80,"width":50,"depth":50,"color":"黒","features":"","popularity":0,"kind":"座椅子","stock":1}]`)
+
+	// event と data の行を1件ずつまとめて読む
+	scanner := bufio.NewScanner(res.Body)
+	next := func() string {
+		var event []string
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" && len(event) > 0 {
+				return strings.Join(event, " ")
+			}
+			if strings.HasPrefix(line, "event: ") || strings.HasPrefix(line, "data: ") {
+				event = append(event, line)
+			}
+		}
+		t.Fatalf("stream closed: %v", scanner.Err())
+		return ""
+	}
+	if got, want := next(), `event: chair.stock data: {"id":3,"stock":1}`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := next(), "event: chair.created data: "; !strings.HasPrefix(got, want) {
+		t.Errorf("got %v, want prefix %v", got, want)
+	}
+}
+
+func TestBotPolicy(t *testing.T) {
+	os.Setenv("ADMIN_TOKEN", "admin-token")
+	defer os.Unsetenv("ADMIN_TOKEN")
+	e := newTestServer(t)
+
+	dir, err := ioutil.TempDir("", "isuumo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, defaultBotPolicyFile)
+	bots = newBotPolicy(path, defaultBotRules)
+	defer func() { bots = newBotPolicy("", defaultBotRules) }()
+
+	admin := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	getChair := func(ua string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/chair/1", nil)
+		req.Header.Set("User-Agent", ua)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if rec := request(e, http.MethodGet, "/api/admin/bot_rules", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without token: got status %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := admin(http.MethodPost, "/api/admin/bot_rules", `{"pattern":"(","action":"block"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid pattern: got status %v, want %v", rec.Code, http.StatusBadRequest)
+	}
+
+	rec := admin(http.MethodPost, "/api/admin/bot_rules", `{"pattern":"^ISUCONbot-","action":"block"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("add: got status %v, want %v", rec.Code, http.StatusCreated)
+	}
+	var rule BotRule
+	decode(t, rec, &rule)
+
+	// 追加したルールは既定のルールより先に試される
+	if got := getChair("ISUCONbot-00000000-0000-0000-0000-000000000000"); got != http.StatusServiceUnavailable {
+		t.Errorf("blocked bot: got status %v, want %v", got, http.StatusServiceUnavailable)
+	}
+	if got := getChair("Mozilla/5.0"); got != http.StatusOK {
+		t.Errorf("human: got status %v, want %v", got, http.StatusOK)
+	}
+	var res BotRulesResponse
+	decode(t, admin(http.MethodGet, "/api/admin/bot_rules", ""), &res)
+	if len(res.Rules) != len(defaultBotRules)+1 || res.Rules[0].ID != rule.ID || res.Rules[0].Hits != 1 {
+		t.Errorf("got rules %+v, want rule %v first with 1 hit", res.Rules, rule.ID)
+	}
+
+	if rec := admin(http.MethodPatch, fmt.Sprintf("/api/admin/bot_rules/%v", rule.ID), `{"action":"allow"}`); rec.Code != http.StatusOK {
+		t.Fatalf("set action: got status %v, want %v", rec.Code, http.StatusOK)
+	}
+	if got := getChair("ISUCONbot-00000000-0000-0000-0000-000000000000"); got != http.StatusOK {
+		t.Errorf("allowed bot: got status %v, want %v", got, http.StatusOK)
+	}
+	decode(t, admin(http.MethodGet, "/api/admin/bot_rules", ""), &res)
+	if res.Rules[0].Hits != 2 {
+		t.Errorf("hits must carry over the action change: got %v, want 2", res.Rules[0].Hits)
+	}
+
+	// 起動し直してもルールは残る
+	loaded, err := loadBotPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.list()[0]; got.ID != rule.ID || got.Action != botActionAllow || got.Hits != 0 {
+		t.Errorf("reloaded: got %+v", got)
+	}
+
+	if rec := admin(http.MethodDelete, fmt.Sprintf("/api/admin/bot_rules/%v", rule.ID), ""); rec.Code != http.StatusNoContent {
+		t.Errorf("delete: got status %v, want %v", rec.Code, http.StatusNoContent)
+	}
+	if rec := admin(http.MethodDelete, fmt.Sprintf("/api/admin/bot_rules/%v", rule.ID), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("delete twice: got status %v, want %v", rec.Code, http.StatusNotFound)
+	}
+}
+
+// TestBotPolicyHits action を変えている間に数えた分も失わない。go test -race で読み書きの競合も確かめる
+func TestBotPolicyHits(t *testing.T) {
+	p := newBotPolicy("", []BotRule{{Pattern: "bot", Action: botActionThrottle}})
+	const n = 1000
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			p.classify("bot")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			action := botActionAllow
+			if i%2 == 0 {
+				action = botActionBlock
+			}
+			if _, err := p.setAction(1, action); err != nil {
+				t.Error(err)
+				return
+			}
+			p.list()
+		}
+	}()
+	wg.Wait()
+	if got := p.list()[0].Hits; got != n {
+		t.Errorf("got %v hits, want %v", got, n)
+	}
+	if _, err := p.setAction(2, botActionAllow); err != errBotRuleNotFound {
+		t.Errorf("unknown rule: got %v", err)
+	}
+	if err := p.remove(2); err != errBotRuleNotFound {
+		t.Errorf("unknown rule: got %v", err)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		want   ErrorResponse
+	}{
+		{http.MethodGet, "/api/chair/search?priceRangeId=100", "", http.StatusBadRequest, ErrorResponse{Code: errCodeInvalidParameter, Field: "priceRangeId"}},
+		{http.MethodGet, "/api/chair/search?priceRangeId=1", "", http.StatusBadRequest, ErrorResponse{Code: errCodeInvalidParameter, Field: "page"}},
+		{http.MethodGet, "/api/chair/abc", "", http.StatusBadRequest, ErrorResponse{Code: errCodeInvalidParameter, Field: "id"}},
+		{http.MethodGet, "/api/chair/100", "", http.StatusNotFound, ErrorResponse{Code: errCodeNotFound}},
+		{http.MethodGet, "/api/chair/2", "", http.StatusNotFound, ErrorResponse{Code: errCodeSoldOut}},
+		{http.MethodPost, "/api/chair/buy/1", `{}`, http.StatusBadRequest, ErrorResponse{Code: errCodeInvalidBody, Field: "email"}},
+		{http.MethodPost, "/api/chair/buy/1", `{`, http.StatusBadRequest, ErrorResponse{Code: errCodeInvalidBody}},
+		{http.MethodGet, "/api/unknown", "", http.StatusNotFound, ErrorResponse{Code: errCodeNotFound}},
+		{http.MethodPut, "/api/chair/1", "", http.StatusMethodNotAllowed, ErrorResponse{Code: errCodeMethodNotAllowed}},
+	}
+	e := newTestServer(t)
+	for _, tt := range tests {
+		rec := requestJSON(e, tt.method, tt.path, tt.body)
+		if rec.Code != tt.status {
+			t.Errorf("%v %v: got status %v, want %v", tt.method, tt.path, rec.Code, tt.status)
+			continue
+		}
+		var got ErrorResponse
+		decode(t, rec, &got)
+		if got.Code != tt.want.Code || got.Field != tt.want.Field || got.Message == "" {
+			t.Errorf("%v %v: got %+v, want code %v field %q", tt.method, tt.path, got, tt.want.Code, tt.want.Field)
+		}
+	}
+
+	var got ErrorResponse
+	decode(t, requestAdmin(e, http.MethodPatch, "/api/chair/1", echo.MIMEApplicationJSON, strings.NewReader(`{"price":-1}`)), &got)
+	if got.Code != errCodeValidationFailed || len(got.Errors) != 1 || got.Errors[0].Field != "price" {
+		t.Errorf("validation: got %+v", got)
+	}
+
+	// 内部エラーの原因は応答に含めない
+	rec := httptest.NewRecorder()
+	httpErrorHandler(errInternal(fmt.Errorf("dial tcp 10.0.0.1:3306: connection refused")), e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec))
+	if rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "3306") {
+		t.Errorf("internal error: got status %v, body %v", rec.Code, rec.Body.String())
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	// 指定しなければ、どのルートにも期限をつけない
+	timeouts, err := newQueryTimeoutConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for group := range defaultQueryTimeouts {
+		if d := timeouts.timeout(group, http.MethodPost, "/api/chair"); d != 0 {
+			t.Errorf("%v: got default timeout %v", group, d)
+		}
+	}
+
+	os.Setenv("QUERY_TIMEOUT_ROUTES", "GET /slow=10ms, GET /missing=10ms")
+	defer os.Unsetenv("QUERY_TIMEOUT_ROUTES")
+	os.Setenv("QUERY_TIMEOUT_SEARCH", "10s")
+	defer os.Unsetenv("QUERY_TIMEOUT_SEARCH")
+	timeouts, err = newQueryTimeoutConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := timeouts.timeout(rateLimitGroupSearch, http.MethodGet, "/api/chair/search"); d != 10*time.Second {
+		t.Errorf("search timeout: got %v", d)
+	}
+
+	slow := func(c echo.Context) error {
+		ctx := c.Request().Context()
+		<-ctx.Done()
+		return errInternal(ctx.Err())
+	}
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+	e.GET("/slow", slow, timeouts.middleware(rateLimitGroupSearch))
+	e.GET("/canceled", slow, timeouts.middleware(queryTimeoutGroupExport))
+	e.GET("/missing", func(c echo.Context) error {
+		<-c.Request().Context().Done()
+		return errNotFound("chair not found")
+	}, timeouts.middleware(rateLimitGroupSearch))
+
+	var got ErrorResponse
+	rec := request(e, http.MethodGet, "/slow", "", nil)
+	decode(t, rec, &got)
+	if rec.Code != http.StatusServiceUnavailable || got.Code != errCodeTimeout {
+		t.Errorf("timeout: got status %v, body %+v", rec.Code, got)
+	}
+	// ハンドラが内部エラー以外を返したときはそのまま返す
+	if rec := request(e, http.MethodGet, "/missing", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("not found: got status %v", rec.Code)
+	}
+
+	// 期限がなくても、クライアントが切断したら打ち切る
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/canceled", nil).WithContext(ctx))
+	if rec.Code != statusClientClosedRequest {
+		t.Errorf("canceled: got status %v", rec.Code)
+	}
+
+	os.Setenv("QUERY_TIMEOUT_ROUTES", "/api/chair/search=1s")
+	if _, err := newQueryTimeoutConfig(); err == nil {
+		t.Error("route without method: got no error")
+	}
+}
+
+func TestReadSQLInserts(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "dump.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := readSQLInserts(f, chairColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"1", "It's a chair", "line1\nline2 'quoted' back\\slash \"double\"", "/images/chair/1.png", "1000", "80", "50", "50", "黒", "ヘッドレスト付き,肘掛け付き", "オフィスチェア", "10", "3"},
+		{"2", "(paren), comma;", "", "/images/chair/2.png", "2000", "1", "2", "3", "白", "", "座椅子", "0", "1"},
+		{"3", "tab\tand\\\\", "椅子", "/images/chair/3.png", "3000", "20", "30", "40", "赤", `100\%綿`, "ゲーミングチェア", "7", "5"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+
+	for _, src := range []string{
+		"INSERT INTO chair (id, name) VALUES (1, 'unterminated);",
+		"INSERT INTO chair (id, name) VALUES (1);",
+		"INSERT INTO chair (id, name) VALUES (1, 'a') (2, 'b');",
+		"INSERT INTO chair (id, name) (1, 'a');",
+	} {
+		if _, err := readSQLInserts(strings.NewReader(src), []string{"id", "name"}); err == nil {
+			t.Errorf("%q: want an error", src)
+		}
+	}
+	if _, err := readSQLInserts(strings.NewReader("INSERT INTO estate (id) VALUES (1);"), []string{"id", "doorHeight"}); err == nil {
+		t.Error("a missing column must be an error")
+	}
+}
+
+func TestMySQLDSN(t *testing.T) {
+	env := &MySQLConnectionEnv{Host: "127.0.0.1", Port: "3306", User: "isucon", DBName: "isuumo", Password: "isucon"}
+	if got, want := env.DSN(), "isucon:isucon@tcp(127.0.0.1:3306)/isuumo"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	os.Setenv("MYSQL_INTERPOLATE_PARAMS", "true")
+	os.Setenv("MYSQL_READ_TIMEOUT", "2s")
+	defer os.Unsetenv("MYSQL_INTERPOLATE_PARAMS")
+	defer os.Unsetenv("MYSQL_READ_TIMEOUT")
+	env.Options = NewMySQLDSNOptions()
+	env.Password = "p@ss/word"
+	conf, err := mysql.ParseDSN(env.DSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Passwd != env.Password || !conf.InterpolateParams || conf.ParseTime || conf.ReadTimeout != 2*time.Second {
+		t.Errorf("got %+v", conf)
+	}
+}
+
+func TestNormalizeSQL(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM chair WHERE id = ?", "SELECT * FROM chair WHERE id = ?"},
+		{"SELECT *\n  FROM chair\tWHERE price >= 12000 LIMIT 20", "SELECT * FROM chair WHERE price >= ? LIMIT ?"},
+		{"SELECT * FROM estate WHERE ST_Contains(ST_PolygonFromText('POLYGON((35.1 139.2, 35.3 139.4))'), ST_GeomFromText('POINT(35.2 139.3)'))", "SELECT * FROM estate WHERE ST_Contains(ST_PolygonFromText(?), ST_GeomFromText(?))"},
+		{"SELECT id FROM chair WHERE id IN (?, ?, ?)", "SELECT id FROM chair WHERE id IN (...)"},
+		{"INSERT INTO chair_activity(chair_id, views) VALUES (?, ?),(?, ?) ON DUPLICATE KEY UPDATE views = views + VALUES(views)", "INSERT INTO chair_activity(chair_id, views) VALUES (...) ON DUPLICATE KEY UPDATE views = views + VALUES(views)"},
+		{"SELECT * FROM chair2 WHERE stock > 0", "SELECT * FROM chair2 WHERE stock > ?"},
+	}
+	for _, tt := range tests {
+		if got := normalizeSQL(tt.query); got != tt.want {
+			t.Errorf("normalizeSQL(%q): got %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	os.Setenv("ADMIN_TOKEN", "admin-token")
+	defer os.Unsetenv("ADMIN_TOKEN")
+	e := newTestServer(t)
+
+	l, err := newSlowQueryLog(e.Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slowQueries = l
+	defer func() { slowQueries = nil }()
+
+	ctx := withQueryRoute(context.Background(), "GET /api/chair/:id")
+	args := []driver.NamedValue{{Ordinal: 1, Value: int64(1)}}
+	l.record(ctx, nil, "SELECT * FROM chair WHERE id = ?", args, time.Millisecond)
+	l.record(ctx, nil, "SELECT * FROM chair WHERE id = ?", args, 150*time.Millisecond)
+	l.record(ctx, nil, "SELECT * FROM chair WHERE id = ?", args, 250*time.Millisecond)
+	l.record(context.Background(), nil, "UPDATE chair SET stock = stock - 1 WHERE id = 2", nil, time.Second)
+
+	admin := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	var res SlowQueriesResponse
+	decode(t, admin(http.MethodGet, "/api/admin/slow_queries"), &res)
+	if res.ThresholdMillis != 100 || len(res.Queries) != 2 {
+		t.Fatalf("got %+v", res)
+	}
+	if q := res.Queries[0]; q.Query != "UPDATE chair SET stock = stock - ? WHERE id = ?" || q.Count != 1 || q.Routes["-"] != 1 {
+		t.Errorf("got %+v", q)
+	}
+	if q := res.Queries[1]; q.Count != 2 || q.AvgMillis != 200 || q.MaxMillis != 250 || q.Routes["GET /api/chair/:id"] != 2 || len(q.LastParams) != 1 || q.LastParams[0] != "1" {
+		t.Errorf("got %+v", q)
+	}
+
+	// ドライバを包んだ接続で実行したクエリも記録される
+	l.reset()
+	timed := &timedConnector{Connector: slowConnector{}}
+	timed.db = sql.OpenDB(timed)
+	defer timed.db.Close()
+	if _, err := timed.db.ExecContext(ctx, "DELETE FROM chair WHERE id = ?", 3); err != nil {
+		t.Fatal(err)
+	}
+	if q := l.top(1); len(q) != 1 || q[0].Query != "DELETE FROM chair WHERE id = ?" || q[0].LastParams[0] != "3" {
+		t.Errorf("timed connector: got %+v", q)
+	}
+
+	decode(t, admin(http.MethodGet, "/api/admin/slow_queries?limit=1"), &res)
+	if len(res.Queries) != 1 {
+		t.Errorf("limit: got %v queries", len(res.Queries))
+	}
+	if rec := admin(http.MethodDelete, "/api/admin/slow_queries"); rec.Code != http.StatusNoContent {
+		t.Errorf("delete: got status %v", rec.Code)
+	}
+	decode(t, admin(http.MethodGet, "/api/admin/slow_queries"), &res)
+	if len(res.Queries) != 0 {
+		t.Errorf("after delete: got %+v", res.Queries)
+	}
+}
+
+type invalidConn struct {
+	slowConn
+}
+
+func (invalidConn) IsValid() bool { return false }
+
+func TestTimedConnIsValid(t *testing.T) {
+	var _ driver.Validator = &timedConn{}
+	if c := (&timedConn{Conn: slowConn{}}); !c.IsValid() {
+		t.Error("a conn without IsValid must be treated as valid")
+	}
+	if c := (&timedConn{Conn: invalidConn{}}); c.IsValid() {
+		t.Error("IsValid must delegate to the wrapped conn")
+	}
+}
+
+// slowConnector 全ての Exec に 100ms かかるドライバ
+type slowConnector struct{}
+
+func (slowConnector) Connect(context.Context) (driver.Conn, error) { return slowConn{}, nil }
+func (slowConnector) Driver() driver.Driver                        { return nil }
+
+type slowConn struct{}
+
+func (slowConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (slowConn) Close() error                        { return nil }
+func (slowConn) Begin() (driver.Tx, error)           { return nil, driver.ErrSkip }
+func (slowConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	time.Sleep(100 * time.Millisecond)
+	return driver.RowsAffected(1), nil
+}
+
+// prepareConnector prepare だけできるドライバ。閉じた statement の数を closed に数える
+type prepareConnector struct {
+	closed *int32
+}
+
+func (c prepareConnector) Connect(context.Context) (driver.Conn, error) { return prepareConn(c), nil }
+func (prepareConnector) Driver() driver.Driver                          { return nil }
+
+type prepareConn prepareConnector
+
+func (c prepareConn) Prepare(string) (driver.Stmt, error) { return prepareStmt(c), nil }
+func (prepareConn) Close() error                          { return nil }
+func (prepareConn) Begin() (driver.Tx, error)             { return nil, driver.ErrSkip }
+
+type prepareStmt prepareConn
+
+func (s prepareStmt) Close() error {
+	atomic.AddInt32(s.closed, 1)
+	return nil
+}
+func (prepareStmt) NumInput() int                              { return -1 }
+func (prepareStmt) Exec([]driver.Value) (driver.Result, error) { return nil, driver.ErrSkip }
+func (prepareStmt) Query([]driver.Value) (driver.Rows, error)  { return nil, driver.ErrSkip }
+
+func TestStmtCacheReset(t *testing.T) {
+	ctx := context.Background()
+	var closed int32
+	db := sqlx.NewDb(sql.OpenDB(prepareConnector{closed: &closed}), "mysql")
+	defer db.Close()
+	c := newStmtCache(db, false)
+
+	inUse, release, err := c.stmt(ctx, "SELECT * FROM chair WHERE id = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 使っている間は reset しても閉じず、次からは prepare し直した statement を使う
+	c.reset()
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&closed); n != 0 {
+		t.Fatalf("an in-use statement was closed by reset: %v closed", n)
+	}
+	fresh, releaseFresh, err := c.stmt(ctx, "SELECT * FROM chair WHERE id = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseFresh()
+	if fresh == inUse {
+		t.Error("reset must prepare the statement again")
+	}
+
+	release()
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&closed) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the old statement was not closed after its last use")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// close は使っている statement を閉じ終わるまで返らないので、その後に DB を閉じてよい
+	_, releaseLast, err := c.stmt(ctx, "SELECT * FROM chair WHERE id = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closing := make(chan struct{})
+	go func() {
+		c.close()
+		close(closing)
+	}()
+	select {
+	case <-closing:
+		t.Fatal("close returned while a statement was in use")
+	case <-time.After(20 * time.Millisecond):
+	}
+	releaseLast()
+	<-closing
+	if n := atomic.LoadInt32(&closed); n != 2 {
+		t.Errorf("got %v closed statements after close, want 2", n)
+	}
+}
+
+func TestSearchCacheCoalesces(t *testing.T) {
+	c := newSearchCache(0)
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return "result", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 5)
+	get := func(i int) {
+		defer wg.Done()
+		results[i], _ = c.get(context.Background(), "color=黒", fetch)
+	}
+	wg.Add(1)
+	go get(0)
+	<-started
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		go get(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("got %v calls, want 1", calls)
+	}
+	for i, r := range results {
+		if r != "result" {
+			t.Errorf("results[%v]: got %v", i, r)
+		}
+	}
+	// TTL が 0 なら結果は残さない
+	if _, err := c.get(context.Background(), "color=黒", fetch); err != nil || calls != 2 {
+		t.Errorf("after flight: got %v calls, err %v", calls, err)
+	}
+}
+
+func TestSearchCache(t *testing.T) {
+	now := time.Now()
+	c := newSearchCache(time.Second)
+	c.now = func() time.Time { return now }
+	calls := 0
+	fetch := func(ctx context.Context) (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+	get := func() interface{} {
+		v, err := c.get(context.Background(), "key", fetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	if v := get(); v != 1 {
+		t.Errorf("first: got %v", v)
+	}
+	if v := get(); v != 1 {
+		t.Errorf("cached: got %v", v)
+	}
+	c.invalidate()
+	if v := get(); v != 2 {
+		t.Errorf("after invalidate: got %v", v)
+	}
+	now = now.Add(time.Second)
+	if v := get(); v != 3 {
+		t.Errorf("after ttl: got %v", v)
+	}
+
+	a := ChairSearchQuery{Color: "黒", Features: []string{"肘掛け", "折りたたみ可"}, PerPage: 10}
+	b := ChairSearchQuery{Color: "黒", Features: []string{"折りたたみ可", "肘掛け", "肘掛け"}, PerPage: 10}
+	if a.key() != b.key() {
+		t.Errorf("feature order: %q != %q", a.key(), b.key())
+	}
+	b.Page = 1
+	if a.key() == b.key() {
+		t.Errorf("page: %q == %q", a.key(), b.key())
+	}
+}
+
+func TestSearchCacheInvalidation(t *testing.T) {
+	e := newTestServer(t)
+	chairSearches = newSearchCache(time.Minute)
+	defer func() { chairSearches = newSearchCache(0) }()
+
+	search := func() []int64 {
+		var res ChairSearchResponse
+		decode(t, request(e, http.MethodGet, "/api/chair/search?color=黒&page=0&perPage=10", "", nil), &res)
+		return chairIDs(res.Chairs)
+	}
+	if got := search(); fmt.Sprint(got) != "[1 4]" {
+		t.Fatalf("got %v", got)
+	}
+	// 在庫が残っている購入では捨てない
+	if rec := requestJSON(e, http.MethodPost, "/api/chair/buy/1", `{"email":"buyer@example.com"}`); rec.Code != http.StatusOK {
+		t.Fatalf("buy: got status %v", rec.Code)
+	}
+	if len(chairSearches.entries) != 1 {
+		t.Errorf("got %v entries after buying chair 1", len(chairSearches.entries))
+	}
+	if rec := requestJSON(e, http.MethodPost, "/api/chair/buy/4", `{"email":"buyer@example.com"}`); rec.Code != http.StatusOK {
+		t.Fatalf("buy: got status %v", rec.Code)
+	}
+	if got := search(); fmt.Sprint(got) != "[1]" {
+		t.Errorf("after sold out: got %v", got)
+	}
+	rec := requestCSV(t, e, "/api/chair", "chairs", "10,黒いイス,,/images/chair/10.png,1000,80,50,50,黒,,座椅子,1000,1\n")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("post: got status %v %v", rec.Code, rec.Body.String())
+	}
+	if got := search(); fmt.Sprint(got) != "[10 1]" {
+		t.Errorf("after CSV import: got %v", got)
+	}
+}
+
+// collationChairs MySQL の照合順序と LIKE の扱いが分かれる値を持つイス
+var collationChairs = []Chair{
+	{ID: 990001, Name: "a", Price: 1000, Height: 80, Width: 50, Depth: 50, Color: "Black", Kind: "Office", Features: "Wood,Armrest", Popularity: 6, Stock: 1},
+	{ID: 990002, Name: "b", Price: 1000, Height: 80, Width: 50, Depth: 50, Color: "black", Kind: "office", Features: "100%綿", Popularity: 5, Stock: 1},
+	{ID: 990003, Name: "c", Price: 1000, Height: 80, Width: 50, Depth: 50, Color: " Black", Kind: "Office ", Features: "1000円", Popularity: 4, Stock: 1},
+	{ID: 990004, Name: "d", Price: 1000, Height: 80, Width: 50, Depth: 50, Color: "BLACK", Kind: "オフィス", Features: "abc", Popularity: 3, Stock: 1},
+	{ID: 990005, Name: "e", Price: 1000, Height: 80, Width: 50, Depth: 50, Color: "Black", Kind: "オフィス", Features: `a\c,a_c`, Popularity: 2, Stock: 1},
+}
+
+var collationQueries = []struct {
+	q    ChairSearchQuery
+	want []int64
+}{
+	{ChairSearchQuery{Features: []string{"wood"}}, []int64{990001}},
+	{ChairSearchQuery{Features: []string{"WOOD", "armrest"}}, []int64{990001}},
+	{ChairSearchQuery{Features: []string{"100%"}}, []int64{990002, 990003}},
+	{ChairSearchQuery{Features: []string{`100\%`}}, []int64{990002}},
+	{ChairSearchQuery{Features: []string{"a_c"}}, []int64{990004, 990005}},
+	{ChairSearchQuery{Features: []string{`a\_c`}}, []int64{990005}},
+	{ChairSearchQuery{Features: []string{`a\\c`}}, []int64{990005}},
+	{ChairSearchQuery{Features: []string{"%綿"}}, []int64{990002}},
+	{ChairSearchQuery{Kind: "OFFICE"}, []int64{990001, 990002, 990003}},
+	{ChairSearchQuery{Color: "black  "}, []int64{990001, 990002, 990004, 990005}},
+	{ChairSearchQuery{Color: "Black", Kind: "オフィス", Features: []string{"A_C"}}, []int64{990004, 990005}},
+}
+
+func TestMemoryCollation(t *testing.T) {
+	ctx := context.Background()
+	chairs := newMemoryChairStore()
+	chairs.reset(collationChairs)
+	for _, tt := range collationQueries {
+		tt.q.PerPage = 10
+		_, got, err := chairs.SearchChairs(ctx, tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(chairIDs(got)) != fmt.Sprint(tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.q, chairIDs(got), tt.want)
+		}
+	}
+}
+
+// TestMySQLCollation 同じ検索を MySQL とメモリの両方で行い、結果が同じことを確かめる
+// 手元の MySQL にイスを書き込むので、ISUUMO_TEST_MYSQL を指定したときだけ動かす
+func TestMySQLCollation(t *testing.T) {
+	if os.Getenv("ISUUMO_TEST_MYSQL") == "" {
+		t.Skip("ISUUMO_TEST_MYSQL is not set")
+	}
+	ctx := context.Background()
+	backend, err := newMySQLStoreBackend(NewMySQLConnectionEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	source := backend.ChairStore().(catalogChairSource)
+	cleanup := func() {
+		for _, chair := range collationChairs {
+			source.DeleteChair(ctx, chair.ID)
+		}
+	}
+	cleanup()
+	defer cleanup()
+	if err := source.InsertChairs(ctx, collationChairs); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := source.loadChairs(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := newMemoryChairStore()
+	mem.reset(rows)
+	for _, tt := range collationQueries {
+		tt.q.PerPage = 100
+		wantCount, want, err := source.SearchChairs(ctx, tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotCount, got, _ := mem.SearchChairs(ctx, tt.q)
+		if gotCount != wantCount || fmt.Sprint(chairIDs(got)) != fmt.Sprint(chairIDs(want)) {
+			t.Errorf("%+v: memory got %v %v, MySQL got %v %v", tt.q, gotCount, chairIDs(got), wantCount, chairIDs(want))
+		}
+	}
+}
+
+func TestCatalogStore(t *testing.T) {
+	ctx := context.Background()
+	source, err := newMemoryStoreBackend(filepath.Join("testdata", "chairs.ndjson"), filepath.Join("testdata", "estates.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := newCatalogStoreBackend(source, echo.New().Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chairs, estates := catalog.ChairStore(), catalog.EstateStore()
+
+	// カタログの読み込みは、元のストアと同じ結果を返さなければならない
+	same := func(step string) {
+		t.Helper()
+		for _, q := range []ChairSearchQuery{
+			{Page: 0, PerPage: 10},
+			{Color: "黒", Page: 0, PerPage: 10},
+			{Price: &Range{Min: -1, Max: 10000}, Page: 0, PerPage: 1},
+		} {
+			wantCount, want, _ := source.ChairStore().SearchChairs(ctx, q)
+			gotCount, got, _ := chairs.SearchChairs(ctx, q)
+			if gotCount != wantCount || !reflect.DeepEqual(got, want) {
+				t.Errorf("%v: search %+v: got %v %v, want %v %v", step, q, gotCount, chairIDs(got), wantCount, chairIDs(want))
+			}
+		}
+		want, _ := source.ChairStore().LowPricedChairs(ctx, 3)
+		got, _ := chairs.LowPricedChairs(ctx, 3)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: low priced: got %v, want %v", step, chairIDs(got), chairIDs(want))
+		}
+		want, _ = source.ChairStore().RecommendedChairs(ctx, 100, 100, 20)
+		got, _ = chairs.RecommendedChairs(ctx, 100, 100, 20)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: recommended: got %v, want %v", step, chairIDs(got), chairIDs(want))
+		}
+		for id := int64(1); id <= 10; id++ {
+			want, wantErr := source.ChairStore().GetChair(ctx, id)
+			got, gotErr := chairs.GetChair(ctx, id)
+			if !reflect.DeepEqual(got, want) || gotErr != wantErr {
+				t.Errorf("%v: chair %v: got %+v %v, want %+v %v", step, id, got, gotErr, want, wantErr)
+			}
+		}
+		wantEstates, _ := source.EstateStore().LowPricedEstates(ctx, 20)
+		gotEstates, _ := estates.LowPricedEstates(ctx, 20)
+		if !reflect.DeepEqual(gotEstates, wantEstates) {
+			t.Errorf("%v: low priced estates: got %v, want %v", step, estateIDs(gotEstates), estateIDs(wantEstates))
+		}
+	}
+	same("initial")
+
+	if _, err := chairs.BuyChair(ctx, 4, "buyer@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	same("after sold out")
+	if err := chairs.InsertChairs(ctx, []Chair{{ID: 10, Name: "黒いイス", Price: 1000, Height: 80, Width: 50, Depth: 50, Color: "黒", Kind: "座椅子", Popularity: 1000, Stock: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	same("after insert")
+	if _, err := chairs.UpdateChair(ctx, 3, func(c *Chair) error { c.Price = 500; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	same("after update")
+	if err := chairs.DeleteChair(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	same("after delete")
+	if _, err := estates.UpdateEstate(ctx, 1, func(e *Estate) error { e.Rent = 1; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	same("after estate update")
+
+	// 書き込みはそのまま元のストアのエラーを返す
+	if _, err := chairs.BuyChair(ctx, 2, "buyer@example.com"); err == nil {
+		t.Error("buying a sold out chair must fail")
+	}
+	if err := catalog.Initialize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	same("after initialize")
+}
+
+// countingChairSource 元のストアを読み直した回数を数える
+type countingChairSource struct {
+	catalogChairSource
+	loads int
+	// fail 残りの回数だけ読み直しを失敗させる
+	fail int
+}
+
+func (s *countingChairSource) loadChairs(ctx context.Context, ids []int64) ([]Chair, error) {
+	s.loads++
+	if s.fail > 0 {
+		s.fail--
+		return nil, errors.New("primary unavailable")
+	}
+	return s.catalogChairSource.loadChairs(ctx, ids)
+}
+
+func TestCatalogStoreAppliesWrites(t *testing.T) {
+	ctx := context.Background()
+	source, err := newMemoryStoreBackend(filepath.Join("testdata", "chairs.ndjson"), filepath.Join("testdata", "estates.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingChairSource{catalogChairSource: source.ChairStore().(catalogChairSource)}
+	closed := make(chan struct{})
+	defer close(closed)
+	chairs := newCatalogChairStore(counting, echo.New().Logger, closed)
+	if err := chairs.refresh(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 確定した行はそのまま反映し、元のストアは読み直さない
+	if _, err := chairs.UpdateChair(ctx, 3, func(c *Chair) error { c.Price = 500; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := chairs.DeleteChair(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if counting.loads != 1 {
+		t.Errorf("got %v loads, want only the initial one", counting.loads)
+	}
+
+	// 購入は確定した行だけを読み直す
+	if _, err := chairs.BuyChair(ctx, 4, "buyer@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if counting.loads != 2 {
+		t.Errorf("got %v loads after a purchase, want 2", counting.loads)
+	}
+	for id := int64(1); id <= 4; id++ {
+		want, wantErr := source.ChairStore().GetChair(ctx, id)
+		got, gotErr := chairs.GetChair(ctx, id)
+		if !reflect.DeepEqual(got, want) || gotErr != wantErr {
+			t.Errorf("chair %v: got %+v %v, want %+v %v", id, got, gotErr, want, wantErr)
+		}
+	}
+
+	// 読み直しに失敗した後は、次の書き込みで全て読み直す
+	chairs.stale = true
+	if _, err := chairs.UpdateChair(ctx, 3, func(c *Chair) error { c.Price = 600; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if counting.loads != 3 || chairs.stale {
+		t.Errorf("got %v loads and stale %v after recovering", counting.loads, chairs.stale)
+	}
+
+	// 反映の読み直しに失敗しても書き込みは成功させ、次の書き込みを待たずに読み直す
+	defer func(d time.Duration) { catalogReloadInterval = d }(catalogReloadInterval)
+	catalogReloadInterval = 10 * time.Millisecond
+	chairs.mu.Lock()
+	chairs.stale = true
+	chairs.mu.Unlock()
+	counting.fail = 2
+	if _, err := chairs.UpdateChair(ctx, 3, func(c *Chair) error { c.Price = 700; return nil }); err != nil {
+		t.Fatalf("the committed update must succeed: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		chairs.mu.Lock()
+		done := !chairs.stale && !chairs.reloading
+		chairs.mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("catalog was not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got, _ := chairs.GetChair(ctx, 3); got.Price != 700 {
+		t.Errorf("after reload: got price %v", got.Price)
+	}
+
+	// 人気度は再計算したときだけ読み直す
+	loads := counting.loads
+	if recomputed, err := chairs.RecomputeChairPopularity(ctx, PopularityConfig{}); err != nil || !recomputed {
+		t.Fatalf("first recompute: got %v %v", recomputed, err)
+	}
+	if recomputed, err := chairs.RecomputeChairPopularity(ctx, PopularityConfig{MinInterval: time.Hour}); err != nil || recomputed {
+		t.Fatalf("recompute within MinInterval: got %v %v", recomputed, err)
+	}
+	if counting.loads != loads+1 {
+		t.Errorf("got %v loads for one recompute", counting.loads-loads)
+	}
+}
+
+// fakeRedis PUBLISH と SUBSCRIBE だけを受け付ける Redis の代わり
+type fakeRedis struct {
+	ln net.Listener
+
+	mu          sync.Mutex
+	subscribers map[string][]net.Conn
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{ln: ln, subscribers: map[string][]net.Conn{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		cmd, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		args, _ := cmd.([]interface{})
+		if len(args) == 0 {
+			return
+		}
+		name, _ := args[0].(string)
+		r.mu.Lock()
+		switch {
+		case strings.EqualFold(name, "SUBSCRIBE") && len(args) == 2:
+			channel := args[1].(string)
+			r.subscribers[channel] = append(r.subscribers[channel], conn)
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%v\r\n%v\r\n:1\r\n", len(channel), channel)
+		case strings.EqualFold(name, "PUBLISH") && len(args) == 3:
+			channel := args[1].(string)
+			for _, sub := range r.subscribers[channel] {
+				writeRESPCommand(sub, "message", channel, args[2].(string))
+			}
+			fmt.Fprintf(conn, ":%v\r\n", len(r.subscribers[channel]))
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%v'\r\n", name)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// dropSubscribers 購読の接続を切り、繋ぎ直させる
+func (r *fakeRedis) dropSubscribers() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for channel, subs := range r.subscribers {
+		for _, sub := range subs {
+			sub.Close()
+		}
+		delete(r.subscribers, channel)
+	}
+}
+
+func (r *fakeRedis) Close() {
+	r.ln.Close()
+	r.dropSubscribers()
+}
+
+func TestInvalidationBus(t *testing.T) {
+	ctx := context.Background()
+	logger := echo.New().Logger
+	receiver := func() (func(ChangeEvent), chan ChangeEvent) {
+		events := make(chan ChangeEvent, 10)
+		return func(ev ChangeEvent) { events <- ev }, events
+	}
+	wait := func(events chan ChangeEvent) *ChangeEvent {
+		select {
+		case ev := <-events:
+			return &ev
+		case <-time.After(3 * time.Second):
+			return nil
+		}
+	}
+	ev := ChangeEvent{Node: "a", Target: changeTargetChair, IDs: []int64{1, 4}, Searches: true}
+
+	t.Run("local", func(t *testing.T) {
+		hub := &localBusHub{}
+		handleA, eventsA := receiver()
+		handleB, eventsB := receiver()
+		a := hub.join(handleA)
+		b := hub.join(handleB)
+		defer b.Close()
+		if err := a.Publish(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+		if got := wait(eventsB); got == nil || !reflect.DeepEqual(*got, ev) {
+			t.Errorf("got %+v, want %+v", got, ev)
+		}
+		// 送ったバスにも届く。自分の通知を無視するのは changeNotifier
+		if got := wait(eventsA); got == nil {
+			t.Error("publisher must receive its own event")
+		}
+		a.Close()
+		if err := b.Publish(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+		if len(eventsA) != 0 {
+			t.Errorf("closed bus received %v events", len(eventsA))
+		}
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		server := newFakeRedis(t)
+		defer server.Close()
+		addr := server.ln.Addr().String()
+		handleA, _ := receiver()
+		handleB, eventsB := receiver()
+		a, err := newRedisBus(addr, "changes", handleA, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close()
+		b, err := newRedisBus(addr, "changes", handleB, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+
+		if err := a.Publish(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+		if got := wait(eventsB); got == nil || !reflect.DeepEqual(*got, ev) {
+			t.Errorf("got %+v, want %+v", got, ev)
+		}
+
+		// 繋ぎ直したら、切れていた間の通知の代わりに全て読み直させる
+		server.dropSubscribers()
+		for _, want := range resyncEvents() {
+			if got := wait(eventsB); got == nil || !reflect.DeepEqual(*got, want) {
+				t.Errorf("after reconnect: got %+v, want %+v", got, want)
+			}
+		}
+		if err := a.Publish(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+		if got := wait(eventsB); got == nil || !reflect.DeepEqual(*got, ev) {
+			t.Errorf("after reconnect: got %+v, want %+v", got, ev)
+		}
+
+		if _, err := newRedisBus("127.0.0.1:1", "changes", handleA, logger); err == nil {
+			t.Error("connecting to a closed port must fail")
+		}
+	})
+
+	t.Run("multicast", func(t *testing.T) {
+		handleA, _ := receiver()
+		handleB, eventsB := receiver()
+		addr := "239.255.0.1:19998"
+		a, err := newMulticastBus(addr, "", handleA, logger)
+		if err != nil {
+			t.Skipf("multicast is not available: %v", err)
+		}
+		defer a.Close()
+		b, err := newMulticastBus(addr, "", handleB, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		if err := a.Publish(ctx, ev); err != nil {
+			t.Skipf("multicast is not available: %v", err)
+		}
+		if got := wait(eventsB); got == nil || !reflect.DeepEqual(*got, ev) {
+			t.Errorf("got %+v, want %+v", got, ev)
+		}
+	})
+}
+
+func TestApplyChange(t *testing.T) {
+	ctx := context.Background()
+	e := newTestServer(t)
+	source := storeBackend
+	catalog, err := newCatalogStoreBackend(source, echo.New().Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setStoreBackend(catalog)
+	chairSearches = newSearchCache(time.Minute)
+	defer func() { chairSearches = newSearchCache(0) }()
+	n := &changeNotifier{node: "b", logger: e.Logger}
+
+	search := func() string {
+		var res ChairSearchResponse
+		decode(t, request(e, http.MethodGet, "/api/chair/search?color=黒&page=0&perPage=10", "", nil), &res)
+		return fmt.Sprint(chairIDs(res.Chairs))
+	}
+	if got := search(); got != "[1 4]" {
+		t.Fatalf("got %v", got)
+	}
+
+	// 他のノードが MySQL の在庫を売り切った
+	if _, err := source.ChairStore().BuyChair(ctx, 4, "buyer@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// 自分が送った通知は無視する
+	n.receive(ChangeEvent{Node: "b", Target: changeTargetChair, IDs: []int64{4}, Searches: true})
+	if got := search(); got != "[1 4]" {
+		t.Errorf("own change must be ignored: got %v", got)
+	}
+	n.receive(ChangeEvent{Node: "a", Target: changeTargetChair, IDs: []int64{4}, Searches: true})
+	if got := search(); got != "[1]" {
+		t.Errorf("after change: got %v", got)
+	}
+	if rec := request(e, http.MethodGet, "/api/chair/4", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("sold out chair: got status %v, want %v", rec.Code, http.StatusNotFound)
+	}
+
+	// このノードでの書き込みは他のノードに通知する
+	hub := &localBusHub{}
+	received := []ChangeEvent{}
+	hub.join(func(ev ChangeEvent) { received = append(received, ev) })
+	n.bus = hub.join(n.receive)
+	changes = n
+	defer func() { changes = nil }()
+	if rec := requestJSON(e, http.MethodPost, "/api/chair/buy/1", `{"email":"buyer@example.com"}`); rec.Code != http.StatusOK {
+		t.Fatalf("buy: got status %v", rec.Code)
+	}
+	rec := requestCSV(t, e, "/api/chair", "chairs", "10,黒いイス,,/images/chair/10.png,1000,80,50,50,黒,,座椅子,1000,1\n")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("post: got status %v %v", rec.Code, rec.Body.String())
+	}
+	want := []ChangeEvent{
+		{Node: "b", Target: changeTargetChair, IDs: []int64{1}, Searches: false},
+		{Node: "b", Target: changeTargetChair, IDs: []int64{10}, Searches: true},
+	}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("got %+v, want %+v", received, want)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isuumo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "isuumo.sock")
+	os.Setenv("SERVER_SOCKET", path)
+	defer os.Unsetenv("SERVER_SOCKET")
+
+	// 前のプロセスが残したソケットは消して待ち受ける
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err := listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0666 {
+		t.Errorf("socket mode: got %v %v", fi, err)
+	}
+
+	e := newTestServer(t)
+	e.HideBanner = true
+	e.HidePort = true
+	started := make(chan struct{})
+	e.GET("/slow", func(c echo.Context) error {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		return c.String(http.StatusOK, "done")
+	})
+	stream = newStreamHub(defaultStreamBufferSize)
+	defer func() { stream = newStreamHub(defaultStreamBufferSize) }()
+
+	workers := newBackgroundWorkers()
+	var stopped int32
+	workers.start(func(ctx context.Context) {
+		<-ctx.Done()
+		atomic.StoreInt32(&stopped, 1)
+	})
+	signals := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(e, ln, workers, signals, 5*time.Second, 5*time.Second)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	streamRes, err := client.Get("http://isuumo/api/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer streamRes.Body.Close()
+	type result struct {
+		body string
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		res, err := client.Get("http://isuumo/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		slow <- result{string(body), err}
+	}()
+
+	// 処理中のリクエストは終わるまで待ち、購読者には繋ぎ直すよう伝えてから止まる
+	<-started
+	signals <- syscall.SIGTERM
+	if r := <-slow; r.err != nil || r.body != "done" {
+		t.Errorf("in-flight request: got %q %v", r.body, r.err)
+	}
+	body, err := ioutil.ReadAll(streamRes.Body)
+	if err != nil || !strings.HasSuffix(string(body), streamRetryMessage) {
+		t.Errorf("stream: got %q %v", body, err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return")
+	}
+	if atomic.LoadInt32(&stopped) != 1 || !workers.stopped() {
+		t.Error("background workers must be stopped")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket must be removed: %v", err)
+	}
+}
+
+func TestBackgroundWorkersStop(t *testing.T) {
+	workers := newBackgroundWorkers()
+	release := make(chan struct{})
+	workers.start(func(ctx context.Context) {
+		<-ctx.Done()
+		<-release
+	})
+
+	// 期限までに戻らなければ、止まっていないと分かるようにする
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := workers.stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want deadline exceeded", err)
+	}
+	if workers.stopped() {
+		t.Error("a worker that has not returned must not be reported as stopped")
+	}
+	close(release)
+	if err := workers.stop(context.Background()); err != nil || !workers.stopped() {
+		t.Errorf("after release: got %v, stopped %v", err, workers.stopped())
+	}
+}
+
+func TestInitialize(t *testing.T) {
+	ctx := context.Background()
+	e := newTestServer(t)
+
+	rec := requestAdmin(e, http.MethodPost, "/api/webhook", echo.MIMEApplicationJSON, strings.NewReader(`{"url":"http://localhost/hook","events":["chair.sold_out"]}`))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("webhook: got status %v", rec.Code)
+	}
+	if rec := requestAdmin(e, http.MethodPatch, "/api/chair/1", echo.MIMEApplicationJSON, strings.NewReader(`{"stock":0}`)); rec.Code != http.StatusOK {
+		t.Fatalf("patch: got status %v", rec.Code)
+	}
+	if rec := requestAdmin(e, http.MethodDelete, "/api/estate/1", "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: got status %v, want %v", rec.Code, http.StatusNoContent)
+	}
+	if rec := request(e, http.MethodPost, "/initialize", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("initialize: got status %v, want %v", rec.Code, http.StatusOK)
+	}
+	if rec := request(e, http.MethodGet, "/api/estate/1", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("initialize must restore data: got status %v, want %v", rec.Code, http.StatusOK)
+	}
+
+	// 通知先の登録は残し、送信待ちの配信だけを消す
+	if endpoints, err := webhookStore.Webhooks(ctx); err != nil || len(endpoints) != 1 {
+		t.Errorf("got endpoints %+v %v, want the registered one", endpoints, err)
+	}
+	if deliveries, err := webhookStore.ClaimWebhookDeliveries(ctx, 10, time.Minute); err != nil || len(deliveries) != 0 {
+		t.Errorf("got deliveries %+v %v, want none", deliveries, err)
+	}
+}
+
+func TestPopularityTracking(t *testing.T) {
+	ctx := context.Background()
+	e := newTestServer(t)
+	popularity = &popularityTracker{conf: PopularityConfig{ChairViewWeight: 1, ChairPurchaseWeight: 300}}
+	popularity.reset()
+	defer func() { popularity = nil }()
+
+	search := func() string {
+		var res ChairSearchResponse
+		decode(t, request(e, http.MethodGet, "/api/chair/search?kind=座椅子&page=0&perPage=10", "", nil), &res)
+		return fmt.Sprint(chairIDs(res.Chairs))
+	}
+	if got, want := search(), "[5 1]"; got != want {
+		t.Fatalf("before: got %v, want %v", got, want)
+	}
+
+	// 500 + 閲覧 1 + 購入 300 で 800 の 5 を抜く
+	request(e, http.MethodGet, "/api/chair/1", "", nil)
+	requestJSON(e, http.MethodPost, "/api/chair/buy/1", `{"email":"buyer@example.com"}`)
+	if got, want := search(), "[5 1]"; got != want {
+		t.Errorf("before recompute: got %v, want %v", got, want)
+	}
+	if err := popularity.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := popularity.recompute(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := search(), "[1 5]"; got != want {
+		t.Errorf("after recompute: got %v, want %v", got, want)
+	}
+	if chair, _ := chairStore.GetChair(ctx, 1); chair.Popularity != 801 {
+		t.Errorf("got popularity %v, want %v", chair.Popularity, 801)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const defaultPopularityFlushInterval = 5 * time.Second
+
+// popularityFinalFlushTimeout 終了するときに、溜まっている件数を書き込むのを待つ時間
+const popularityFinalFlushTimeout = 5 * time.Second
+
+// popularity 利用者の行動を数える。POPULARITY_RECOMPUTE_INTERVAL が未設定なら nil で、何も記録しない
+// ベンチマーカーは入稿した popularity の順で検索結果を検証するので、既定では無効にしている
+var popularity *popularityTracker
+
+// ChairActivity 前回の再計算以降のイスの閲覧数と購入数
+type ChairActivity struct {
+	Views     int64
+	Purchases int64
+}
+
+// EstateActivity 前回の再計算以降の物件の閲覧数と資料請求数
+type EstateActivity struct {
+	Views    int64
+	Requests int64
+}
+
+// PopularityConfig popularity の再計算の方法
+// popularity = floor(popularity * 0.5^(経過時間 / HalfLife)) + round(各イベント数 * 重み)
+type PopularityConfig struct {
+	ChairViewWeight     float64
+	ChairPurchaseWeight float64
+	EstateViewWeight    float64
+	EstateRequestWeight float64
+	// HalfLife 0 なら減衰させない
+	HalfLife time.Duration
+	// MinInterval 前回の再計算からこれより短い間隔では再計算しない
+	// 複数台で動かしても減衰が重複しないようにするため
+	MinInterval time.Duration
+}
+
+func (conf PopularityConfig) decay(elapsed time.Duration) float64 {
+	if conf.HalfLife <= 0 || elapsed <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, elapsed.Seconds()/conf.HalfLife.Seconds())
+}
+
+type popularityTracker struct {
+	conf              PopularityConfig
+	flushInterval     time.Duration
+	recomputeInterval time.Duration
+
+	mu      sync.Mutex
+	chairs  map[int64]ChairActivity
+	estates map[int64]EstateActivity
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	f, err := strconv.ParseFloat(getEnv(key, ""), 64)
+	if err != nil || f < 0 {
+		return defaultValue
+	}
+	return f
+}
+
+// newPopularityTracker POPULARITY_* から設定を読む。再計算の間隔が未設定なら nil を返す
+func newPopularityTracker() *popularityTracker {
+	recomputeInterval := getEnvDuration("POPULARITY_RECOMPUTE_INTERVAL", 0)
+	if recomputeInterval == 0 {
+		return nil
+	}
+	t := &popularityTracker{
+		conf: PopularityConfig{
+			ChairViewWeight:     getEnvFloat("POPULARITY_WEIGHT_CHAIR_VIEW", 1),
+			ChairPurchaseWeight: getEnvFloat("POPULARITY_WEIGHT_CHAIR_PURCHASE", 10),
+			EstateViewWeight:    getEnvFloat("POPULARITY_WEIGHT_ESTATE_VIEW", 1),
+			EstateRequestWeight: getEnvFloat("POPULARITY_WEIGHT_ESTATE_REQUEST", 10),
+			HalfLife:            getEnvDuration("POPULARITY_HALF_LIFE", 0),
+			MinInterval:         recomputeInterval / 2,
+		},
+		flushInterval:     getEnvDuration("POPULARITY_FLUSH_INTERVAL", defaultPopularityFlushInterval),
+		recomputeInterval: recomputeInterval,
+	}
+	t.reset()
+	return t
+}
+
+func (t *popularityTracker) reset() {
+	t.chairs = map[int64]ChairActivity{}
+	t.estates = map[int64]EstateActivity{}
+}
+
+func (t *popularityTracker) chairViewed(id int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	a := t.chairs[id]
+	a.Views++
+	t.chairs[id] = a
+	t.mu.Unlock()
+}
+
+func (t *popularityTracker) chairPurchased(id int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	a := t.chairs[id]
+	a.Purchases++
+	t.chairs[id] = a
+	t.mu.Unlock()
+}
+
+func (t *popularityTracker) estateViewed(id int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	a := t.estates[id]
+	a.Views++
+	t.estates[id] = a
+	t.mu.Unlock()
+}
+
+func (t *popularityTracker) estateRequested(id int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	a := t.estates[id]
+	a.Requests++
+	t.estates[id] = a
+	t.mu.Unlock()
+}
+
+// flush 溜まった件数をまとめてストアに書き込む
+func (t *popularityTracker) flush(ctx context.Context) error {
+	t.mu.Lock()
+	chairs, estates := t.chairs, t.estates
+	t.reset()
+	t.mu.Unlock()
+
+	if err := chairStore.AddChairActivity(ctx, chairs); err != nil {
+		return err
+	}
+	return estateStore.AddEstateActivity(ctx, estates)
+}
+
+func (t *popularityTracker) recompute(ctx context.Context) error {
+	// 検索は popularity の順なので、再計算したら結果を捨てる
+	defer chairSearches.invalidate()
+	defer estateSearches.invalidate()
+	if _, err := chairStore.RecomputeChairPopularity(ctx, t.conf); err != nil {
+		return err
+	}
+	_, err := estateStore.RecomputeEstatePopularity(ctx, t.conf)
+	return err
+}
+
+// run ctx が終わったら、溜まっている件数を書き込んでから戻る
+func (t *popularityTracker) run(ctx context.Context, e *echo.Echo) {
+	ctx = withQueryRoute(ctx, "popularity")
+	flushTicker := time.NewTicker(t.flushInterval)
+	defer flushTicker.Stop()
+	recomputeTicker := time.NewTicker(t.recomputeInterval)
+	defer recomputeTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(withQueryRoute(context.Background(), "popularity"), popularityFinalFlushTimeout)
+			defer cancel()
+			if err := t.flush(flushCtx); err != nil {
+				e.Logger.Errorf("failed to flush popularity activity : %v", err)
+			}
+			return
+		case <-flushTicker.C:
+			if err := t.flush(ctx); err != nil {
+				e.Logger.Errorf("failed to flush popularity activity : %v", err)
+			}
+		case <-recomputeTicker.C:
+			if err := t.flush(ctx); err != nil {
+				e.Logger.Errorf("failed to flush popularity activity : %v", err)
+			}
+			if err := t.recompute(ctx); err != nil {
+				e.Logger.Errorf("failed to recompute popularity : %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 使われていないバケットを掃除する間隔
+const rateLimitCleanupInterval = time.Minute
+
+const (
+	rateLimitGroupSearch = "search"
+	rateLimitGroupDetail = "detail"
+	rateLimitGroupWrite  = "write"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter クライアントごとのトークンバケット
+type rateLimiter struct {
+	rate  float64 // 1秒あたりに補充するトークン数
+	burst float64
+
+	mu          sync.Mutex
+	buckets     map[string]*tokenBucket
+	lastCleanup time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:        rate,
+		burst:       float64(burst),
+		buckets:     map[string]*tokenBucket{},
+		lastCleanup: time.Now(),
+	}
+}
+
+// parseRateLimit "10:20" のような 1秒あたりのリクエスト数:バースト の形式を読む
+func parseRateLimit(s string) (*rateLimiter, error) {
+	parts := strings.SplitN(s, ":", 2)
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("invalid rate %q", s)
+	}
+	burst := int(math.Ceil(rate))
+	if len(parts) == 2 {
+		burst, err = strconv.Atoi(parts[1])
+		if err != nil || burst <= 0 {
+			return nil, fmt.Errorf("invalid burst %q", s)
+		}
+	}
+	return newRateLimiter(rate, burst), nil
+}
+
+// allow トークンが残っていれば消費して true を返す。足りなければ次に使えるまでの時間を返す
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastCleanup) > rateLimitCleanupInterval {
+		l.cleanup(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// cleanup 満タンまで回復したバケットは新規作成と同じなので捨てる
+func (l *rateLimiter) cleanup(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastCleanup = now
+}
+
+// rateLimitTier ルートのグループごとの人間用・クローラー用の制限。nil なら制限しない
+type rateLimitTier struct {
+	human *rateLimiter
+	bot   *rateLimiter
+}
+
+type rateLimitConfig struct {
+	keyByUserAgent bool
+	tiers          map[string]*rateLimitTier
+}
+
+// newRateLimitConfig RATE_LIMIT_{SEARCH,DETAIL,WRITE}_{HUMAN,BOT} から制限を読む
+func newRateLimitConfig() (*rateLimitConfig, error) {
+	conf := &rateLimitConfig{
+		keyByUserAgent: getEnv("RATE_LIMIT_KEY", "ip") == "ua",
+		tiers:          map[string]*rateLimitTier{},
+	}
+	for _, group := range []string{rateLimitGroupSearch, rateLimitGroupDetail, rateLimitGroupWrite} {
+		tier := &rateLimitTier{}
+		for _, class := range []string{"HUMAN", "BOT"} {
+			key := fmt.Sprintf("RATE_LIMIT_%v_%v", strings.ToUpper(group), class)
+			v := getEnv(key, "")
+			if v == "" {
+				continue
+			}
+			limiter, err := parseRateLimit(v)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", key, err)
+			}
+			if class == "BOT" {
+				tier.bot = limiter
+			} else {
+				tier.human = limiter
+			}
+		}
+		conf.tiers[group] = tier
+	}
+	return conf, nil
+}
+
+func (conf *rateLimitConfig) middleware(group string) echo.MiddlewareFunc {
+	tier := conf.tiers[group]
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ua := c.Request().UserAgent()
+			limiter := tier.human
+			switch bots.classify(ua) {
+			case botActionBlock:
+				return newAPIError(http.StatusServiceUnavailable, errCodeBlocked, "", "crawler is blocked")
+			case botActionThrottle:
+				limiter = tier.bot
+			}
+			if limiter == nil {
+				return next(c)
+			}
+
+			key := c.RealIP()
+			if conf.keyByUserAgent {
+				key = ua
+			}
+			ok, wait := limiter.allow(key, time.Now())
+			if !ok {
+				c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				return newAPIError(http.StatusTooManyRequests, errCodeRateLimited, "", "too many requests")
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const defaultReservationTTL = 10 * time.Minute
+const defaultReservationSweepInterval = 30 * time.Second
+
+var reservationTTL = defaultReservationTTL
+
+type ChairReservationResponse struct {
+	ReservationID string    `json:"reservationId"`
+	ChairID       int64     `json:"chairId"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	d, err := time.ParseDuration(getEnv(key, ""))
+	if err != nil || d <= 0 {
+		return defaultValue
+	}
+	return d
+}
+
+func newReservationToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// reserveChair イスを1脚確保する
+// 確保した時点で在庫を減らすので、確保中のイスは詳細・検索で在庫として数えられない
+func reserveChair(c echo.Context) error {
+	m := echo.Map{}
+	if err := c.Bind(&m); err != nil {
+		c.Echo().Logger.Infof("post reserve chair failed : %v", err)
+		return errInvalidBody("", "request body is not valid JSON")
+	}
+
+	email, ok := m["email"].(string)
+	if !ok {
+		c.Echo().Logger.Info("post reserve chair failed : email not found in request body")
+		return errInvalidBody("email", "email is required")
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("post reserve chair failed : %v", err)
+		return errInvalidParameter("id", "id must be an integer")
+	}
+
+	token, err := newReservationToken()
+	if err != nil {
+		return errInternal(fmt.Errorf("failed to generate reservation token : %v", err))
+	}
+
+	stock, expiresAt, err := chairStore.ReserveChair(c.Request().Context(), int64(id), token, email, reservationTTL)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("reserveChair chair id \"%v\" not found", id)
+			return errNotFound("chair not found")
+		}
+		return errInternal(fmt.Errorf("DB Execution Error: on reserving a chair by id : %v", err))
+	}
+	chairsChanged(c.Request().Context(), stock == 0, []int64{int64(id)})
+
+	publishStream(c, streamEventChairStock, ChairStockEvent{ID: int64(id), Stock: stock})
+	return c.JSON(http.StatusOK, ChairReservationResponse{
+		ReservationID: token,
+		ChairID:       int64(id),
+		ExpiresAt:     expiresAt,
+	})
+}
+
+// consumeChairReservation buyChair から呼ばれ、確保済みの在庫で購入を確定する
+func consumeChairReservation(c echo.Context, id int, token, email string) error {
+	err := chairStore.ConsumeChairReservation(c.Request().Context(), int64(id), token, email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("buyChair reservation \"%v\" for chair id \"%v\" not found", token, id)
+			return newAPIError(http.StatusNotFound, errCodeNotFound, "reservationId", "reservation not found or expired")
+		}
+		return errInternal(fmt.Errorf("DB Execution Error: on consuming a reservation by token : %v", err))
+	}
+
+	popularity.chairPurchased(int64(id))
+	return c.NoContent(http.StatusOK)
+}
+
+// runReservationSweeper ctx が終わったら戻る
+func runReservationSweeper(ctx context.Context, e *echo.Echo, interval time.Duration) {
+	ctx = withQueryRoute(ctx, "reservation sweeper")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stocks, err := chairStore.ReleaseExpiredReservations(ctx)
+		if err != nil {
+			e.Logger.Errorf("failed to release expired reservations : %v", err)
+			continue
+		}
+		if len(stocks) == 0 {
+			continue
+		}
+		ids := make([]int64, 0, len(stocks))
+		for id, stock := range stocks {
+			ids = append(ids, id)
+			// 購入・確保と同じく、在庫が戻ったことを /api/stream の購読者に知らせる
+			if err := stream.publish(streamEventChairStock, ChairStockEvent{ID: id, Stock: stock}); err != nil {
+				e.Logger.Errorf("failed to publish %v : %v", streamEventChairStock, err)
+			}
+		}
+		chairsChanged(ctx, true, ids)
+		e.Logger.Infof("released expired reservations of %v chairs", len(stocks))
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSearchCacheEntries 検索条件の組み合わせがこれを超えたら、期限切れのものを捨てる
+const maxSearchCacheEntries = 10000
+
+// 検索の結果を共有する。TTL は SEARCH_CACHE_TTL で、0 なら同時に来た同じ検索をまとめるだけにする
+var chairSearches = newSearchCache(0)
+var estateSearches = newSearchCache(0)
+
+// flightCall 実行中の検索。done が閉じたら val と err が読める
+type flightCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// flightGroup 同じ key の呼び出しが実行中なら、新しく実行せずにその結果を待つ
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// do fn はどの呼び出し元の context でもなく、最初の呼び出し元の期限だけを引き継いだ context で動く
+// 最初の呼び出し元が切断しても、待っている他の呼び出し元の検索は打ち切らない
+// 呼び出し元は自分の ctx が終われば結果を待たずに戻る。shared は他の呼び出しの結果を使ったかどうか
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (val interface{}, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall{}
+	}
+	call, shared := g.calls[key]
+	if !shared {
+		call = &flightCall{done: make(chan struct{})}
+		g.calls[key] = call
+		fctx, cancel := detachContext(ctx)
+		go func() {
+			defer cancel()
+			call.val, call.err = fn(fctx)
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.val, shared, call.err
+	case <-ctx.Done():
+		return nil, shared, ctx.Err()
+	}
+}
+
+// detachContext ctx の期限とルート名だけを引き継ぎ、切断では終わらない context を返す
+func detachContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := withQueryRoute(context.Background(), queryRoute(ctx))
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return context.WithCancel(detached)
+}
+
+type searchCacheEntry struct {
+	val     interface{}
+	expires time.Time
+}
+
+// searchCache 検索の結果を ttl の間だけ使い回す。値は共有するので、呼び出し元は書き換えないこと
+type searchCache struct {
+	ttl     time.Duration
+	now     func() time.Time
+	flights flightGroup
+
+	mu sync.Mutex
+	// generation invalidate のたびに増やす。実行中だった検索の結果は、増える前の世代なので保存しない
+	generation uint64
+	entries    map[string]searchCacheEntry
+}
+
+func newSearchCache(ttl time.Duration) *searchCache {
+	return &searchCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]searchCacheEntry{},
+	}
+}
+
+func (c *searchCache) get(ctx context.Context, key string, fetch func(context.Context) (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	generation := c.generation
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.val, nil
+	}
+
+	// 世代を key に含め、invalidate より前に始まった検索には相乗りしない
+	val, _, err := c.flights.do(ctx, fmt.Sprintf("%v|%v", generation, key), func(ctx context.Context) (interface{}, error) {
+		val, err := fetch(ctx)
+		if err != nil || c.ttl <= 0 {
+			return val, err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.generation != generation {
+			return val, nil
+		}
+		now := c.now()
+		if len(c.entries) >= maxSearchCacheEntries {
+			for k, e := range c.entries {
+				if !now.Before(e.expires) {
+					delete(c.entries, k)
+				}
+			}
+		}
+		if len(c.entries) < maxSearchCacheEntries {
+			c.entries[key] = searchCacheEntry{val: val, expires: now.Add(c.ttl)}
+		}
+		return val, nil
+	})
+	return val, err
+}
+
+// invalidate 検索結果が変わる書き込みの後に呼ぶ
+func (c *searchCache) invalidate() {
+	c.mu.Lock()
+	c.generation++
+	if len(c.entries) > 0 {
+		c.entries = map[string]searchCacheEntry{}
+	}
+	c.mu.Unlock()
+}
+
+func rangeKey(r *Range) string {
+	if r == nil {
+		return ""
+	}
+	return fmt.Sprint(r.ID)
+}
+
+// featuresKey 特徴の条件は AND なので、順番と重複を無視する
+func featuresKey(features []string) string {
+	sorted := make([]string, 0, len(features))
+	seen := map[string]bool{}
+	for _, f := range features {
+		if !seen[f] {
+			seen[f] = true
+			sorted = append(sorted, f)
+		}
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// key 結果が同じになる検索条件が同じ文字列になるように正規化する
+func (q *ChairSearchQuery) key() string {
+	return fmt.Sprintf("price=%v&height=%v&width=%v&depth=%v&kind=%q&color=%q&features=%q&page=%v&perPage=%v",
+		rangeKey(q.Price), rangeKey(q.Height), rangeKey(q.Width), rangeKey(q.Depth),
+		q.Kind, q.Color, featuresKey(q.Features), q.Page, q.PerPage)
+}
+
+func (q *EstateSearchQuery) key() string {
+	return fmt.Sprintf("doorHeight=%v&doorWidth=%v&rent=%v&features=%q&page=%v&perPage=%v",
+		rangeKey(q.DoorHeight), rangeKey(q.DoorWidth), rangeKey(q.Rent),
+		featuresKey(q.Features), q.Page, q.PerPage)
+}
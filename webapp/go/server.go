@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// defaultShutdownTimeout 終了の合図を受けてから、処理中のリクエストを待つ時間
+const defaultShutdownTimeout = 10 * time.Second
+
+// defaultWorkerStopTimeout リクエストを待ち終えてから、バックグラウンドの処理が戻るのを待つ時間
+// 人気度の最後の書き込み (popularityFinalFlushTimeout) が収まるようにする
+const defaultWorkerStopTimeout = 10 * time.Second
+
+// listen SERVER_SOCKET が指定されていれば Unix ドメインソケットで、なければ SERVER_PORT の TCP で待ち受ける
+// ソケットでは接続元のアドレスが取れないので、nginx は X-Real-IP か X-Forwarded-For をつけること
+func listen() (net.Listener, error) {
+	path := getEnv("SERVER_SOCKET", "")
+	if path == "" {
+		return net.Listen("tcp", fmt.Sprintf(":%v", getEnv("SERVER_PORT", "1323")))
+	}
+	mode, err := strconv.ParseUint(getEnv("SERVER_SOCKET_MODE", "666"), 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("SERVER_SOCKET_MODE: invalid mode %q", getEnv("SERVER_SOCKET_MODE", ""))
+	}
+	// 前のプロセスが消さずに終わったソケットは消す。ソケット以外のファイルは消さない
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// nginx のユーザーから繋げるようにする
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// backgroundWorkers 終了するときに止めて、動いている処理が終わるのを待つ
+type backgroundWorkers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// done 止めた後、全ての処理が戻ったら閉じる
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newBackgroundWorkers() *backgroundWorkers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backgroundWorkers{ctx: ctx, cancel: cancel, done: make(chan struct{})}
+}
+
+// start run は ctx が終わったら戻ること
+func (w *backgroundWorkers) start(run func(ctx context.Context)) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		run(w.ctx)
+	}()
+}
+
+// stop ctx が終わるまでに戻らなかった処理は止まらずに残るので、stopped で確かめてから DB を閉じること
+func (w *backgroundWorkers) stop(ctx context.Context) error {
+	w.stopOnce.Do(func() {
+		w.cancel()
+		go func() {
+			w.wg.Wait()
+			close(w.done)
+		}()
+	})
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stopped 止めた後、全ての処理が戻っていれば true を返す
+func (w *backgroundWorkers) stopped() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// serve signals を受け取ったら新しい接続を受け付けるのをやめ、処理中のリクエストを timeout まで待つ
+// その後にバックグラウンドの処理を止め、workerTimeout まで戻るのを待つ
+// DB は呼び出し元が workers.stopped を確かめてから閉じる
+func serve(e *echo.Echo, ln net.Listener, workers *backgroundWorkers, signals <-chan os.Signal, timeout, workerTimeout time.Duration) error {
+	// /api/stream は切断されるまで終わらないので、先に閉じて新しいプロセスに繋ぎ直させる
+	e.Server.RegisterOnShutdown(func() { stream.shutdown() })
+	e.Listener = ln
+	errs := make(chan error, 1)
+	go func() {
+		errs <- e.Start("")
+	}()
+
+	select {
+	case err := <-errs:
+		stopWorkers(e, workers, workerTimeout)
+		return err
+	case sig := <-signals:
+		e.Logger.Infof("received %v, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		e.Logger.Errorf("graceful shutdown failed : %v", err)
+		e.Close()
+	}
+	// リクエストを待つのに期限を使い切っても、バックグラウンドの処理には改めて期限を与える
+	stopWorkers(e, workers, workerTimeout)
+	if err := <-errs; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func stopWorkers(e *echo.Echo, workers *backgroundWorkers, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := workers.stop(ctx); err != nil {
+		e.Logger.Errorf("background workers did not stop : %v", err)
+	}
+}
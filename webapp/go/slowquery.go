@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultSlowQueryThreshold   = 100 * time.Millisecond
+	defaultSlowQueryExplainRate = 0.1
+	defaultSlowQueryTop         = 20
+	// maxSlowQueryDigests SQL の種類がこれを超えたら、合計時間の最も短いものから捨てる
+	maxSlowQueryDigests = 1000
+	// ログに出すパラメータの数と長さ。一括 INSERT や CSV の値でログを埋めないようにする
+	maxSlowQueryParams      = 20
+	maxSlowQueryParamLength = 64
+	slowQueryExplainTimeout = 5 * time.Second
+	slowQueryExplainQueue   = 16
+)
+
+// slowQueries DB への全ての呼び出しの時間を測り、遅いものを記録する。nil なら記録しない
+var slowQueries *slowQueryLog
+
+// SlowQueryDigest 正規化した SQL ごとの遅いクエリの集計
+type SlowQueryDigest struct {
+	Query       string           `json:"query"`
+	Count       int64            `json:"count"`
+	TotalMillis float64          `json:"totalMillis"`
+	AvgMillis   float64          `json:"avgMillis"`
+	MaxMillis   float64          `json:"maxMillis"`
+	Routes      map[string]int64 `json:"routes"`
+	LastParams  []string         `json:"lastParams"`
+	// Explain 最後に取れた EXPLAIN の結果。SELECT だけ取る
+	Explain []map[string]*string `json:"explain,omitempty"`
+}
+
+type SlowQueriesResponse struct {
+	ThresholdMillis float64           `json:"thresholdMillis"`
+	Queries         []SlowQueryDigest `json:"queries"`
+}
+
+type slowQueryLog struct {
+	threshold   time.Duration
+	explainRate float64
+	logger      echo.Logger
+	explains    chan slowQueryExplain
+
+	mu      sync.Mutex
+	digests map[string]*SlowQueryDigest
+}
+
+type slowQueryExplain struct {
+	db     *sql.DB
+	digest string
+	query  string
+	args   []interface{}
+}
+
+// newSlowQueryLog SLOW_QUERY_THRESHOLD・SLOW_QUERY_EXPLAIN_RATE から設定を読む
+// SLOW_QUERY_THRESHOLD が 0 なら nil を返し、時間を測らない
+func newSlowQueryLog(logger echo.Logger) (*slowQueryLog, error) {
+	threshold := defaultSlowQueryThreshold
+	if v := getEnv("SLOW_QUERY_THRESHOLD", ""); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("SLOW_QUERY_THRESHOLD: invalid duration %q", v)
+		}
+		threshold = d
+	}
+	if threshold == 0 {
+		return nil, nil
+	}
+	l := &slowQueryLog{
+		threshold:   threshold,
+		explainRate: getEnvFloat("SLOW_QUERY_EXPLAIN_RATE", defaultSlowQueryExplainRate),
+		logger:      logger,
+		explains:    make(chan slowQueryExplain, slowQueryExplainQueue),
+		digests:     map[string]*SlowQueryDigest{},
+	}
+	go l.runExplain()
+	return l, nil
+}
+
+type queryRouteKey struct{}
+
+// withQueryRoute ログに出すルート名を ctx に載せる。バックグラウンドの処理は処理の名前を載せる
+func withQueryRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, queryRouteKey{}, route)
+}
+
+func queryRoute(ctx context.Context) string {
+	if route, ok := ctx.Value(queryRouteKey{}).(string); ok {
+		return route
+	}
+	return "-"
+}
+
+// queryRouteMiddleware ルーティングの後に動くので c.Path() はルートの定義になる
+func queryRouteMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		c.SetRequest(req.WithContext(withQueryRoute(req.Context(), req.Method+" "+c.Path())))
+		return next(c)
+	}
+}
+
+type explainingKey struct{}
+
+var (
+	sqlStringLiteral = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'`)
+	sqlNumber        = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	sqlSpace         = regexp.MustCompile(`\s+`)
+	sqlInList        = regexp.MustCompile(`(?i)\bIN \(\?(?:, ?\?)*\)`)
+	sqlValuesList    = regexp.MustCompile(`(?i)\bVALUES ?\(\?(?:, ?\?)*\)(?:, ?\(\?(?:, ?\?)*\))*`)
+)
+
+// normalizeSQL リテラルを ? に置き換え、IN や VALUES の並びを畳んで、値の違うクエリを同じものとして数える
+func normalizeSQL(query string) string {
+	s := sqlStringLiteral.ReplaceAllString(query, "?")
+	s = sqlNumber.ReplaceAllString(s, "?")
+	s = strings.TrimSpace(sqlSpace.ReplaceAllString(s, " "))
+	s = sqlInList.ReplaceAllString(s, "IN (...)")
+	return sqlValuesList.ReplaceAllString(s, "VALUES (...)")
+}
+
+func formatQueryParams(args []driver.NamedValue) []string {
+	params := make([]string, 0, len(args))
+	for i, arg := range args {
+		if i == maxSlowQueryParams {
+			params = append(params, fmt.Sprintf("... (%v more)", len(args)-i))
+			break
+		}
+		var s string
+		switch v := arg.Value.(type) {
+		case nil:
+			s = "NULL"
+		case []byte:
+			s = strconv.Quote(string(v))
+		case string:
+			s = strconv.Quote(v)
+		case time.Time:
+			s = v.Format(time.RFC3339Nano)
+		default:
+			s = fmt.Sprint(v)
+		}
+		if utf8.RuneCountInString(s) > maxSlowQueryParamLength {
+			s = string([]rune(s)[:maxSlowQueryParamLength]) + "..."
+		}
+		params = append(params, s)
+	}
+	return params
+}
+
+// record 閾値を超えたクエリをログに出して集計する。db は EXPLAIN を投げる先
+func (l *slowQueryLog) record(ctx context.Context, db *sql.DB, query string, args []driver.NamedValue, elapsed time.Duration) {
+	if l == nil || elapsed < l.threshold || ctx.Value(explainingKey{}) != nil {
+		return
+	}
+	digest := normalizeSQL(query)
+	params := formatQueryParams(args)
+	route := queryRoute(ctx)
+	millis := float64(elapsed) / float64(time.Millisecond)
+	l.logger.Warnf("slow query %.1fms %v : %v %v", millis, route, digest, params)
+
+	l.mu.Lock()
+	d, ok := l.digests[digest]
+	if !ok {
+		if len(l.digests) >= maxSlowQueryDigests {
+			l.evict()
+		}
+		d = &SlowQueryDigest{Query: digest, Routes: map[string]int64{}}
+		l.digests[digest] = d
+	}
+	d.Count++
+	d.TotalMillis += millis
+	if millis > d.MaxMillis {
+		d.MaxMillis = millis
+	}
+	d.Routes[route]++
+	d.LastParams = params
+	explain := d.Explain == nil || rand.Float64() < l.explainRate
+	l.mu.Unlock()
+
+	if !explain || db == nil || !strings.HasPrefix(strings.ToUpper(digest), "SELECT") {
+		return
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	// EXPLAIN は別の goroutine で投げる。詰まっていたら今回は取らない
+	select {
+	case l.explains <- slowQueryExplain{db: db, digest: digest, query: query, args: values}:
+	default:
+	}
+}
+
+// evict ロックを取った状態で呼ぶ
+func (l *slowQueryLog) evict() {
+	var min *SlowQueryDigest
+	for _, d := range l.digests {
+		if min == nil || d.TotalMillis < min.TotalMillis {
+			min = d
+		}
+	}
+	delete(l.digests, min.Query)
+}
+
+func (l *slowQueryLog) runExplain() {
+	for e := range l.explains {
+		plan, err := explainQuery(e.db, e.query, e.args)
+		if err != nil {
+			l.logger.Infof("failed to explain slow query : %v", err)
+			continue
+		}
+		l.mu.Lock()
+		if d, ok := l.digests[e.digest]; ok {
+			d.Explain = plan
+		}
+		l.mu.Unlock()
+	}
+}
+
+func explainQuery(db *sql.DB, query string, args []interface{}) ([]map[string]*string, error) {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), explainingKey{}, true), slowQueryExplainTimeout)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "EXPLAIN "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	plan := []map[string]*string{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := map[string]*string{}
+		for i, column := range columns {
+			if values[i].Valid {
+				v := values[i].String
+				row[column] = &v
+			} else {
+				row[column] = nil
+			}
+		}
+		plan = append(plan, row)
+	}
+	return plan, rows.Err()
+}
+
+// top 合計時間の長い順に limit 件を返す
+func (l *slowQueryLog) top(limit int) []SlowQueryDigest {
+	digests := []SlowQueryDigest{}
+	if l == nil {
+		return digests
+	}
+	l.mu.Lock()
+	for _, d := range l.digests {
+		digest := *d
+		digest.AvgMillis = d.TotalMillis / float64(d.Count)
+		digest.Routes = make(map[string]int64, len(d.Routes))
+		for route, n := range d.Routes {
+			digest.Routes[route] = n
+		}
+		digests = append(digests, digest)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(digests, func(i, j int) bool { return digests[i].TotalMillis > digests[j].TotalMillis })
+	if len(digests) > limit {
+		digests = digests[:limit]
+	}
+	return digests
+}
+
+func (l *slowQueryLog) reset() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.digests = map[string]*SlowQueryDigest{}
+	l.mu.Unlock()
+}
+
+// timedConnector ドライバの接続を包み、全ての SQL の実行時間を slowQueries に記録する
+type timedConnector struct {
+	driver.Connector
+	// db EXPLAIN を投げる先。sql.OpenDB の後に設定する
+	db *sql.DB
+}
+
+func (c *timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{Conn: conn, connector: c}, nil
+}
+
+type timedConn struct {
+	driver.Conn
+	connector *timedConnector
+}
+
+func (c *timedConn) record(ctx context.Context, query string, args []driver.NamedValue, start time.Time) {
+	slowQueries.record(ctx, c.connector.db, query, args, time.Since(start))
+}
+
+func (c *timedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &timedStmt{Stmt: stmt, conn: c, query: query}, nil
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+// ExecContext ドライバが driver.ErrSkip を返したら database/sql が prepare して timedStmt で実行し直すので、ここでは記録しない
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.record(ctx, query, args, start)
+	}
+	return result, err
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err == driver.ErrSkip {
+		return nil, err
+	} else if err != nil {
+		c.record(ctx, query, args, start)
+		return nil, err
+	}
+	return &timedRows{Rows: rows, done: func() { c.record(ctx, query, args, start) }}, nil
+}
+
+func (c *timedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *timedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid 包んだ接続が壊れていれば、database/sql にプールへ戻させない
+func (c *timedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *timedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type timedStmt struct {
+	driver.Stmt
+	conn  *timedConn
+	query string
+}
+
+func (s *timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	defer s.conn.record(ctx, s.query, args, start)
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return e.ExecContext(ctx, args)
+	}
+	return s.Stmt.Exec(driverValues(args))
+}
+
+func (s *timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(driverValues(args))
+	}
+	if err != nil {
+		s.conn.record(ctx, s.query, args, start)
+		return nil, err
+	}
+	return &timedRows{Rows: rows, done: func() { s.conn.record(ctx, s.query, args, start) }}, nil
+}
+
+func driverValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+// timedRows 結果を読み終えるまでをクエリの時間に含める
+type timedRows struct {
+	driver.Rows
+	done func()
+}
+
+func (r *timedRows) Close() error {
+	err := r.Rows.Close()
+	r.done()
+	return err
+}
+
+func getSlowQueries(c echo.Context) error {
+	limit := defaultSlowQueryTop
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return errInvalidParameter("limit", "limit must be a positive integer")
+		}
+		limit = n
+	}
+	res := SlowQueriesResponse{Queries: slowQueries.top(limit)}
+	if slowQueries != nil {
+		res.ThresholdMillis = float64(slowQueries.threshold) / float64(time.Millisecond)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func deleteSlowQueries(c echo.Context) error {
+	slowQueries.reset()
+	return c.NoContent(http.StatusNoContent)
+}
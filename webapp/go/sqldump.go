@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode"
+)
+
+// readSQLInserts initial-data が生成する INSERT INTO t (cols) VALUES (...), (...); の並びを読み、
+// columns の順に並べた値を返す。columns の doorHeight のような名前は door_height として探す
+func readSQLInserts(r io.Reader, columns []string) ([][]string, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlDumpParser{src: src}
+	records := [][]string{}
+	for {
+		i := bytes.Index(p.src[p.pos:], []byte("INSERT INTO"))
+		if i < 0 {
+			return records, nil
+		}
+		p.pos += i + len("INSERT INTO")
+
+		names, err := p.columnNames()
+		if err != nil {
+			return nil, err
+		}
+		index := make([]int, len(columns))
+		for i, column := range columns {
+			index[i] = -1
+			for j, name := range names {
+				if name == snakeCase(column) {
+					index[i] = j
+				}
+			}
+			if index[i] < 0 {
+				return nil, fmt.Errorf("column %v not found at offset %v", column, p.pos)
+			}
+		}
+
+		if err := p.expectKeyword("VALUES"); err != nil {
+			return nil, err
+		}
+		for {
+			values, err := p.tuple()
+			if err != nil {
+				return nil, err
+			}
+			if len(values) != len(names) {
+				return nil, fmt.Errorf("got %v values for %v columns at offset %v", len(values), len(names), p.pos)
+			}
+			record := make([]string, len(columns))
+			for i, j := range index {
+				record[i] = values[j]
+			}
+			records = append(records, record)
+
+			p.skipSpace()
+			if p.consume(',') {
+				continue
+			}
+			if p.consume(';') {
+				break
+			}
+			return nil, fmt.Errorf("unexpected character at offset %v", p.pos)
+		}
+	}
+}
+
+func snakeCase(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsUpper(r) {
+			b.WriteByte('_')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type sqlDumpParser struct {
+	src []byte
+	pos int
+}
+
+func (p *sqlDumpParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *sqlDumpParser) consume(c byte) bool {
+	if p.pos < len(p.src) && p.src[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlDumpParser) expect(c byte) error {
+	p.skipSpace()
+	if !p.consume(c) {
+		return fmt.Errorf("expected %q at offset %v", c, p.pos)
+	}
+	return nil
+}
+
+func (p *sqlDumpParser) expectKeyword(keyword string) error {
+	p.skipSpace()
+	if !bytes.HasPrefix(p.src[p.pos:], []byte(keyword)) {
+		return fmt.Errorf("expected %v at offset %v", keyword, p.pos)
+	}
+	p.pos += len(keyword)
+	return nil
+}
+
+// columnNames テーブル名を読み飛ばし、括弧内の列名を返す
+func (p *sqlDumpParser) columnNames() ([]string, error) {
+	i := bytes.IndexByte(p.src[p.pos:], '(')
+	if i < 0 {
+		return nil, fmt.Errorf("column list not found at offset %v", p.pos)
+	}
+	p.pos += i + 1
+	j := bytes.IndexByte(p.src[p.pos:], ')')
+	if j < 0 {
+		return nil, fmt.Errorf("unterminated column list at offset %v", p.pos)
+	}
+	names := []string{}
+	for _, name := range strings.Split(string(p.src[p.pos:p.pos+j]), ",") {
+		names = append(names, strings.Trim(strings.TrimSpace(name), "`"))
+	}
+	p.pos += j + 1
+	return names, nil
+}
+
+func (p *sqlDumpParser) tuple() ([]string, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for {
+		p.skipSpace()
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		p.skipSpace()
+		if p.consume(',') {
+			continue
+		}
+		if p.consume(')') {
+			return values, nil
+		}
+		return nil, fmt.Errorf("unexpected character at offset %v", p.pos)
+	}
+}
+
+// value 引用符で囲まれた文字列か、数値などの裸の値を読む
+func (p *sqlDumpParser) value() (string, error) {
+	if !p.consume('\'') {
+		start := p.pos
+		for p.pos < len(p.src) && p.src[p.pos] != ',' && p.src[p.pos] != ')' && !unicode.IsSpace(rune(p.src[p.pos])) {
+			p.pos++
+		}
+		return string(p.src[start:p.pos]), nil
+	}
+
+	var b bytes.Buffer
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		p.pos++
+		switch {
+		case c == '\\' && p.pos < len(p.src):
+			b.WriteString(sqlUnescape(p.src[p.pos]))
+			p.pos++
+		case c == '\'' && p.consume('\''):
+			b.WriteByte('\'')
+		case c == '\'':
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated string at offset %v", p.pos)
+}
+
+// sqlUnescape MySQL の文字列リテラルで \ の次の文字 c が表す文字列を返す
+// \% と \_ は LIKE のために \ を残す。それ以外の知らない文字は \ を取り除く
+func sqlUnescape(c byte) string {
+	switch c {
+	case '0':
+		return "\x00"
+	case 'b':
+		return "\b"
+	case 'n':
+		return "\n"
+	case 'r':
+		return "\r"
+	case 't':
+		return "\t"
+	case 'Z':
+		return "\x1a"
+	case '%', '_':
+		return "\\" + string(c)
+	default:
+		// UTF-8 の途中のバイトでもそのまま残す
+		return string([]byte{c})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// stmtCache 決まった SQL を DB ごとに一度だけ prepare して使い回す
+// 検索のように条件で SQL が変わるクエリには使わないこと。SQL の種類だけ statement が残る
+// disabled なら prepare せず、毎回 DB に直接投げる (interpolateParams と比べるときに使う)
+type stmtCache struct {
+	db       *sqlx.DB
+	disabled bool
+
+	mu  sync.RWMutex
+	set *stmtSet
+	// closing reset で置き換えた statement を閉じ終えていない数。close はこれを待ってから返る
+	closing sync.WaitGroup
+}
+
+// stmtSet reset までに prepare した statement。reset で置き換えた後も、使っている間は閉じない
+type stmtSet struct {
+	stmts map[string]*sqlx.Stmt
+	// inUse stmt で取り出してから release するまでの数
+	inUse sync.WaitGroup
+}
+
+func newStmtCache(db *sqlx.DB, disabled bool) *stmtCache {
+	return &stmtCache{
+		db:       db,
+		disabled: disabled,
+		set:      &stmtSet{stmts: map[string]*sqlx.Stmt{}},
+	}
+}
+
+// stmt 使い終わったら返した release を呼ぶこと
+func (c *stmtCache) stmt(ctx context.Context, query string) (*sqlx.Stmt, func(), error) {
+	c.mu.RLock()
+	set := c.set
+	stmt, ok := set.stmts[query]
+	if ok {
+		// reset はロックを取ってから置き換えるので、Add は置き換えた後の Wait より先に起きる
+		set.inUse.Add(1)
+	}
+	c.mu.RUnlock()
+	if ok {
+		return stmt, set.inUse.Done, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	set = c.set
+	if stmt, ok := set.stmts[query]; ok {
+		set.inUse.Add(1)
+		return stmt, set.inUse.Done, nil
+	}
+	stmt, err := c.db.PreparexContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	set.stmts[query] = stmt
+	set.inUse.Add(1)
+	return stmt, set.inUse.Done, nil
+}
+
+func (c *stmtCache) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	if c.disabled {
+		return c.db.GetContext(ctx, dest, query, args...)
+	}
+	stmt, release, err := c.stmt(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return stmt.GetContext(ctx, dest, args...)
+}
+
+func (c *stmtCache) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	if c.disabled {
+		return c.db.SelectContext(ctx, dest, query, args...)
+	}
+	stmt, release, err := c.stmt(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return stmt.SelectContext(ctx, dest, args...)
+}
+
+// reset 空の statement の集まりに置き換える。スキーマを作り直した後に呼ぶ
+// 置き換える前の statement は、使っているクエリが全て終わってから閉じる
+func (c *stmtCache) reset() {
+	c.mu.Lock()
+	old := c.set
+	c.set = &stmtSet{stmts: map[string]*sqlx.Stmt{}}
+	c.mu.Unlock()
+	c.closing.Add(1)
+	go func() {
+		defer c.closing.Done()
+		old.inUse.Wait()
+		for _, stmt := range old.stmts {
+			stmt.Close()
+		}
+	}()
+}
+
+// close 全ての statement を閉じ終わるまで待つ。DB を閉じる前に呼ぶ
+func (c *stmtCache) close() {
+	c.reset()
+	c.closing.Wait()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// ハンドラはデータの読み書きを全てこのストア経由で行う
+// 見つからない場合は database/sql と同じく sql.ErrNoRows を返す
+// ctx にはリクエストの context を渡す。期限切れや切断で ctx が終わるとクエリを打ち切る
+var chairStore ChairStore
+var estateStore EstateStore
+var webhookStore WebhookStore
+var storeBackend StoreBackend
+
+// ChairSearchQuery searchChairs の検索条件。nil や空文字の条件は使わない
+type ChairSearchQuery struct {
+	Price    *Range
+	Height   *Range
+	Width    *Range
+	Depth    *Range
+	Kind     string
+	Color    string
+	Features []string
+	Page     int
+	PerPage  int
+}
+
+func (q *ChairSearchQuery) empty() bool {
+	return q.Price == nil && q.Height == nil && q.Width == nil && q.Depth == nil &&
+		q.Kind == "" && q.Color == "" && len(q.Features) == 0
+}
+
+// EstateSearchQuery searchEstates の検索条件
+type EstateSearchQuery struct {
+	DoorHeight *Range
+	DoorWidth  *Range
+	Rent       *Range
+	Features   []string
+	Page       int
+	PerPage    int
+}
+
+func (q *EstateSearchQuery) empty() bool {
+	return q.DoorHeight == nil && q.DoorWidth == nil && q.Rent == nil && len(q.Features) == 0
+}
+
+type ChairStore interface {
+	GetChair(ctx context.Context, id int64) (*Chair, error)
+	// SearchChairs 在庫のあるイスを popularity の降順で返す
+	SearchChairs(ctx context.Context, q ChairSearchQuery) (int64, []Chair, error)
+	LowPricedChairs(ctx context.Context, limit int) ([]Chair, error)
+	// RecommendedChairs 幅 doorWidth、高さ doorHeight のドアを通る在庫のあるイスを返す
+	RecommendedChairs(ctx context.Context, doorWidth, doorHeight int64, limit int) ([]Chair, error)
+	ExistingChairIDs(ctx context.Context, ids []int64) ([]int64, error)
+	InsertChairs(ctx context.Context, chairs []Chair) error
+	// UpdateChair fn で書き換えた内容で更新する。fn がエラーを返した場合はそのまま返す
+	UpdateChair(ctx context.Context, id int64, fn func(*Chair) error) (*Chair, error)
+	DeleteChair(ctx context.Context, id int64) error
+	// BuyChair 在庫を1つ減らし、購入者の email を履歴に残す。残りの在庫数を返す
+	BuyChair(ctx context.Context, id int64, email string) (int64, error)
+	// ReserveChair 在庫を1つ減らして確保する。残りの在庫数と、ストアに記録した確保の期限を返す
+	ReserveChair(ctx context.Context, id int64, token, email string, ttl time.Duration) (int64, time.Time, error)
+	ConsumeChairReservation(ctx context.Context, id int64, token, email string) error
+	// ReleaseExpiredReservations 期限切れの確保を消して在庫を戻す。戻したイスの ID と、戻した後の在庫数を返す
+	ReleaseExpiredReservations(ctx context.Context) (map[int64]int64, error)
+	// EachChair 全てのイスを id 順に fn に渡す
+	EachChair(ctx context.Context, fn func(Chair) error) error
+	// AddChairActivity 次の再計算まで閲覧数・購入数を積み上げる
+	AddChairActivity(ctx context.Context, activity map[int64]ChairActivity) error
+	// RecomputeChairPopularity 前回から MinInterval が経っていなければ何もせず false を返す
+	RecomputeChairPopularity(ctx context.Context, conf PopularityConfig) (bool, error)
+	// ChairHistory 価格・在庫の変更履歴を古い順に返す
+	ChairHistory(ctx context.Context, id int64) ([]ChairHistory, error)
+}
+
+type EstateStore interface {
+	GetEstate(ctx context.Context, id int64) (*Estate, error)
+	// SearchEstates 物件を popularity の降順で返す
+	SearchEstates(ctx context.Context, q EstateSearchQuery) (int64, []Estate, error)
+	LowPricedEstates(ctx context.Context, limit int) ([]Estate, error)
+	// RecommendedEstates 幅 width、高さ height、奥行き depth のイスが通るドアの物件を返す
+	RecommendedEstates(ctx context.Context, width, height, depth int64, limit int) ([]Estate, error)
+	// EstatesInPolygon 多角形の内側にある物件を popularity の降順で返す
+	EstatesInPolygon(ctx context.Context, coordinates Coordinates) ([]Estate, error)
+	ExistingEstateIDs(ctx context.Context, ids []int64) ([]int64, error)
+	InsertEstates(ctx context.Context, estates []Estate) error
+	UpdateEstate(ctx context.Context, id int64, fn func(*Estate) error) (*Estate, error)
+	DeleteEstate(ctx context.Context, id int64) error
+	EachEstate(ctx context.Context, fn func(Estate) error) error
+	AddEstateActivity(ctx context.Context, activity map[int64]EstateActivity) error
+	RecomputeEstatePopularity(ctx context.Context, conf PopularityConfig) (bool, error)
+	EstateHistory(ctx context.Context, id int64) ([]EstateHistory, error)
+}
+
+// WebhookStore 通知先と送信待ちの配信。配信はイスや物件を更新したトランザクションで書く
+type WebhookStore interface {
+	AddWebhook(ctx context.Context, endpoint WebhookEndpoint) (*WebhookEndpoint, error)
+	Webhooks(ctx context.Context) ([]WebhookEndpoint, error)
+	// DeleteWebhook 送信待ちの配信も消す
+	DeleteWebhook(ctx context.Context, id int64) error
+	// ClaimWebhookDeliveries 送信時刻を過ぎた配信を最大 limit 件返し、lease の間は他から取り出せないようにする
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error)
+	WebhookDelivered(ctx context.Context, delivery WebhookDelivery) error
+	// WebhookFailed retryAfter 後に送り直す。retryAfter が 0 なら再送をあきらめて残しておく
+	WebhookFailed(ctx context.Context, delivery WebhookDelivery, retryAfter time.Duration, reason string) error
+}
+
+// StoreBackend ストアの実装。ISUUMO_STORE で選ぶ
+type StoreBackend interface {
+	ChairStore() ChairStore
+	EstateStore() EstateStore
+	WebhookStore() WebhookStore
+	// Initialize 初期データを入れ直す
+	Initialize(ctx context.Context) error
+	Close() error
+}
+
+func newStoreBackend(name string, logger echo.Logger) (StoreBackend, error) {
+	switch name {
+	case "", "mysql":
+		return newMySQLStoreBackend(NewMySQLConnectionEnv())
+	case "memory":
+		return newMemoryStoreBackend(
+			getEnv("ISUUMO_MEMORY_CHAIR_DATA", defaultMemoryChairData),
+			getEnv("ISUUMO_MEMORY_ESTATE_DATA", defaultMemoryEstateData),
+		)
+	case "catalog":
+		// MySQL に書き込み、読み込みはメモリに載せたカタログから返す
+		source, err := newMySQLStoreBackend(NewMySQLConnectionEnv())
+		if err != nil {
+			return nil, err
+		}
+		b, err := newCatalogStoreBackend(source, logger)
+		if err != nil {
+			source.Close()
+			return nil, err
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown store %q", name)
+	}
+}
+
+func setStoreBackend(backend StoreBackend) {
+	storeBackend = backend
+	chairStore = backend.ChairStore()
+	estateStore = backend.EstateStore()
+	webhookStore = backend.WebhookStore()
+}
+
+// validationErrors UpdateChair などに渡す関数が、入力の誤りを返すときに使う
+type validationErrors []FieldError
+
+func (e validationErrors) Error() string {
+	return fmt.Sprintf("%v", []FieldError(e))
+}
+
+// chairFitsDoor イスのどれか2辺がドアの幅と高さ以下であれば通過できる
+func chairFitsDoor(width, height, depth, doorWidth, doorHeight int64) bool {
+	return (doorWidth >= width && doorHeight >= height) ||
+		(doorWidth >= width && doorHeight >= depth) ||
+		(doorWidth >= height && doorHeight >= width) ||
+		(doorWidth >= height && doorHeight >= depth) ||
+		(doorWidth >= depth && doorHeight >= width) ||
+		(doorWidth >= depth && doorHeight >= height)
+}
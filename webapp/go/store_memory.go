@@ -0,0 +1,1131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// /initialize が MySQL に流すのと同じダミーデータを読む
+// ISUUMO_MEMORY_*_DATA に initial-data の chair_json.txt などの NDJSON を指定してもよい
+const defaultMemoryChairData = "../mysql/db/2_DummyChairData.sql"
+const defaultMemoryEstateData = "../mysql/db/1_DummyEstateData.sql"
+
+// memoryStoreBackend MySQL を使わずに全てのデータをメモリ上に持つ
+type memoryStoreBackend struct {
+	chairPath  string
+	estatePath string
+	chairs     *memoryChairStore
+	estates    *memoryEstateStore
+	webhooks   *memoryWebhookStore
+}
+
+type memoryReservation struct {
+	chairID   int64
+	email     string
+	expiresAt time.Time
+}
+
+type memoryChairStore struct {
+	mu           sync.RWMutex
+	chairs       map[int64]*Chair
+	byPopularity []*Chair
+	byPrice      []*Chair
+	reservations map[string]*memoryReservation
+	activity     map[int64]ChairActivity
+	history      map[int64][]ChairHistory
+	recomputedAt time.Time
+	webhooks     *memoryWebhookStore
+	now          func() time.Time
+}
+
+type memoryEstateStore struct {
+	mu           sync.RWMutex
+	estates      map[int64]*Estate
+	byPopularity []*Estate
+	byRent       []*Estate
+	activity     map[int64]EstateActivity
+	history      map[int64][]EstateHistory
+	recomputedAt time.Time
+	webhooks     *memoryWebhookStore
+	now          func() time.Time
+}
+
+type memoryWebhookDelivery struct {
+	WebhookDelivery
+	lastError string
+	// nextAttemptAt nil なら再送をあきらめている
+	nextAttemptAt *time.Time
+}
+
+type memoryWebhookStore struct {
+	mu             sync.Mutex
+	endpoints      map[int64]*WebhookEndpoint
+	deliveries     map[int64]*memoryWebhookDelivery
+	lastEndpointID int64
+	lastDeliveryID int64
+	now            func() time.Time
+}
+
+// newMemoryStoreBackend パスが空ならデータを持たない状態で始める
+func newMemoryStoreBackend(chairPath, estatePath string) (*memoryStoreBackend, error) {
+	b := &memoryStoreBackend{
+		chairPath:  chairPath,
+		estatePath: estatePath,
+		chairs:     newMemoryChairStore(),
+		estates:    newMemoryEstateStore(),
+		webhooks:   newMemoryWebhookStore(),
+	}
+	b.chairs.webhooks = b.webhooks
+	b.estates.webhooks = b.webhooks
+	if err := b.Initialize(context.Background()); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *memoryStoreBackend) ChairStore() ChairStore {
+	return b.chairs
+}
+
+func (b *memoryStoreBackend) EstateStore() EstateStore {
+	return b.estates
+}
+
+func (b *memoryStoreBackend) WebhookStore() WebhookStore {
+	return b.webhooks
+}
+
+func (b *memoryStoreBackend) Initialize(ctx context.Context) error {
+	chairs := []Chair{}
+	if b.chairPath != "" {
+		var err error
+		if chairs, err = loadChairData(b.chairPath); err != nil {
+			return err
+		}
+	}
+	estates := []Estate{}
+	if b.estatePath != "" {
+		var err error
+		if estates, err = loadEstateData(b.estatePath); err != nil {
+			return err
+		}
+	}
+	b.chairs.reset(chairs)
+	b.estates.reset(estates)
+	b.webhooks.clearDeliveries()
+	return nil
+}
+
+func (b *memoryStoreBackend) Close() error {
+	return nil
+}
+
+func loadChairData(path string) ([]Chair, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows []chairRow
+	var errs []RowError
+	if filepath.Ext(path) == ".sql" {
+		records, err := readSQLInserts(f, chairColumns)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		rows, errs = parseChairCSV(records)
+	} else {
+		rows, errs, _, err = decodeChairNDJSON(f)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%v: row %v: %v %v", path, errs[0].Row, errs[0].Column, errs[0].Reason)
+	}
+
+	chairs := make([]Chair, 0, len(rows))
+	for _, r := range rows {
+		chairs = append(chairs, r.Chair)
+	}
+	return chairs, nil
+}
+
+func loadEstateData(path string) ([]Estate, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows []estateRow
+	var errs []RowError
+	if filepath.Ext(path) == ".sql" {
+		records, err := readSQLInserts(f, estateColumns)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		rows, errs = parseEstateCSV(records)
+	} else {
+		rows, errs, _, err = decodeEstateNDJSON(f)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%v: row %v: %v %v", path, errs[0].Row, errs[0].Column, errs[0].Reason)
+	}
+
+	estates := make([]Estate, 0, len(rows))
+	for _, r := range rows {
+		estates = append(estates, r.Estate)
+	}
+	return estates, nil
+}
+
+func inRange(v int64, r *Range) bool {
+	if r == nil {
+		return true
+	}
+	return (r.Min == -1 || v >= r.Min) && (r.Max == -1 || v < r.Max)
+}
+
+// containsAllFeatures MySQL の features LIKE CONCAT('%', ?, '%') と同じく、want の % と _ はワイルドカードとして扱う
+func containsAllFeatures(features string, want []string) bool {
+	for _, f := range want {
+		if !sqlLike(features, "%"+f+"%") {
+			return false
+		}
+	}
+	return true
+}
+
+// collationEqual MySQL の utf8mb4_general_ci での = と同じく、大文字と小文字を区別せず末尾の空白を無視して比べる
+// general_ci が同じとみなす一部のアクセント付きの文字は区別したままになる
+func collationEqual(a, b string) bool {
+	return strings.Map(unicode.ToUpper, strings.TrimRight(a, " ")) == strings.Map(unicode.ToUpper, strings.TrimRight(b, " "))
+}
+
+// likeToken LIKE のパターンを % (any)、_ (one)、それ以外の1文字に分けたもの
+type likeToken struct {
+	any bool
+	one bool
+	r   rune
+}
+
+// sqlLike MySQL の LIKE と同じく、% は0文字以上、_ は1文字に一致し、\ の次の文字はそのまま比べる
+// 大文字と小文字は区別しない。= と違って末尾の空白は無視しない
+func sqlLike(s, pattern string) bool {
+	text := []rune(strings.Map(unicode.ToUpper, s))
+	tokens := []likeToken{}
+	runes := []rune(strings.Map(unicode.ToUpper, pattern))
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == '%':
+			tokens = append(tokens, likeToken{any: true})
+		case r == '_':
+			tokens = append(tokens, likeToken{one: true})
+		case r == '\\' && i+1 < len(runes):
+			i++
+			tokens = append(tokens, likeToken{r: runes[i]})
+		default:
+			tokens = append(tokens, likeToken{r: r})
+		}
+	}
+
+	// % を含むパターンでも長さの積で済むよう、最後の % の位置から1文字ずつずらして試し直す
+	i, j, star, mark := 0, 0, -1, 0
+	for i < len(text) {
+		switch {
+		case j < len(tokens) && !tokens[j].any && (tokens[j].one || tokens[j].r == text[i]):
+			i++
+			j++
+		case j < len(tokens) && tokens[j].any:
+			star, mark = j, i
+			j++
+		case star >= 0:
+			mark++
+			i, j = mark, star+1
+		default:
+			return false
+		}
+	}
+	for j < len(tokens) && tokens[j].any {
+		j++
+	}
+	return j == len(tokens)
+}
+
+func pageBounds(total, page, perPage int) (int, int, error) {
+	if page < 0 || perPage < 0 {
+		return 0, 0, fmt.Errorf("invalid page %v, perPage %v", page, perPage)
+	}
+	start := page * perPage
+	if start > total {
+		start = total
+	}
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+	return start, end, nil
+}
+
+func newMemoryChairStore() *memoryChairStore {
+	s := &memoryChairStore{now: time.Now}
+	s.reset(nil)
+	return s
+}
+
+func (s *memoryChairStore) reset(chairs []Chair) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chairs = make(map[int64]*Chair, len(chairs))
+	for i := range chairs {
+		chair := chairs[i]
+		s.chairs[chair.ID] = &chair
+	}
+	s.reservations = map[string]*memoryReservation{}
+	s.activity = map[int64]ChairActivity{}
+	s.history = map[int64][]ChairHistory{}
+	s.recomputedAt = s.now()
+	s.reindex()
+}
+
+// record ロックを取った状態で呼ぶ
+func (s *memoryChairStore) record(chair *Chair, event, email string) {
+	s.history[chair.ID] = append(s.history[chair.ID], ChairHistory{Event: event, Price: chair.Price, Stock: chair.Stock, Email: email, CreatedAt: s.now()})
+}
+
+// reindex 並び順が変わる更新の後に、ロックを取った状態で呼ぶ
+func (s *memoryChairStore) reindex() {
+	s.byPopularity = make([]*Chair, 0, len(s.chairs))
+	for _, chair := range s.chairs {
+		s.byPopularity = append(s.byPopularity, chair)
+	}
+	s.byPrice = append([]*Chair{}, s.byPopularity...)
+	sort.Slice(s.byPopularity, func(i, j int) bool {
+		a, b := s.byPopularity[i], s.byPopularity[j]
+		if a.Popularity != b.Popularity {
+			return a.Popularity > b.Popularity
+		}
+		return a.ID < b.ID
+	})
+	sort.Slice(s.byPrice, func(i, j int) bool {
+		a, b := s.byPrice[i], s.byPrice[j]
+		if a.Price != b.Price {
+			return a.Price < b.Price
+		}
+		return a.ID < b.ID
+	})
+}
+
+// replace ids のイスを chairs の内容に置き換える。chairs にない ID のイスは消す
+// 並び順に関わる値が変わったときだけ索引を作り直す
+func (s *memoryChairStore) replace(ids []int64, chairs []Chair) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := make(map[int64]bool, len(chairs))
+	reindex := false
+	for i := range chairs {
+		chair := chairs[i]
+		found[chair.ID] = true
+		current, ok := s.chairs[chair.ID]
+		if !ok {
+			s.chairs[chair.ID] = &chair
+			reindex = true
+			continue
+		}
+		if current.Popularity != chair.Popularity || current.Price != chair.Price {
+			reindex = true
+		}
+		// 索引は同じポインタを持っているので、中身だけを書き換える
+		*current = chair
+	}
+	for _, id := range ids {
+		if _, ok := s.chairs[id]; ok && !found[id] {
+			delete(s.chairs, id)
+			reindex = true
+		}
+	}
+	if reindex {
+		s.reindex()
+	}
+}
+
+func (q *ChairSearchQuery) match(chair *Chair) bool {
+	return chair.Stock > 0 &&
+		inRange(chair.Price, q.Price) &&
+		inRange(chair.Height, q.Height) &&
+		inRange(chair.Width, q.Width) &&
+		inRange(chair.Depth, q.Depth) &&
+		(q.Kind == "" || collationEqual(chair.Kind, q.Kind)) &&
+		(q.Color == "" || collationEqual(chair.Color, q.Color)) &&
+		containsAllFeatures(chair.Features, q.Features)
+}
+
+func (s *memoryChairStore) GetChair(ctx context.Context, id int64) (*Chair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	chair, ok := s.chairs[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	c := *chair
+	return &c, nil
+}
+
+func (s *memoryChairStore) SearchChairs(ctx context.Context, q ChairSearchQuery) (int64, []Chair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	matched := []*Chair{}
+	for _, chair := range s.byPopularity {
+		if q.match(chair) {
+			matched = append(matched, chair)
+		}
+	}
+	start, end, err := pageBounds(len(matched), q.Page, q.PerPage)
+	if err != nil {
+		return 0, nil, err
+	}
+	chairs := make([]Chair, 0, end-start)
+	for _, chair := range matched[start:end] {
+		chairs = append(chairs, *chair)
+	}
+	return int64(len(matched)), chairs, nil
+}
+
+func (s *memoryChairStore) LowPricedChairs(ctx context.Context, limit int) ([]Chair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	chairs := make([]Chair, 0, limit)
+	for _, chair := range s.byPrice {
+		if len(chairs) >= limit {
+			break
+		}
+		if chair.Stock > 0 {
+			chairs = append(chairs, *chair)
+		}
+	}
+	return chairs, nil
+}
+
+func (s *memoryChairStore) RecommendedChairs(ctx context.Context, doorWidth, doorHeight int64, limit int) ([]Chair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	chairs := make([]Chair, 0, limit)
+	for _, chair := range s.byPopularity {
+		if len(chairs) >= limit {
+			break
+		}
+		if chair.Stock > 0 && chairFitsDoor(chair.Width, chair.Height, chair.Depth, doorWidth, doorHeight) {
+			chairs = append(chairs, *chair)
+		}
+	}
+	return chairs, nil
+}
+
+// loadChairs カタログのテストで、メモリのストアを MySQL の代わりに使う
+func (s *memoryChairStore) loadChairs(ctx context.Context, ids []int64) ([]Chair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	chairs := []Chair{}
+	if ids == nil {
+		for _, chair := range s.chairs {
+			chairs = append(chairs, *chair)
+		}
+		return chairs, nil
+	}
+	for _, id := range ids {
+		if chair, ok := s.chairs[id]; ok {
+			chairs = append(chairs, *chair)
+		}
+	}
+	return chairs, nil
+}
+
+func (s *memoryChairStore) ExistingChairIDs(ctx context.Context, ids []int64) ([]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	existing := []int64{}
+	for _, id := range ids {
+		if _, ok := s.chairs[id]; ok {
+			existing = append(existing, id)
+		}
+	}
+	return existing, nil
+}
+
+func (s *memoryChairStore) InsertChairs(ctx context.Context, chairs []Chair) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[int64]bool, len(chairs))
+	for _, chair := range chairs {
+		if _, ok := s.chairs[chair.ID]; ok || seen[chair.ID] {
+			return fmt.Errorf("duplicate entry %v for chair", chair.ID)
+		}
+		seen[chair.ID] = true
+	}
+	for i := range chairs {
+		chair := chairs[i]
+		s.chairs[chair.ID] = &chair
+		s.record(&chair, historyEventCreate, "")
+	}
+	s.reindex()
+	return nil
+}
+
+func (s *memoryChairStore) UpdateChair(ctx context.Context, id int64, fn func(*Chair) error) (*Chair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.chairs[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	chair := *current
+	if err := fn(&chair); err != nil {
+		return nil, err
+	}
+	chair.ID = id
+	// 在庫を 0 にした編集も、購入で売り切れたときと同じく通知する。積めなかったら編集も反映しない
+	if current.Stock > 0 && chair.Stock == 0 && !s.reserved(id, "") {
+		if err := s.webhooks.enqueue(WebhookPayload{Event: webhookEventChairSoldOut, CreatedAt: s.now(), Chair: &chair}); err != nil {
+			return nil, err
+		}
+	}
+	if chair.Price != current.Price || chair.Stock != current.Stock {
+		s.record(&chair, historyEventUpdate, "")
+	}
+	*current = chair
+	s.reindex()
+	return &chair, nil
+}
+
+func (s *memoryChairStore) DeleteChair(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chair, ok := s.chairs[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	s.record(chair, historyEventDelete, "")
+	delete(s.chairs, id)
+	for token, r := range s.reservations {
+		if r.chairID == id {
+			delete(s.reservations, token)
+		}
+	}
+	s.reindex()
+	return nil
+}
+
+// reserved except 以外に、イスを確保したままの分が残っていれば true を返す。ロックを取った状態で呼ぶ
+// 確保中の分が残っていれば、期限切れで在庫に戻るかもしれないので売り切れにしない
+func (s *memoryChairStore) reserved(id int64, except string) bool {
+	for token, r := range s.reservations {
+		if token != except && r.chairID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryChairStore) BuyChair(ctx context.Context, id int64, email string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chair, ok := s.chairs[id]
+	if !ok || chair.Stock <= 0 {
+		return 0, sql.ErrNoRows
+	}
+	// 通知を積めなかったら購入も反映しない
+	if chair.Stock == 1 && !s.reserved(id, "") {
+		soldOut := *chair
+		soldOut.Stock = 0
+		if err := s.webhooks.enqueue(WebhookPayload{Event: webhookEventChairSoldOut, CreatedAt: s.now(), Chair: &soldOut}); err != nil {
+			return 0, err
+		}
+	}
+	chair.Stock--
+	s.record(chair, historyEventPurchase, email)
+	return chair.Stock, nil
+}
+
+func (s *memoryChairStore) ReserveChair(ctx context.Context, id int64, token, email string, ttl time.Duration) (int64, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chair, ok := s.chairs[id]
+	if !ok || chair.Stock <= 0 {
+		return 0, time.Time{}, sql.ErrNoRows
+	}
+	if _, ok := s.reservations[token]; ok {
+		return 0, time.Time{}, fmt.Errorf("duplicate reservation token %v", token)
+	}
+	chair.Stock--
+	expiresAt := s.now().Add(ttl)
+	s.reservations[token] = &memoryReservation{chairID: id, email: email, expiresAt: expiresAt}
+	s.record(chair, historyEventReserve, email)
+	return chair.Stock, expiresAt, nil
+}
+
+func (s *memoryChairStore) ConsumeChairReservation(ctx context.Context, id int64, token, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.reservations[token]
+	if !ok || r.chairID != id || !s.now().Before(r.expiresAt) {
+		return sql.ErrNoRows
+	}
+	chair, ok := s.chairs[id]
+	if !ok {
+		delete(s.reservations, token)
+		return nil
+	}
+	// 通知を積めなかったら確保したままにする
+	if chair.Stock == 0 && !s.reserved(id, token) {
+		if err := s.webhooks.enqueue(WebhookPayload{Event: webhookEventChairSoldOut, CreatedAt: s.now(), Chair: chair}); err != nil {
+			return err
+		}
+	}
+	delete(s.reservations, token)
+	s.record(chair, historyEventPurchase, email)
+	return nil
+}
+
+func (s *memoryChairStore) ReleaseExpiredReservations(ctx context.Context) (map[int64]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	stocks := map[int64]int64{}
+	for token, r := range s.reservations {
+		if now.Before(r.expiresAt) {
+			continue
+		}
+		if chair, ok := s.chairs[r.chairID]; ok {
+			chair.Stock++
+			s.record(chair, historyEventRelease, r.email)
+			stocks[chair.ID] = chair.Stock
+		}
+		delete(s.reservations, token)
+	}
+	return stocks, nil
+}
+
+func (s *memoryChairStore) ChairHistory(ctx context.Context, id int64) ([]ChairHistory, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]ChairHistory{}, s.history[id]...), nil
+}
+
+func (s *memoryChairStore) EachChair(ctx context.Context, fn func(Chair) error) error {
+	s.mu.RLock()
+	chairs := make([]Chair, 0, len(s.chairs))
+	for _, chair := range s.chairs {
+		chairs = append(chairs, *chair)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(chairs, func(i, j int) bool { return chairs[i].ID < chairs[j].ID })
+	for _, chair := range chairs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(chair); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryChairStore) AddChairActivity(ctx context.Context, activity map[int64]ChairActivity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, a := range activity {
+		current := s.activity[id]
+		current.Views += a.Views
+		current.Purchases += a.Purchases
+		s.activity[id] = current
+	}
+	return nil
+}
+
+func (s *memoryChairStore) RecomputeChairPopularity(ctx context.Context, conf PopularityConfig) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	elapsed := now.Sub(s.recomputedAt)
+	if elapsed < conf.MinInterval {
+		return false, nil
+	}
+	if decay := conf.decay(elapsed); decay < 1 {
+		for _, chair := range s.chairs {
+			chair.Popularity = int64(math.Floor(float64(chair.Popularity) * decay))
+		}
+	}
+	for id, a := range s.activity {
+		if chair, ok := s.chairs[id]; ok {
+			chair.Popularity += int64(math.Round(float64(a.Views)*conf.ChairViewWeight + float64(a.Purchases)*conf.ChairPurchaseWeight))
+		}
+	}
+	s.activity = map[int64]ChairActivity{}
+	s.recomputedAt = now
+	s.reindex()
+	return true, nil
+}
+
+func newMemoryEstateStore() *memoryEstateStore {
+	s := &memoryEstateStore{now: time.Now}
+	s.reset(nil)
+	return s
+}
+
+func (s *memoryEstateStore) reset(estates []Estate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.estates = make(map[int64]*Estate, len(estates))
+	for i := range estates {
+		estate := estates[i]
+		s.estates[estate.ID] = &estate
+	}
+	s.activity = map[int64]EstateActivity{}
+	s.history = map[int64][]EstateHistory{}
+	s.recomputedAt = s.now()
+	s.reindex()
+}
+
+func (s *memoryEstateStore) record(estate *Estate, event string) {
+	s.history[estate.ID] = append(s.history[estate.ID], EstateHistory{Event: event, Rent: estate.Rent, CreatedAt: s.now()})
+}
+
+func (s *memoryEstateStore) reindex() {
+	s.byPopularity = make([]*Estate, 0, len(s.estates))
+	for _, estate := range s.estates {
+		s.byPopularity = append(s.byPopularity, estate)
+	}
+	s.byRent = append([]*Estate{}, s.byPopularity...)
+	sort.Slice(s.byPopularity, func(i, j int) bool {
+		a, b := s.byPopularity[i], s.byPopularity[j]
+		if a.Popularity != b.Popularity {
+			return a.Popularity > b.Popularity
+		}
+		return a.ID < b.ID
+	})
+	sort.Slice(s.byRent, func(i, j int) bool {
+		a, b := s.byRent[i], s.byRent[j]
+		if a.Rent != b.Rent {
+			return a.Rent < b.Rent
+		}
+		return a.ID < b.ID
+	})
+}
+
+func (s *memoryEstateStore) replace(ids []int64, estates []Estate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := make(map[int64]bool, len(estates))
+	reindex := false
+	for i := range estates {
+		estate := estates[i]
+		found[estate.ID] = true
+		current, ok := s.estates[estate.ID]
+		if !ok {
+			s.estates[estate.ID] = &estate
+			reindex = true
+			continue
+		}
+		if current.Popularity != estate.Popularity || current.Rent != estate.Rent {
+			reindex = true
+		}
+		*current = estate
+	}
+	for _, id := range ids {
+		if _, ok := s.estates[id]; ok && !found[id] {
+			delete(s.estates, id)
+			reindex = true
+		}
+	}
+	if reindex {
+		s.reindex()
+	}
+}
+
+func (q *EstateSearchQuery) match(estate *Estate) bool {
+	return inRange(estate.DoorHeight, q.DoorHeight) &&
+		inRange(estate.DoorWidth, q.DoorWidth) &&
+		inRange(estate.Rent, q.Rent) &&
+		containsAllFeatures(estate.Features, q.Features)
+}
+
+func (s *memoryEstateStore) GetEstate(ctx context.Context, id int64) (*Estate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	estate, ok := s.estates[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	e := *estate
+	return &e, nil
+}
+
+func (s *memoryEstateStore) SearchEstates(ctx context.Context, q EstateSearchQuery) (int64, []Estate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	matched := []*Estate{}
+	for _, estate := range s.byPopularity {
+		if q.match(estate) {
+			matched = append(matched, estate)
+		}
+	}
+	start, end, err := pageBounds(len(matched), q.Page, q.PerPage)
+	if err != nil {
+		return 0, nil, err
+	}
+	estates := make([]Estate, 0, end-start)
+	for _, estate := range matched[start:end] {
+		estates = append(estates, *estate)
+	}
+	return int64(len(matched)), estates, nil
+}
+
+func (s *memoryEstateStore) LowPricedEstates(ctx context.Context, limit int) ([]Estate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	estates := make([]Estate, 0, limit)
+	for _, estate := range s.byRent {
+		if len(estates) >= limit {
+			break
+		}
+		estates = append(estates, *estate)
+	}
+	return estates, nil
+}
+
+func (s *memoryEstateStore) RecommendedEstates(ctx context.Context, width, height, depth int64, limit int) ([]Estate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	estates := make([]Estate, 0, limit)
+	for _, estate := range s.byPopularity {
+		if len(estates) >= limit {
+			break
+		}
+		if chairFitsDoor(width, height, depth, estate.DoorWidth, estate.DoorHeight) {
+			estates = append(estates, *estate)
+		}
+	}
+	return estates, nil
+}
+
+func (s *memoryEstateStore) EstatesInPolygon(ctx context.Context, coordinates Coordinates) ([]Estate, error) {
+	b := coordinates.getBoundingBox()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	estates := []Estate{}
+	for _, estate := range s.byPopularity {
+		if estate.Latitude > b.BottomRightCorner.Latitude || estate.Latitude < b.TopLeftCorner.Latitude ||
+			estate.Longitude > b.BottomRightCorner.Longitude || estate.Longitude < b.TopLeftCorner.Longitude {
+			continue
+		}
+		if coordinates.contains(Coordinate{Latitude: estate.Latitude, Longitude: estate.Longitude}) {
+			estates = append(estates, *estate)
+		}
+	}
+	return estates, nil
+}
+
+func (s *memoryEstateStore) loadEstates(ctx context.Context, ids []int64) ([]Estate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	estates := []Estate{}
+	if ids == nil {
+		for _, estate := range s.estates {
+			estates = append(estates, *estate)
+		}
+		return estates, nil
+	}
+	for _, id := range ids {
+		if estate, ok := s.estates[id]; ok {
+			estates = append(estates, *estate)
+		}
+	}
+	return estates, nil
+}
+
+func (s *memoryEstateStore) ExistingEstateIDs(ctx context.Context, ids []int64) ([]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	existing := []int64{}
+	for _, id := range ids {
+		if _, ok := s.estates[id]; ok {
+			existing = append(existing, id)
+		}
+	}
+	return existing, nil
+}
+
+func (s *memoryEstateStore) InsertEstates(ctx context.Context, estates []Estate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[int64]bool, len(estates))
+	for _, estate := range estates {
+		if _, ok := s.estates[estate.ID]; ok || seen[estate.ID] {
+			return fmt.Errorf("duplicate entry %v for estate", estate.ID)
+		}
+		seen[estate.ID] = true
+	}
+	if len(estates) > 0 {
+		if err := s.webhooks.enqueue(WebhookPayload{Event: webhookEventEstateCreated, CreatedAt: s.now(), Estates: estates}); err != nil {
+			return err
+		}
+	}
+	for i := range estates {
+		estate := estates[i]
+		s.estates[estate.ID] = &estate
+		s.record(&estate, historyEventCreate)
+	}
+	s.reindex()
+	return nil
+}
+
+func (s *memoryEstateStore) UpdateEstate(ctx context.Context, id int64, fn func(*Estate) error) (*Estate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.estates[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	estate := *current
+	if err := fn(&estate); err != nil {
+		return nil, err
+	}
+	estate.ID = id
+	if estate.Rent != current.Rent {
+		s.record(&estate, historyEventUpdate)
+	}
+	*current = estate
+	s.reindex()
+	return &estate, nil
+}
+
+func (s *memoryEstateStore) DeleteEstate(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	estate, ok := s.estates[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	s.record(estate, historyEventDelete)
+	delete(s.estates, id)
+	s.reindex()
+	return nil
+}
+
+func (s *memoryEstateStore) EstateHistory(ctx context.Context, id int64) ([]EstateHistory, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]EstateHistory{}, s.history[id]...), nil
+}
+
+func (s *memoryEstateStore) EachEstate(ctx context.Context, fn func(Estate) error) error {
+	s.mu.RLock()
+	estates := make([]Estate, 0, len(s.estates))
+	for _, estate := range s.estates {
+		estates = append(estates, *estate)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(estates, func(i, j int) bool { return estates[i].ID < estates[j].ID })
+	for _, estate := range estates {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(estate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryEstateStore) AddEstateActivity(ctx context.Context, activity map[int64]EstateActivity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, a := range activity {
+		current := s.activity[id]
+		current.Views += a.Views
+		current.Requests += a.Requests
+		s.activity[id] = current
+	}
+	return nil
+}
+
+func (s *memoryEstateStore) RecomputeEstatePopularity(ctx context.Context, conf PopularityConfig) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	elapsed := now.Sub(s.recomputedAt)
+	if elapsed < conf.MinInterval {
+		return false, nil
+	}
+	if decay := conf.decay(elapsed); decay < 1 {
+		for _, estate := range s.estates {
+			estate.Popularity = int64(math.Floor(float64(estate.Popularity) * decay))
+		}
+	}
+	for id, a := range s.activity {
+		if estate, ok := s.estates[id]; ok {
+			estate.Popularity += int64(math.Round(float64(a.Views)*conf.EstateViewWeight + float64(a.Requests)*conf.EstateRequestWeight))
+		}
+	}
+	s.activity = map[int64]EstateActivity{}
+	s.recomputedAt = now
+	s.reindex()
+	return true, nil
+}
+
+func newMemoryWebhookStore() *memoryWebhookStore {
+	return &memoryWebhookStore{
+		endpoints:  map[int64]*WebhookEndpoint{},
+		deliveries: map[int64]*memoryWebhookDelivery{},
+		now:        time.Now,
+	}
+}
+
+// clearDeliveries 送信待ちの配信だけを消す。通知先の登録は /initialize の後も残す
+// 取り出し中の配信の ID と重ならないよう、lastDeliveryID は戻さない
+func (s *memoryWebhookStore) clearDeliveries() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries = map[int64]*memoryWebhookDelivery{}
+}
+
+// enqueue イスや物件のロックを取った状態で呼ぶ。ストアを介さずに作ったときは何もしない
+func (s *memoryWebhookStore) enqueue(payload WebhookPayload) error {
+	if s == nil {
+		return nil
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, endpoint := range s.endpoints {
+		for _, event := range endpoint.Events {
+			if event != payload.Event {
+				continue
+			}
+			s.lastDeliveryID++
+			s.deliveries[s.lastDeliveryID] = &memoryWebhookDelivery{
+				WebhookDelivery: WebhookDelivery{ID: s.lastDeliveryID, EndpointID: endpoint.ID, Event: payload.Event, Payload: body},
+				nextAttemptAt:   &now,
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryWebhookStore) AddWebhook(ctx context.Context, endpoint WebhookEndpoint) (*WebhookEndpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastEndpointID++
+	endpoint.ID = s.lastEndpointID
+	endpoint.Events = append([]string{}, endpoint.Events...)
+	s.endpoints[endpoint.ID] = &endpoint
+	created := endpoint
+	return &created, nil
+}
+
+func (s *memoryWebhookStore) Webhooks(ctx context.Context) ([]WebhookEndpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	endpoints := make([]WebhookEndpoint, 0, len(s.endpoints))
+	for _, endpoint := range s.endpoints {
+		e := *endpoint
+		e.Events = append([]string{}, endpoint.Events...)
+		endpoints = append(endpoints, e)
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].ID < endpoints[j].ID })
+	return endpoints, nil
+}
+
+func (s *memoryWebhookStore) DeleteWebhook(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.endpoints[id]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(s.endpoints, id)
+	for deliveryID, d := range s.deliveries {
+		if d.EndpointID == id {
+			delete(s.deliveries, deliveryID)
+		}
+	}
+	return nil
+}
+
+func (s *memoryWebhookStore) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	due := []*memoryWebhookDelivery{}
+	for _, d := range s.deliveries {
+		if d.nextAttemptAt != nil && !d.nextAttemptAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].nextAttemptAt.Equal(*due[j].nextAttemptAt) {
+			return due[i].nextAttemptAt.Before(*due[j].nextAttemptAt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	next := now.Add(lease)
+	deliveries := make([]WebhookDelivery, 0, len(due))
+	for _, d := range due {
+		d.nextAttemptAt = &next
+		delivery := d.WebhookDelivery
+		endpoint := s.endpoints[d.EndpointID]
+		delivery.URL = endpoint.URL
+		delivery.Secret = endpoint.Secret
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+func (s *memoryWebhookStore) WebhookDelivered(ctx context.Context, delivery WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.deliveries, delivery.ID)
+	return nil
+}
+
+func (s *memoryWebhookStore) WebhookFailed(ctx context.Context, delivery WebhookDelivery, retryAfter time.Duration, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.deliveries[delivery.ID]
+	if !ok {
+		return nil
+	}
+	d.Attempts++
+	d.lastError = reason
+	if retryAfter <= 0 {
+		d.nextAttemptAt = nil
+		return nil
+	}
+	next := s.now().Add(retryAfter)
+	d.nextAttemptAt = &next
+	return nil
+}
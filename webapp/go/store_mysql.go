@@ -0,0 +1,1026 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 既存 ID の重複確認で一度に IN 句へ渡す件数
+const duplicateCheckChunkSize = 500
+
+type mySQLStoreBackend struct {
+	chairDB  *dbCluster
+	estateDB *dbCluster
+}
+
+type mySQLChairStore struct {
+	db *dbCluster
+}
+
+type mySQLEstateStore struct {
+	db *dbCluster
+}
+
+type mySQLWebhookStore struct {
+	dbs []*dbCluster
+}
+
+// newMySQLStoreBackend イスと物件の接続先が同じなら同じコネクションプールを使う
+func newMySQLStoreBackend(base *MySQLConnectionEnv) (*mySQLStoreBackend, error) {
+	chairEnv := NewMySQLStoreConnectionEnv("CHAIR", base)
+	chairReplicaEnvs := NewMySQLReplicaConnectionEnvs("CHAIR", chairEnv)
+	estateEnv := NewMySQLStoreConnectionEnv("ESTATE", base)
+	estateReplicaEnvs := NewMySQLReplicaConnectionEnvs("ESTATE", estateEnv)
+
+	chairDB, err := connectDBCluster(chairEnv, chairReplicaEnvs)
+	if err != nil {
+		return nil, err
+	}
+	if reflect.DeepEqual(chairEnv, estateEnv) && reflect.DeepEqual(chairReplicaEnvs, estateReplicaEnvs) {
+		return &mySQLStoreBackend{chairDB: chairDB, estateDB: chairDB}, nil
+	}
+	estateDB, err := connectDBCluster(estateEnv, estateReplicaEnvs)
+	if err != nil {
+		chairDB.Close()
+		return nil, err
+	}
+	return &mySQLStoreBackend{chairDB: chairDB, estateDB: estateDB}, nil
+}
+
+func (b *mySQLStoreBackend) ChairStore() ChairStore {
+	return &mySQLChairStore{db: b.chairDB}
+}
+
+func (b *mySQLStoreBackend) EstateStore() EstateStore {
+	return &mySQLEstateStore{db: b.estateDB}
+}
+
+// WebhookStore 通知先は全ての DB に同じ ID で登録し、配信はイベントを書いた DB から取り出す
+func (b *mySQLStoreBackend) WebhookStore() WebhookStore {
+	dbs := []*dbCluster{b.chairDB}
+	if b.estateDB != b.chairDB {
+		dbs = append(dbs, b.estateDB)
+	}
+	return &mySQLWebhookStore{dbs: dbs}
+}
+
+func (b *mySQLStoreBackend) Initialize(ctx context.Context) error {
+	sqlDir := filepath.Join("..", "mysql", "db")
+	// スキーマは DB ごと作り直すので、データを入れる前に全ての接続先で流す
+	scripts := []struct {
+		env  *MySQLConnectionEnv
+		path string
+	}{
+		{b.chairDB.env, filepath.Join(sqlDir, "0_Schema.sql")},
+		{b.estateDB.env, filepath.Join(sqlDir, "0_Schema.sql")},
+		{b.estateDB.env, filepath.Join(sqlDir, "1_DummyEstateData.sql")},
+		{b.chairDB.env, filepath.Join(sqlDir, "2_DummyChairData.sql")},
+	}
+
+	done := map[MySQLConnectionEnv]map[string]bool{}
+	for _, script := range scripts {
+		if done[*script.env][script.path] {
+			continue
+		}
+		sqlFile, _ := filepath.Abs(script.path)
+		cmdStr := fmt.Sprintf("mysql -h %v -u %v -p%v -P %v %v < %v",
+			script.env.Host,
+			script.env.User,
+			script.env.Password,
+			script.env.Port,
+			script.env.DBName,
+			sqlFile,
+		)
+		if err := exec.CommandContext(ctx, "bash", "-c", cmdStr).Run(); err != nil {
+			return fmt.Errorf("%v: %v", sqlFile, err)
+		}
+		if done[*script.env] == nil {
+			done[*script.env] = map[string]bool{}
+		}
+		done[*script.env][script.path] = true
+	}
+	b.chairDB.resetStmts()
+	b.estateDB.resetStmts()
+	return nil
+}
+
+func (b *mySQLStoreBackend) Close() error {
+	if b.estateDB != b.chairDB {
+		b.estateDB.Close()
+	}
+	return b.chairDB.Close()
+}
+
+func existingIDs(ctx context.Context, db *sqlx.DB, table string, ids []int64) ([]int64, error) {
+	existing := []int64{}
+	for start := 0; start < len(ids); start += duplicateCheckChunkSize {
+		end := start + duplicateCheckChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		query, args, err := sqlx.In("SELECT id FROM "+table+" WHERE id IN (?)", ids[start:end])
+		if err != nil {
+			return nil, err
+		}
+		found := []int64{}
+		if err := db.SelectContext(ctx, &found, query, args...); err != nil {
+			return nil, err
+		}
+		existing = append(existing, found...)
+	}
+	return existing, nil
+}
+
+// 閲覧数などの加算で一度に INSERT する件数
+const activityChunkSize = 500
+
+// exportBatchSize エクスポートで一度に読む行数
+const exportBatchSize = 1000
+
+// addActivity id ごとの件数を counters の列にまとめて加算する
+func addActivity(ctx context.Context, db *sqlx.DB, table, idColumn string, counters []string, activity map[int64][]int64) error {
+	ids := make([]int64, 0, len(activity))
+	for id := range activity {
+		ids = append(ids, id)
+	}
+	placeholder := "(?" + strings.Repeat(", ?", len(counters)) + ")"
+	updates := make([]string, 0, len(counters))
+	for _, counter := range counters {
+		updates = append(updates, fmt.Sprintf("%v = %v + VALUES(%v)", counter, counter, counter))
+	}
+
+	for start := 0; start < len(ids); start += activityChunkSize {
+		end := start + activityChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		placeholders := make([]string, 0, end-start)
+		params := make([]interface{}, 0, (end-start)*(len(counters)+1))
+		for _, id := range ids[start:end] {
+			placeholders = append(placeholders, placeholder)
+			params = append(params, id)
+			for _, v := range activity[id] {
+				params = append(params, v)
+			}
+		}
+		query := fmt.Sprintf("INSERT INTO %v(%v, %v) VALUES %v ON DUPLICATE KEY UPDATE %v",
+			table, idColumn, strings.Join(counters, ", "), strings.Join(placeholders, ", "), strings.Join(updates, ", "))
+		if _, err := db.ExecContext(ctx, query, params...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recomputePopularity 積み上げた件数を score の式で popularity に足し込み、件数を消す
+// 前回の再計算時刻を popularity_state の行ロックで守り、複数台から呼ばれても MinInterval に1回しか実行しない
+func recomputePopularity(ctx context.Context, db *sqlx.DB, table, activityTable, idColumn string, conf PopularityConfig, score string, weights ...interface{}) (bool, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var elapsedMicros int64
+	err = tx.GetContext(ctx, &elapsedMicros, "SELECT TIMESTAMPDIFF(MICROSECOND, recomputed_at, NOW(6)) FROM popularity_state WHERE name = ? FOR UPDATE", table)
+	if err != nil {
+		return false, err
+	}
+	elapsed := time.Duration(elapsedMicros) * time.Microsecond
+	if elapsed < conf.MinInterval {
+		return false, nil
+	}
+
+	// 集計中に加算された件数を消してしまわないよう、先に全ての行をロックする
+	if _, err := tx.ExecContext(ctx, "SELECT "+idColumn+" FROM "+activityTable+" FOR UPDATE"); err != nil {
+		return false, err
+	}
+	if decay := conf.decay(elapsed); decay < 1 {
+		if _, err := tx.ExecContext(ctx, "UPDATE "+table+" SET popularity = FLOOR(popularity * ?)", decay); err != nil {
+			return false, err
+		}
+	}
+	query := "UPDATE " + table + " t JOIN " + activityTable + " a ON a." + idColumn + " = t.id SET t.popularity = t.popularity + ROUND(" + score + ")"
+	if _, err := tx.ExecContext(ctx, query, weights...); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+activityTable); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE popularity_state SET recomputed_at = NOW(6) WHERE name = ?", table); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func appendRangeCondition(conditions []string, params []interface{}, column string, r *Range) ([]string, []interface{}) {
+	if r == nil {
+		return conditions, params
+	}
+	if r.Min != -1 {
+		conditions = append(conditions, column+" >= ?")
+		params = append(params, r.Min)
+	}
+	if r.Max != -1 {
+		conditions = append(conditions, column+" < ?")
+		params = append(params, r.Max)
+	}
+	return conditions, params
+}
+
+func (s *mySQLChairStore) GetChair(ctx context.Context, id int64) (*Chair, error) {
+	chair := Chair{}
+	query := `SELECT * FROM chair WHERE id = ?`
+	if err := s.db.replicaStmts().GetContext(ctx, &chair, query, id); err != nil {
+		return nil, err
+	}
+	return &chair, nil
+}
+
+func (s *mySQLChairStore) SearchChairs(ctx context.Context, q ChairSearchQuery) (int64, []Chair, error) {
+	conditions := make([]string, 0)
+	params := make([]interface{}, 0)
+
+	conditions, params = appendRangeCondition(conditions, params, "price", q.Price)
+	conditions, params = appendRangeCondition(conditions, params, "height", q.Height)
+	conditions, params = appendRangeCondition(conditions, params, "width", q.Width)
+	conditions, params = appendRangeCondition(conditions, params, "depth", q.Depth)
+
+	if q.Kind != "" {
+		conditions = append(conditions, "kind = ?")
+		params = append(params, q.Kind)
+	}
+
+	if q.Color != "" {
+		conditions = append(conditions, "color = ?")
+		params = append(params, q.Color)
+	}
+
+	for _, f := range q.Features {
+		conditions = append(conditions, "features LIKE CONCAT('%', ?, '%')")
+		params = append(params, f)
+	}
+
+	conditions = append(conditions, "stock > 0")
+
+	searchQuery := "SELECT * FROM chair WHERE "
+	countQuery := "SELECT COUNT(*) FROM chair WHERE "
+	searchCondition := strings.Join(conditions, " AND ")
+	limitOffset := " ORDER BY popularity DESC, id ASC LIMIT ? OFFSET ?"
+
+	var count int64
+	rdb := s.db.replica()
+	if err := rdb.GetContext(ctx, &count, countQuery+searchCondition, params...); err != nil {
+		return 0, nil, err
+	}
+
+	chairs := []Chair{}
+	params = append(params, q.PerPage, q.Page*q.PerPage)
+	if err := rdb.SelectContext(ctx, &chairs, searchQuery+searchCondition+limitOffset, params...); err != nil {
+		return 0, nil, err
+	}
+	return count, chairs, nil
+}
+
+func (s *mySQLChairStore) LowPricedChairs(ctx context.Context, limit int) ([]Chair, error) {
+	chairs := []Chair{}
+	query := `SELECT * FROM chair WHERE stock > 0 ORDER BY price ASC, id ASC LIMIT ?`
+	if err := s.db.replicaStmts().SelectContext(ctx, &chairs, query, limit); err != nil {
+		return nil, err
+	}
+	return chairs, nil
+}
+
+func (s *mySQLChairStore) RecommendedChairs(ctx context.Context, doorWidth, doorHeight int64, limit int) ([]Chair, error) {
+	chairs := []Chair{}
+	w := doorWidth
+	h := doorHeight
+	query := `SELECT * FROM chair WHERE stock > 0 AND ((width <= ? AND height <= ?) OR (width <= ? AND depth <= ?) OR (height <= ? AND width <= ?) OR (height <= ? AND depth <= ?) OR (depth <= ? AND width <= ?) OR (depth <= ? AND height <= ?)) ORDER BY popularity DESC, id ASC LIMIT ?`
+	if err := s.db.replicaStmts().SelectContext(ctx, &chairs, query, w, h, w, h, w, h, w, h, w, h, w, h, limit); err != nil {
+		return nil, err
+	}
+	return chairs, nil
+}
+
+func (s *mySQLChairStore) ExistingChairIDs(ctx context.Context, ids []int64) ([]int64, error) {
+	return existingIDs(ctx, s.db.primary, "chair", ids)
+}
+
+// loadChairs カタログに読み込むイスをプライマリから読む。ids が nil なら全て読む
+func (s *mySQLChairStore) loadChairs(ctx context.Context, ids []int64) ([]Chair, error) {
+	chairs := []Chair{}
+	if ids == nil {
+		err := s.db.primary.SelectContext(ctx, &chairs, "SELECT * FROM chair ORDER BY id ASC")
+		return chairs, err
+	}
+	for start := 0; start < len(ids); start += duplicateCheckChunkSize {
+		end := start + duplicateCheckChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		query, args, err := sqlx.In("SELECT * FROM chair WHERE id IN (?)", ids[start:end])
+		if err != nil {
+			return nil, err
+		}
+		found := []Chair{}
+		if err := s.db.primary.SelectContext(ctx, &found, query, args...); err != nil {
+			return nil, err
+		}
+		chairs = append(chairs, found...)
+	}
+	return chairs, nil
+}
+
+func (s *mySQLChairStore) InsertChairs(ctx context.Context, chairs []Chair) error {
+	tx, err := s.db.primary.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, chair := range chairs {
+		_, err := tx.ExecContext(ctx, "INSERT INTO chair(id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)", chair.ID, chair.Name, chair.Description, chair.Thumbnail, chair.Price, chair.Height, chair.Width, chair.Depth, chair.Color, chair.Features, chair.Kind, chair.Popularity, chair.Stock)
+		if err != nil {
+			return err
+		}
+		if err := insertChairHistory(ctx, tx, chair.ID, historyEventCreate, chair.Price, chair.Stock, ""); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *mySQLChairStore) UpdateChair(ctx context.Context, id int64, fn func(*Chair) error) (*Chair, error) {
+	tx, err := s.db.primary.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var chair Chair
+	if err := tx.QueryRowxContext(ctx, "SELECT * FROM chair WHERE id = ? FOR UPDATE", id).StructScan(&chair); err != nil {
+		return nil, err
+	}
+	before := chair
+	if err := fn(&chair); err != nil {
+		return nil, err
+	}
+
+	if chair.Price != before.Price || chair.Stock != before.Stock {
+		if err := insertChairHistory(ctx, tx, id, historyEventUpdate, chair.Price, chair.Stock, ""); err != nil {
+			return nil, err
+		}
+	}
+	// 在庫を 0 にした編集も、購入で売り切れたときと同じく通知する
+	if before.Stock > 0 && chair.Stock == 0 {
+		if err := queueChairSoldOut(ctx, tx, &chair); err != nil {
+			return nil, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE chair SET name = ?, description = ?, thumbnail = ?, price = ?, height = ?, width = ?, depth = ?, color = ?, features = ?, kind = ?, popularity = ?, stock = ? WHERE id = ?",
+		chair.Name, chair.Description, chair.Thumbnail, chair.Price, chair.Height, chair.Width, chair.Depth, chair.Color, chair.Features, chair.Kind, chair.Popularity, chair.Stock, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &chair, nil
+}
+
+func (s *mySQLChairStore) DeleteChair(ctx context.Context, id int64) error {
+	tx, err := s.db.primary.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var chair Chair
+	if err := tx.QueryRowxContext(ctx, "SELECT * FROM chair WHERE id = ? FOR UPDATE", id).StructScan(&chair); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chair WHERE id = ?", id); err != nil {
+		return err
+	}
+	if err := insertChairHistory(ctx, tx, id, historyEventDelete, chair.Price, chair.Stock, ""); err != nil {
+		return err
+	}
+
+	// 削除したイスの確保は在庫を戻す先がないので一緒に消す
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chair_reservation WHERE chair_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *mySQLChairStore) BuyChair(ctx context.Context, id int64, email string) (int64, error) {
+	tx, err := s.db.primary.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var chair Chair
+	if err := tx.QueryRowxContext(ctx, "SELECT * FROM chair WHERE id = ? AND stock > 0 FOR UPDATE", id).StructScan(&chair); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE chair SET stock = stock - 1 WHERE id = ?", id); err != nil {
+		return 0, err
+	}
+	chair.Stock--
+	if err := insertChairHistory(ctx, tx, id, historyEventPurchase, chair.Price, chair.Stock, email); err != nil {
+		return 0, err
+	}
+	if chair.Stock == 0 {
+		if err := queueChairSoldOut(ctx, tx, &chair); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return chair.Stock, nil
+}
+
+// ReserveChair 確保した時点で在庫を減らすので、確保中のイスは詳細・検索で在庫として数えられない
+func (s *mySQLChairStore) ReserveChair(ctx context.Context, id int64, token, email string, ttl time.Duration) (int64, time.Time, error) {
+	tx, err := s.db.primary.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var chair Chair
+	if err := tx.QueryRowxContext(ctx, "SELECT * FROM chair WHERE id = ? AND stock > 0 FOR UPDATE", id).StructScan(&chair); err != nil {
+		return 0, time.Time{}, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE chair SET stock = stock - 1 WHERE id = ?", id); err != nil {
+		return 0, time.Time{}, err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO chair_reservation(token, chair_id, email, expires_at) VALUES(?, ?, ?, DATE_ADD(NOW(6), INTERVAL ? MICROSECOND))", token, id, email, ttl.Microseconds())
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	// 期限切れの判定は DB の時刻で行うので、Go の時計ではなく記録した期限を返す
+	var expiresAt float64
+	if err := tx.GetContext(ctx, &expiresAt, "SELECT UNIX_TIMESTAMP(expires_at) FROM chair_reservation WHERE token = ?", token); err != nil {
+		return 0, time.Time{}, err
+	}
+	chair.Stock--
+	if err := insertChairHistory(ctx, tx, id, historyEventReserve, chair.Price, chair.Stock, email); err != nil {
+		return 0, time.Time{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, time.Time{}, err
+	}
+	return chair.Stock, historyTime(expiresAt), nil
+}
+
+// ConsumeChairReservation 在庫は確保したときに減らしているので、履歴には購入者だけを残す
+func (s *mySQLChairStore) ConsumeChairReservation(ctx context.Context, id int64, token, email string) error {
+	tx, err := s.db.primary.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var reservationID int64
+	err = tx.QueryRowxContext(ctx, "SELECT id FROM chair_reservation WHERE token = ? AND chair_id = ? AND expires_at > NOW(6) FOR UPDATE", token, id).Scan(&reservationID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chair_reservation WHERE id = ?", reservationID); err != nil {
+		return err
+	}
+	var chair Chair
+	if err := tx.QueryRowxContext(ctx, "SELECT * FROM chair WHERE id = ?", id).StructScan(&chair); err != nil {
+		return err
+	}
+	if err := insertChairHistory(ctx, tx, id, historyEventPurchase, chair.Price, chair.Stock, email); err != nil {
+		return err
+	}
+	if chair.Stock == 0 {
+		if err := queueChairSoldOut(ctx, tx, &chair); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// queueChairSoldOut 在庫が 0 になったイスの chair.sold_out を積む
+// 確保中の分が残っていれば、期限切れで在庫に戻るかもしれないので売り切れにしない
+func queueChairSoldOut(ctx context.Context, tx *sqlx.Tx, chair *Chair) error {
+	var reserved int64
+	if err := tx.GetContext(ctx, &reserved, "SELECT COUNT(*) FROM chair_reservation WHERE chair_id = ?", chair.ID); err != nil {
+		return err
+	}
+	if reserved > 0 {
+		return nil
+	}
+	return insertWebhookDeliveries(ctx, tx, WebhookPayload{Event: webhookEventChairSoldOut, CreatedAt: time.Now(), Chair: chair})
+}
+
+// ReleaseExpiredReservations 期限切れの確保を削除して在庫を戻す
+func (s *mySQLChairStore) ReleaseExpiredReservations(ctx context.Context) (map[int64]int64, error) {
+	tx, err := s.db.primary.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	type expired struct {
+		ID      int64  `db:"id"`
+		ChairID int64  `db:"chair_id"`
+		Email   string `db:"email"`
+	}
+	reservations := []expired{}
+	err = tx.SelectContext(ctx, &reservations, "SELECT id, chair_id, email FROM chair_reservation WHERE expires_at <= NOW(6) FOR UPDATE")
+	if err != nil {
+		return nil, err
+	}
+
+	stocks := make(map[int64]int64, len(reservations))
+	for _, r := range reservations {
+		if _, err := tx.ExecContext(ctx, "UPDATE chair SET stock = stock + 1 WHERE id = ?", r.ChairID); err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM chair_reservation WHERE id = ?", r.ID); err != nil {
+			return nil, err
+		}
+		var chair Chair
+		if err := tx.QueryRowxContext(ctx, "SELECT * FROM chair WHERE id = ?", r.ChairID).StructScan(&chair); err != nil {
+			return nil, err
+		}
+		if err := insertChairHistory(ctx, tx, r.ChairID, historyEventRelease, chair.Price, chair.Stock, r.Email); err != nil {
+			return nil, err
+		}
+		stocks[r.ChairID] = chair.Stock
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return stocks, nil
+}
+
+// EachChair exportBatchSize 件ずつ id の続きから読む。fn はクライアントに書き込むので、その間カーソルを開いたままにしない
+// エクスポートは今の在庫を返すので、遅れのあるレプリカではなくプライマリから読む
+func (s *mySQLChairStore) EachChair(ctx context.Context, fn func(Chair) error) error {
+	var after int64 = -1
+	for {
+		var chairs []Chair
+		if err := s.db.primary.SelectContext(ctx, &chairs, "SELECT * FROM chair WHERE id > ? ORDER BY id ASC LIMIT ?", after, exportBatchSize); err != nil {
+			return err
+		}
+		for _, chair := range chairs {
+			if err := fn(chair); err != nil {
+				return err
+			}
+		}
+		if len(chairs) < exportBatchSize {
+			return nil
+		}
+		after = chairs[len(chairs)-1].ID
+	}
+}
+
+func (s *mySQLChairStore) AddChairActivity(ctx context.Context, activity map[int64]ChairActivity) error {
+	counts := make(map[int64][]int64, len(activity))
+	for id, a := range activity {
+		counts[id] = []int64{a.Views, a.Purchases}
+	}
+	return addActivity(ctx, s.db.primary, "chair_activity", "chair_id", []string{"views", "purchases"}, counts)
+}
+
+func (s *mySQLChairStore) RecomputeChairPopularity(ctx context.Context, conf PopularityConfig) (bool, error) {
+	return recomputePopularity(ctx, s.db.primary, "chair", "chair_activity", "chair_id", conf,
+		"a.views * ? + a.purchases * ?", conf.ChairViewWeight, conf.ChairPurchaseWeight)
+}
+
+// ChairHistory 直前に書いた履歴を読めるよう primary から読む
+func (s *mySQLChairStore) ChairHistory(ctx context.Context, id int64) ([]ChairHistory, error) {
+	rows := []struct {
+		Event     string  `db:"event"`
+		Price     int64   `db:"price"`
+		Stock     int64   `db:"stock"`
+		Email     string  `db:"email"`
+		CreatedAt float64 `db:"created_at"`
+	}{}
+	err := s.db.primaryStmts().SelectContext(ctx, &rows, "SELECT event, price, stock, email, UNIX_TIMESTAMP(created_at) AS created_at FROM chair_history WHERE chair_id = ? ORDER BY id ASC", id)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]ChairHistory, 0, len(rows))
+	for _, r := range rows {
+		history = append(history, ChairHistory{Event: r.Event, Price: r.Price, Stock: r.Stock, Email: r.Email, CreatedAt: historyTime(r.CreatedAt)})
+	}
+	return history, nil
+}
+
+func (s *mySQLEstateStore) GetEstate(ctx context.Context, id int64) (*Estate, error) {
+	var estate Estate
+	if err := s.db.replicaStmts().GetContext(ctx, &estate, "SELECT * FROM estate WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	return &estate, nil
+}
+
+func (s *mySQLEstateStore) SearchEstates(ctx context.Context, q EstateSearchQuery) (int64, []Estate, error) {
+	conditions := make([]string, 0)
+	params := make([]interface{}, 0)
+
+	conditions, params = appendRangeCondition(conditions, params, "door_height", q.DoorHeight)
+	conditions, params = appendRangeCondition(conditions, params, "door_width", q.DoorWidth)
+	conditions, params = appendRangeCondition(conditions, params, "rent", q.Rent)
+
+	for _, f := range q.Features {
+		conditions = append(conditions, "features like concat('%', ?, '%')")
+		params = append(params, f)
+	}
+
+	searchQuery := "SELECT * FROM estate WHERE "
+	countQuery := "SELECT COUNT(*) FROM estate WHERE "
+	searchCondition := strings.Join(conditions, " AND ")
+	limitOffset := " ORDER BY popularity DESC, id ASC LIMIT ? OFFSET ?"
+
+	var count int64
+	rdb := s.db.replica()
+	if err := rdb.GetContext(ctx, &count, countQuery+searchCondition, params...); err != nil {
+		return 0, nil, err
+	}
+
+	estates := []Estate{}
+	params = append(params, q.PerPage, q.Page*q.PerPage)
+	if err := rdb.SelectContext(ctx, &estates, searchQuery+searchCondition+limitOffset, params...); err != nil {
+		return 0, nil, err
+	}
+	return count, estates, nil
+}
+
+func (s *mySQLEstateStore) LowPricedEstates(ctx context.Context, limit int) ([]Estate, error) {
+	estates := make([]Estate, 0, limit)
+	query := `SELECT * FROM estate ORDER BY rent ASC, id ASC LIMIT ?`
+	if err := s.db.replicaStmts().SelectContext(ctx, &estates, query, limit); err != nil {
+		return nil, err
+	}
+	return estates, nil
+}
+
+func (s *mySQLEstateStore) RecommendedEstates(ctx context.Context, width, height, depth int64, limit int) ([]Estate, error) {
+	estates := []Estate{}
+	w := width
+	h := height
+	d := depth
+	query := `SELECT * FROM estate WHERE (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) ORDER BY popularity DESC, id ASC LIMIT ?`
+	if err := s.db.replicaStmts().SelectContext(ctx, &estates, query, w, h, w, d, h, w, h, d, d, w, d, h, limit); err != nil {
+		return nil, err
+	}
+	return estates, nil
+}
+
+func (s *mySQLEstateStore) EstatesInPolygon(ctx context.Context, coordinates Coordinates) ([]Estate, error) {
+	b := coordinates.getBoundingBox()
+	estatesInBoundingBox := []Estate{}
+	query := `SELECT * FROM estate WHERE latitude <= ? AND latitude >= ? AND longitude <= ? AND longitude >= ? ORDER BY popularity DESC, id ASC`
+	// 絞り込みと多角形の判定は同じレプリカに投げる
+	stmts := s.db.replicaStmts()
+	err := stmts.SelectContext(ctx, &estatesInBoundingBox, query, b.BottomRightCorner.Latitude, b.TopLeftCorner.Latitude, b.BottomRightCorner.Longitude, b.TopLeftCorner.Longitude)
+	if err != nil {
+		return nil, err
+	}
+
+	estatesInPolygon := []Estate{}
+	for _, estate := range estatesInBoundingBox {
+		validatedEstate := Estate{}
+
+		point := fmt.Sprintf("'POINT(%f %f)'", estate.Latitude, estate.Longitude)
+		query := fmt.Sprintf(`SELECT * FROM estate WHERE id = ? AND ST_Contains(ST_PolygonFromText(%s), ST_GeomFromText(%s))`, coordinates.coordinatesToText(), point)
+		err = stmts.db.GetContext(ctx, &validatedEstate, query, estate.ID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				continue
+			}
+			return nil, err
+		}
+		estatesInPolygon = append(estatesInPolygon, validatedEstate)
+	}
+	return estatesInPolygon, nil
+}
+
+func (s *mySQLEstateStore) ExistingEstateIDs(ctx context.Context, ids []int64) ([]int64, error) {
+	return existingIDs(ctx, s.db.primary, "estate", ids)
+}
+
+func (s *mySQLEstateStore) loadEstates(ctx context.Context, ids []int64) ([]Estate, error) {
+	estates := []Estate{}
+	if ids == nil {
+		err := s.db.primary.SelectContext(ctx, &estates, "SELECT * FROM estate ORDER BY id ASC")
+		return estates, err
+	}
+	for start := 0; start < len(ids); start += duplicateCheckChunkSize {
+		end := start + duplicateCheckChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		query, args, err := sqlx.In("SELECT * FROM estate WHERE id IN (?)", ids[start:end])
+		if err != nil {
+			return nil, err
+		}
+		found := []Estate{}
+		if err := s.db.primary.SelectContext(ctx, &found, query, args...); err != nil {
+			return nil, err
+		}
+		estates = append(estates, found...)
+	}
+	return estates, nil
+}
+
+func (s *mySQLEstateStore) InsertEstates(ctx context.Context, estates []Estate) error {
+	tx, err := s.db.primary.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, estate := range estates {
+		_, err := tx.ExecContext(ctx, "INSERT INTO estate(id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity) VALUES(?,?,?,?,?,?,?,?,?,?,?,?)", estate.ID, estate.Name, estate.Description, estate.Thumbnail, estate.Address, estate.Latitude, estate.Longitude, estate.Rent, estate.DoorHeight, estate.DoorWidth, estate.Features, estate.Popularity)
+		if err != nil {
+			return err
+		}
+		if err := insertEstateHistory(ctx, tx, estate.ID, historyEventCreate, estate.Rent); err != nil {
+			return err
+		}
+	}
+	if len(estates) > 0 {
+		if err := insertWebhookDeliveries(ctx, tx, WebhookPayload{Event: webhookEventEstateCreated, CreatedAt: time.Now(), Estates: estates}); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *mySQLEstateStore) UpdateEstate(ctx context.Context, id int64, fn func(*Estate) error) (*Estate, error) {
+	tx, err := s.db.primary.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var estate Estate
+	if err := tx.QueryRowxContext(ctx, "SELECT * FROM estate WHERE id = ? FOR UPDATE", id).StructScan(&estate); err != nil {
+		return nil, err
+	}
+	before := estate
+	if err := fn(&estate); err != nil {
+		return nil, err
+	}
+
+	if estate.Rent != before.Rent {
+		if err := insertEstateHistory(ctx, tx, id, historyEventUpdate, estate.Rent); err != nil {
+			return nil, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE estate SET name = ?, description = ?, thumbnail = ?, address = ?, latitude = ?, longitude = ?, rent = ?, door_height = ?, door_width = ?, features = ?, popularity = ? WHERE id = ?",
+		estate.Name, estate.Description, estate.Thumbnail, estate.Address, estate.Latitude, estate.Longitude, estate.Rent, estate.DoorHeight, estate.DoorWidth, estate.Features, estate.Popularity, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &estate, nil
+}
+
+func (s *mySQLEstateStore) DeleteEstate(ctx context.Context, id int64) error {
+	tx, err := s.db.primary.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var estate Estate
+	if err := tx.QueryRowxContext(ctx, "SELECT * FROM estate WHERE id = ? FOR UPDATE", id).StructScan(&estate); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM estate WHERE id = ?", id); err != nil {
+		return err
+	}
+	if err := insertEstateHistory(ctx, tx, id, historyEventDelete, estate.Rent); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *mySQLEstateStore) EachEstate(ctx context.Context, fn func(Estate) error) error {
+	var after int64 = -1
+	for {
+		var estates []Estate
+		if err := s.db.primary.SelectContext(ctx, &estates, "SELECT * FROM estate WHERE id > ? ORDER BY id ASC LIMIT ?", after, exportBatchSize); err != nil {
+			return err
+		}
+		for _, estate := range estates {
+			if err := fn(estate); err != nil {
+				return err
+			}
+		}
+		if len(estates) < exportBatchSize {
+			return nil
+		}
+		after = estates[len(estates)-1].ID
+	}
+}
+
+func (s *mySQLEstateStore) AddEstateActivity(ctx context.Context, activity map[int64]EstateActivity) error {
+	counts := make(map[int64][]int64, len(activity))
+	for id, a := range activity {
+		counts[id] = []int64{a.Views, a.Requests}
+	}
+	return addActivity(ctx, s.db.primary, "estate_activity", "estate_id", []string{"views", "requests"}, counts)
+}
+
+func (s *mySQLEstateStore) RecomputeEstatePopularity(ctx context.Context, conf PopularityConfig) (bool, error) {
+	return recomputePopularity(ctx, s.db.primary, "estate", "estate_activity", "estate_id", conf,
+		"a.views * ? + a.requests * ?", conf.EstateViewWeight, conf.EstateRequestWeight)
+}
+
+func (s *mySQLEstateStore) EstateHistory(ctx context.Context, id int64) ([]EstateHistory, error) {
+	rows := []struct {
+		Event     string  `db:"event"`
+		Rent      int64   `db:"rent"`
+		CreatedAt float64 `db:"created_at"`
+	}{}
+	err := s.db.primaryStmts().SelectContext(ctx, &rows, "SELECT event, rent, UNIX_TIMESTAMP(created_at) AS created_at FROM estate_history WHERE estate_id = ? ORDER BY id ASC", id)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]EstateHistory, 0, len(rows))
+	for _, r := range rows {
+		history = append(history, EstateHistory{Event: r.Event, Rent: r.Rent, CreatedAt: historyTime(r.CreatedAt)})
+	}
+	return history, nil
+}
+
+// AddWebhook 全ての DB でトランザクションを開いて書き込んでから順に確定する
+// 途中の DB で確定に失敗したら、確定済みの DB の行を消して揃える
+func (s *mySQLWebhookStore) AddWebhook(ctx context.Context, endpoint WebhookEndpoint) (*WebhookEndpoint, error) {
+	events := webhookEventsColumn(endpoint.Events)
+	txs := make([]*sqlx.Tx, 0, len(s.dbs))
+	defer func() {
+		for _, tx := range txs {
+			tx.Rollback()
+		}
+	}()
+	for i, db := range s.dbs {
+		tx, err := db.primary.BeginTxx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+		if i == 0 {
+			result, err := tx.ExecContext(ctx, "INSERT INTO webhook_endpoint(url, secret, events) VALUES(?, ?, ?)", endpoint.URL, endpoint.Secret, events)
+			if err != nil {
+				return nil, err
+			}
+			if endpoint.ID, err = result.LastInsertId(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO webhook_endpoint(id, url, secret, events) VALUES(?, ?, ?, ?)", endpoint.ID, endpoint.URL, endpoint.Secret, events)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, tx := range txs {
+		if err := tx.Commit(); err != nil {
+			// 確定した DB の行は消せなくても、ID が同じなので DeleteWebhook で消せる
+			undoCtx, cancel := detachContext(ctx)
+			for _, db := range s.dbs[:i] {
+				db.primary.ExecContext(undoCtx, "DELETE FROM webhook_endpoint WHERE id = ?", endpoint.ID)
+			}
+			cancel()
+			return nil, err
+		}
+	}
+	return &endpoint, nil
+}
+
+func (s *mySQLWebhookStore) Webhooks(ctx context.Context) ([]WebhookEndpoint, error) {
+	rows := []struct {
+		ID     int64  `db:"id"`
+		URL    string `db:"url"`
+		Secret string `db:"secret"`
+		Events string `db:"events"`
+	}{}
+	if err := s.dbs[0].primary.SelectContext(ctx, &rows, "SELECT id, url, secret, events FROM webhook_endpoint ORDER BY id ASC"); err != nil {
+		return nil, err
+	}
+	endpoints := make([]WebhookEndpoint, 0, len(rows))
+	for _, r := range rows {
+		endpoints = append(endpoints, WebhookEndpoint{ID: r.ID, URL: r.URL, Secret: r.Secret, Events: strings.Split(r.Events, ",")})
+	}
+	return endpoints, nil
+}
+
+func (s *mySQLWebhookStore) DeleteWebhook(ctx context.Context, id int64) error {
+	for i, db := range s.dbs {
+		result, err := db.primary.ExecContext(ctx, "DELETE FROM webhook_endpoint WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 && i == 0 {
+			return sql.ErrNoRows
+		}
+		if _, err := db.primary.ExecContext(ctx, "DELETE FROM webhook_delivery WHERE endpoint_id = ?", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClaimWebhookDeliveries 送信時刻を lease だけ先に進めてから返すので、送り終える前に落ちても後で送り直される
+func (s *mySQLWebhookStore) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	for shard, db := range s.dbs {
+		claimed, err := claimWebhookDeliveries(ctx, db, limit-len(deliveries), lease)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range claimed {
+			d.shard = shard
+			deliveries = append(deliveries, d)
+		}
+		if len(deliveries) >= limit {
+			break
+		}
+	}
+	return deliveries, nil
+}
+
+func claimWebhookDeliveries(ctx context.Context, db *dbCluster, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	tx, err := db.primary.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows := []struct {
+		ID         int64  `db:"id"`
+		EndpointID int64  `db:"endpoint_id"`
+		URL        string `db:"url"`
+		Secret     string `db:"secret"`
+		Event      string `db:"event"`
+		Payload    []byte `db:"payload"`
+		Attempts   int    `db:"attempts"`
+	}{}
+	query := "SELECT d.id, d.endpoint_id, e.url, e.secret, d.event, d.payload, d.attempts FROM webhook_delivery d JOIN webhook_endpoint e ON e.id = d.endpoint_id WHERE d.next_attempt_at <= NOW(6) ORDER BY d.next_attempt_at ASC, d.id ASC LIMIT ? FOR UPDATE"
+	if err := tx.SelectContext(ctx, &rows, query, limit); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int64, 0, len(rows))
+	deliveries := make([]WebhookDelivery, 0, len(rows))
+	for _, r := range rows {
+		ids = append(ids, r.ID)
+		deliveries = append(deliveries, WebhookDelivery{ID: r.ID, EndpointID: r.EndpointID, URL: r.URL, Secret: r.Secret, Event: r.Event, Payload: r.Payload, Attempts: r.Attempts})
+	}
+	query, args, err := sqlx.In("UPDATE webhook_delivery SET next_attempt_at = DATE_ADD(NOW(6), INTERVAL ? MICROSECOND) WHERE id IN (?)", lease.Microseconds(), ids)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return nil, err
+	}
+	return deliveries, tx.Commit()
+}
+
+func (s *mySQLWebhookStore) WebhookDelivered(ctx context.Context, delivery WebhookDelivery) error {
+	_, err := s.dbs[delivery.shard].primary.ExecContext(ctx, "DELETE FROM webhook_delivery WHERE id = ?", delivery.ID)
+	return err
+}
+
+// WebhookFailed あきらめた配信は next_attempt_at を NULL にして、調べられるよう残しておく
+func (s *mySQLWebhookStore) WebhookFailed(ctx context.Context, delivery WebhookDelivery, retryAfter time.Duration, reason string) error {
+	db := s.dbs[delivery.shard].primary
+	if retryAfter <= 0 {
+		_, err := db.ExecContext(ctx, "UPDATE webhook_delivery SET attempts = attempts + 1, last_error = ?, next_attempt_at = NULL WHERE id = ?", reason, delivery.ID)
+		return err
+	}
+	_, err := db.ExecContext(ctx, "UPDATE webhook_delivery SET attempts = attempts + 1, last_error = ?, next_attempt_at = DATE_ADD(NOW(6), INTERVAL ? MICROSECOND) WHERE id = ?", reason, retryAfter.Microseconds(), delivery.ID)
+	return err
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	streamEventChairStock    = "chair.stock"
+	streamEventChairCreated  = "chair.created"
+	streamEventEstateCreated = "estate.created"
+)
+
+const (
+	defaultStreamBufferSize = 64
+	streamKeepAliveInterval = 15 * time.Second
+	streamContentType       = "text/event-stream"
+	streamKeepAliveComment  = ": keepalive\n\n"
+	// streamRetryMessage 切断する前に送り、EventSource が繋ぎ直すまでの時間を指定する
+	streamRetryMessage = "retry: 1000\n\n"
+)
+
+// stream /api/stream の購読者に変更を配る。配るのはこのプロセスで起きた変更だけ
+var stream = newStreamHub(defaultStreamBufferSize)
+
+type ChairStockEvent struct {
+	ID    int64 `json:"id"`
+	Stock int64 `json:"stock"`
+}
+
+type ChairCreatedEvent struct {
+	Chairs []Chair `json:"chairs"`
+}
+
+type EstateCreatedEvent struct {
+	Estates []Estate `json:"estates"`
+}
+
+type streamSubscriber struct {
+	ch chan []byte
+	// dropped 送信が追いつかず hub から外されたら閉じる
+	dropped chan struct{}
+}
+
+// streamHub 購読者ごとに bufferSize 件までためる。あふれた購読者は切断し、publish は待たない
+type streamHub struct {
+	bufferSize int
+
+	mu          sync.Mutex
+	subscribers map[*streamSubscriber]struct{}
+	lastID      int64
+
+	// closing サーバーを止めるときに閉じ、全ての購読者を切断する
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newStreamHub(bufferSize int) *streamHub {
+	return &streamHub{
+		bufferSize:  bufferSize,
+		subscribers: map[*streamSubscriber]struct{}{},
+		closing:     make(chan struct{}),
+	}
+}
+
+// shutdown 購読者に繋ぎ直すよう伝えて切断する
+func (h *streamHub) shutdown() {
+	h.closeOnce.Do(func() { close(h.closing) })
+}
+
+func (h *streamHub) subscribe() *streamSubscriber {
+	sub := &streamSubscriber{
+		ch:      make(chan []byte, h.bufferSize),
+		dropped: make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *streamHub) unsubscribe(sub *streamSubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, sub)
+	h.mu.Unlock()
+}
+
+// publish SSE の1件分に整形してから全ての購読者に配る
+func (h *streamHub) publish(event string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID++
+	msg := []byte(fmt.Sprintf("id: %v\nevent: %v\ndata: %s\n\n", h.lastID, event, body))
+	for sub := range h.subscribers {
+		select {
+		case sub.ch <- msg:
+		default:
+			delete(h.subscribers, sub)
+			close(sub.dropped)
+		}
+	}
+	return nil
+}
+
+func (h *streamHub) subscriberCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
+
+func publishStream(c echo.Context, event string, data interface{}) {
+	if err := stream.publish(event, data); err != nil {
+		c.Echo().Logger.Errorf("failed to publish %v : %v", event, err)
+	}
+}
+
+// getStream 変更を Server-Sent Events で送り続ける
+// 切断されたブラウザは EventSource が自動で繋ぎ直すので、取りこぼした分は送り直さない
+func getStream(c echo.Context) error {
+	hub := stream
+	sub := hub.subscribe()
+	defer hub.unsubscribe(sub)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, streamContentType)
+	res.Header().Set("Cache-Control", "no-cache")
+	// nginx が応答をためこまないようにする
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-sub.dropped:
+			c.Echo().Logger.Infof("stream subscriber dropped : buffer full")
+			res.Write([]byte(streamRetryMessage))
+			res.Flush()
+			return nil
+		case <-hub.closing:
+			res.Write([]byte(streamRetryMessage))
+			res.Flush()
+			return nil
+		case msg := <-sub.ch:
+			if _, err := res.Write(msg); err != nil {
+				return nil
+			}
+			res.Flush()
+		case <-keepAlive.C:
+			if _, err := res.Write([]byte(streamKeepAliveComment)); err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
@@ -0,0 +1,5 @@
+-- initial-data と同じ形式の INSERT と、MySQL のダンプに現れる書き方
+INSERT INTO isuumo.chair (id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock) VALUES (1, 'It''s a chair', 'line1\nline2 \'quoted\' back\\slash \"double\"', '/images/chair/1.png', 1000, 80, 50, 50, '黒', 'ヘッドレスト付き,肘掛け付き', 'オフィスチェア', 10, 3),
+  (2,'(paren), comma;','',  '/images/chair/2.png',2000,1,2,3,'白','','座椅子',0,1)
+;
+INSERT INTO `chair` (`stock`, `popularity`, `kind`, `features`, `color`, `depth`, `width`, `height`, `price`, `thumbnail`, `name`, `description`, `id`) VALUES(5,7,'ゲーミングチェア','100\%綿','赤',40,30,20,3000,'/images/chair/3.png','tab\tand\\\\','\椅\子',3);
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// queryTimeoutGroupExport エクスポートは全件を送るので、検索とは別の期限にする
+const queryTimeoutGroupExport = "export"
+
+// ルートのグループごとの期限の既定値。0 は期限なしで、QUERY_TIMEOUT_* で指定したときだけ打ち切る
+// ベンチマーカーは CSV の入稿を 5 秒、検証の検索を 10 秒まで待つので、指定するならそれより長くすること
+// 期限がなくても、クライアントが切断すればクエリは打ち切られる
+var defaultQueryTimeouts = map[string]time.Duration{
+	rateLimitGroupSearch:    0,
+	rateLimitGroupDetail:    0,
+	rateLimitGroupWrite:     0,
+	queryTimeoutGroupExport: 0,
+}
+
+// statusClientClosedRequest nginx と同じく、応答する前にクライアントが切断したリクエストを 499 で記録する
+const statusClientClosedRequest = 499
+
+type queryTimeoutConfig struct {
+	groups map[string]time.Duration
+	// routes "GET /api/chair/search" のようなメソッドとルートごとの期限。グループの期限より優先する
+	routes map[string]time.Duration
+}
+
+// newQueryTimeoutConfig QUERY_TIMEOUT_{SEARCH,DETAIL,WRITE,EXPORT} と QUERY_TIMEOUT_ROUTES から期限を読む
+// QUERY_TIMEOUT_ROUTES は "GET /api/chair/search=800ms,POST /api/estate/nazotte=3s" の形式
+func newQueryTimeoutConfig() (*queryTimeoutConfig, error) {
+	conf := &queryTimeoutConfig{
+		groups: map[string]time.Duration{},
+		routes: map[string]time.Duration{},
+	}
+	for group, d := range defaultQueryTimeouts {
+		key := "QUERY_TIMEOUT_" + strings.ToUpper(group)
+		if v := getEnv(key, ""); v != "" {
+			var err error
+			d, err = parseQueryTimeout(v)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", key, err)
+			}
+		}
+		conf.groups[group] = d
+	}
+
+	routes := getEnv("QUERY_TIMEOUT_ROUTES", "")
+	if routes == "" {
+		return conf, nil
+	}
+	for _, entry := range strings.Split(routes, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		route := strings.Fields(parts[0])
+		if len(parts) != 2 || len(route) != 2 {
+			return nil, fmt.Errorf("QUERY_TIMEOUT_ROUTES: invalid entry %q", entry)
+		}
+		d, err := parseQueryTimeout(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("QUERY_TIMEOUT_ROUTES: %v", err)
+		}
+		conf.routes[strings.ToUpper(route[0])+" "+route[1]] = d
+	}
+	return conf, nil
+}
+
+func parseQueryTimeout(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid timeout %q", s)
+	}
+	return d, nil
+}
+
+func (conf *queryTimeoutConfig) timeout(group, method, path string) time.Duration {
+	if d, ok := conf.routes[method+" "+path]; ok {
+		return d
+	}
+	return conf.groups[group]
+}
+
+// middleware リクエストの context に期限をつける。ストアはこの context でクエリを投げる
+// 期限切れやクライアントの切断で失敗したリクエストは、内部エラーではなくそれぞれの応答にする
+func (conf *queryTimeoutConfig) middleware(group string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			parent := c.Request().Context()
+			ctx, cancel := parent, context.CancelFunc(func() {})
+			if d := conf.timeout(group, c.Request().Method, c.Path()); d > 0 {
+				ctx, cancel = context.WithTimeout(parent, d)
+			}
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+
+			err := next(c)
+			if err == nil || ctx.Err() == nil {
+				return err
+			}
+			if e, ok := err.(*apiError); ok && e.status < http.StatusInternalServerError {
+				return err
+			}
+			if parent.Err() != nil {
+				c.Echo().Logger.Infof("%v %v : client disconnected : %v", c.Request().Method, c.Request().URL.Path, err)
+				return newAPIError(statusClientClosedRequest, errCodeCanceled, "", "request canceled")
+			}
+			e := newAPIError(http.StatusServiceUnavailable, errCodeTimeout, "", "request timed out")
+			e.cause = err
+			return e
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// スキーマの INTEGER / VARCHAR の上限
+const maxIntColumn = 1<<31 - 1
+
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Field, e.Reason)
+}
+
+type fieldValidator struct {
+	errs []FieldError
+}
+
+func (v *fieldValidator) add(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Field: field, Reason: fmt.Sprintf(format, args...)})
+}
+
+func (v *fieldValidator) str(field, s string, min, max int) {
+	n := utf8.RuneCountInString(s)
+	if n < min {
+		v.add(field, "must not be empty")
+	} else if n > max {
+		v.add(field, "must be at most %v characters", max)
+	}
+}
+
+func (v *fieldValidator) int(field string, i, min int64) {
+	if i < min {
+		v.add(field, "must be greater than or equal to %v", min)
+	} else if i > maxIntColumn {
+		v.add(field, "must be less than or equal to %v", maxIntColumn)
+	}
+}
+
+func (v *fieldValidator) float(field string, f, min, max float64) {
+	if f < min || f > max {
+		v.add(field, "must be between %v and %v", min, max)
+	}
+}
+
+func (v *fieldValidator) oneOf(field, s string, list []string) {
+	for _, l := range list {
+		if s == l {
+			return
+		}
+	}
+	v.add(field, "unknown %v %q", field, s)
+}
+
+func validateChair(chair *Chair) []FieldError {
+	v := fieldValidator{}
+	v.int("id", chair.ID, 1)
+	v.str("name", chair.Name, 1, 64)
+	v.str("description", chair.Description, 0, 4096)
+	v.str("thumbnail", chair.Thumbnail, 0, 128)
+	v.int("price", chair.Price, 0)
+	v.int("height", chair.Height, 1)
+	v.int("width", chair.Width, 1)
+	v.int("depth", chair.Depth, 1)
+	v.oneOf("color", chair.Color, chairSearchCondition.Color.List)
+	v.str("features", chair.Features, 0, 64)
+	v.oneOf("kind", chair.Kind, chairSearchCondition.Kind.List)
+	v.int("popularity", chair.Popularity, 0)
+	v.int("stock", chair.Stock, 0)
+	return v.errs
+}
+
+func validateEstate(estate *Estate) []FieldError {
+	v := fieldValidator{}
+	v.int("id", estate.ID, 1)
+	v.str("name", estate.Name, 1, 64)
+	v.str("description", estate.Description, 0, 4096)
+	v.str("thumbnail", estate.Thumbnail, 0, 128)
+	v.str("address", estate.Address, 1, 128)
+	v.float("latitude", estate.Latitude, -90, 90)
+	v.float("longitude", estate.Longitude, -180, 180)
+	v.int("rent", estate.Rent, 0)
+	v.int("doorHeight", estate.DoorHeight, 1)
+	v.int("doorWidth", estate.DoorWidth, 1)
+	v.str("features", estate.Features, 0, 64)
+	v.int("popularity", estate.Popularity, 0)
+	return v.errs
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+const (
+	webhookEventChairSoldOut  = "chair.sold_out"
+	webhookEventEstateCreated = "estate.created"
+)
+
+var webhookEvents = []string{webhookEventChairSoldOut, webhookEventEstateCreated}
+
+const (
+	defaultWebhookDispatchInterval = time.Second
+	defaultWebhookTimeout          = 5 * time.Second
+	defaultWebhookBackoff          = 5 * time.Second
+	defaultWebhookMaxAttempts      = 8
+	maxWebhookBackoff              = 10 * time.Minute
+	webhookDispatchBatchSize       = 100
+	maxWebhookErrorLength          = 1024
+)
+
+// WebhookEndpoint 通知先。登録は /initialize の後も残り、送信待ちの配信だけが消える
+type WebhookEndpoint struct {
+	ID     int64    `json:"id"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events"`
+}
+
+// WebhookPayload 通知先に POST する本文
+type WebhookPayload struct {
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"createdAt"`
+	Chair     *Chair    `json:"chair,omitempty"`
+	Estates   []Estate  `json:"estates,omitempty"`
+}
+
+// WebhookDelivery 通知先ごとの送信待ちの配信
+type WebhookDelivery struct {
+	ID         int64
+	EndpointID int64
+	URL        string
+	Secret     string
+	Event      string
+	Payload    []byte
+	Attempts   int
+	// shard 配信を書いた DB。イスと物件の DB が分かれているときに使う
+	shard int
+}
+
+type WebhookEndpointsResponse struct {
+	Webhooks []WebhookEndpoint `json:"webhooks"`
+}
+
+// insertWebhookDeliveries 購読している全ての通知先への配信を、呼び出し元のトランザクションで書く
+func insertWebhookDeliveries(ctx context.Context, tx sqlx.ExecerContext, payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO webhook_delivery(endpoint_id, event, payload, next_attempt_at) SELECT id, ?, ?, NOW(6) FROM webhook_endpoint WHERE FIND_IN_SET(?, events)", payload.Event, body, payload.Event)
+	return err
+}
+
+// signWebhook 通知先は X-Isuumo-Signature を同じ secret で計算し直して検証する
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type webhookDispatcher struct {
+	client      *http.Client
+	interval    time.Duration
+	backoff     time.Duration
+	maxAttempts int
+}
+
+// newWebhookDispatcher WEBHOOK_* から設定を読む
+func newWebhookDispatcher() *webhookDispatcher {
+	maxAttempts, err := strconv.Atoi(getEnv("WEBHOOK_MAX_ATTEMPTS", ""))
+	if err != nil || maxAttempts <= 0 {
+		maxAttempts = defaultWebhookMaxAttempts
+	}
+	return &webhookDispatcher{
+		client:      &http.Client{Timeout: getEnvDuration("WEBHOOK_TIMEOUT", defaultWebhookTimeout)},
+		interval:    getEnvDuration("WEBHOOK_DISPATCH_INTERVAL", defaultWebhookDispatchInterval),
+		backoff:     getEnvDuration("WEBHOOK_BACKOFF", defaultWebhookBackoff),
+		maxAttempts: maxAttempts,
+	}
+}
+
+// retryAfter attempts 回失敗した配信を次に送るまでの間隔。0 なら再送しない
+func (d *webhookDispatcher) retryAfter(attempts int) time.Duration {
+	if attempts >= d.maxAttempts {
+		return 0
+	}
+	wait := d.backoff
+	for i := 1; i < attempts && wait < maxWebhookBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxWebhookBackoff {
+		wait = maxWebhookBackoff
+	}
+	return wait
+}
+
+func (d *webhookDispatcher) deliver(ctx context.Context, w WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(w.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Isuumo-Event", w.Event)
+	// 配信の ID はイベントの種類ごとに一意。再送でも変わらないので、受信側はこれで重複を除く
+	req.Header.Set("X-Isuumo-Delivery", strconv.FormatInt(w.ID, 10))
+	req.Header.Set("X-Isuumo-Signature", signWebhook(w.Secret, w.Payload))
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %v", res.StatusCode)
+	}
+	return nil
+}
+
+// dispatch 送信時刻を過ぎた配信をまとめて送り、送った件数を返す
+func (d *webhookDispatcher) dispatch(ctx context.Context) (int, error) {
+	// 全件を送り終える前に他の台が取り出さないよう、タイムアウトより長く確保する
+	deliveries, err := webhookStore.ClaimWebhookDeliveries(ctx, webhookDispatchBatchSize, 2*d.client.Timeout+d.interval)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(deliveries))
+	for i := range deliveries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := deliveries[i]
+			if err := d.deliver(ctx, w); err != nil {
+				// last_error は VARCHAR(1024) なので、文字の途中で切らないよう文字数で切り詰める
+				reason := err.Error()
+				if utf8.RuneCountInString(reason) > maxWebhookErrorLength {
+					reason = string([]rune(reason)[:maxWebhookErrorLength])
+				}
+				errs[i] = webhookStore.WebhookFailed(ctx, w, d.retryAfter(w.Attempts+1), reason)
+				return
+			}
+			errs[i] = webhookStore.WebhookDelivered(ctx, w)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return len(deliveries), err
+		}
+	}
+	return len(deliveries), nil
+}
+
+// run ctx が終わったら戻る。送信中だった配信は lease が切れた後に送り直される
+func (d *webhookDispatcher) run(ctx context.Context, e *echo.Echo) {
+	ctx = withQueryRoute(ctx, "webhook dispatcher")
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for ctx.Err() == nil {
+			n, err := d.dispatch(ctx)
+			if err != nil {
+				e.Logger.Errorf("failed to dispatch webhooks : %v", err)
+				break
+			}
+			if n < webhookDispatchBatchSize {
+				break
+			}
+		}
+	}
+}
+
+func postWebhook(c echo.Context) error {
+	var endpoint WebhookEndpoint
+	if err := c.Bind(&endpoint); err != nil {
+		c.Echo().Logger.Infof("post webhook failed : %v", err)
+		return errInvalidBody("", "request body is not valid JSON")
+	}
+
+	var v fieldValidator
+	if u, err := url.Parse(endpoint.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.add("url", "must be an http or https URL")
+	} else {
+		v.str("url", endpoint.URL, 1, 2048)
+	}
+	v.str("secret", endpoint.Secret, 0, 128)
+	if len(endpoint.Events) == 0 {
+		v.add("events", "must not be empty")
+	}
+	for i, event := range endpoint.Events {
+		v.oneOf(fmt.Sprintf("events[%v]", i), event, webhookEvents)
+	}
+	if len(v.errs) > 0 {
+		return errValidation(v.errs)
+	}
+
+	if endpoint.Secret == "" {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			return errInternal(fmt.Errorf("failed to generate webhook secret : %v", err))
+		}
+		endpoint.Secret = secret
+	}
+	created, err := webhookStore.AddWebhook(c.Request().Context(), endpoint)
+	if err != nil {
+		return errInternal(fmt.Errorf("post webhook DB execution error : %v", err))
+	}
+	// secret を返すのは登録したときだけ
+	return c.JSON(http.StatusCreated, created)
+}
+
+func getWebhooks(c echo.Context) error {
+	endpoints, err := webhookStore.Webhooks(c.Request().Context())
+	if err != nil {
+		return errInternal(fmt.Errorf("getWebhooks DB execution error : %v", err))
+	}
+	for i := range endpoints {
+		endpoints[i].Secret = ""
+	}
+	return c.JSON(http.StatusOK, WebhookEndpointsResponse{Webhooks: endpoints})
+}
+
+func deleteWebhook(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return errInvalidParameter("id", "id must be an integer")
+	}
+	if err := webhookStore.DeleteWebhook(c.Request().Context(), int64(id)); err == sql.ErrNoRows {
+		return errNotFound("webhook not found")
+	} else if err != nil {
+		return errInternal(fmt.Errorf("deleteWebhook DB execution error : %v", err))
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func webhookEventsColumn(events []string) string {
+	return strings.Join(events, ",")
+}
@@ -1,8 +1,15 @@
-DROP DATABASE IF EXISTS isuumo;
-CREATE DATABASE isuumo;
+-- 通知先の登録は /initialize の後も残すので、DB ごとではなくテーブルごとに作り直す
+CREATE DATABASE IF NOT EXISTS isuumo;
 
 DROP TABLE IF EXISTS isuumo.estate;
 DROP TABLE IF EXISTS isuumo.chair;
+DROP TABLE IF EXISTS isuumo.chair_reservation;
+DROP TABLE IF EXISTS isuumo.chair_activity;
+DROP TABLE IF EXISTS isuumo.estate_activity;
+DROP TABLE IF EXISTS isuumo.popularity_state;
+DROP TABLE IF EXISTS isuumo.chair_history;
+DROP TABLE IF EXISTS isuumo.estate_history;
+DROP TABLE IF EXISTS isuumo.webhook_delivery;
 
 CREATE TABLE isuumo.estate
 (
@@ -36,3 +43,79 @@ CREATE TABLE isuumo.chair
     popularity  INTEGER         NOT NULL,
     stock       INTEGER         NOT NULL
 );
+
+CREATE TABLE isuumo.chair_reservation
+(
+    id          INTEGER         NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    token       VARCHAR(64)     NOT NULL,
+    chair_id    INTEGER         NOT NULL,
+    email       VARCHAR(256)    NOT NULL,
+    expires_at  DATETIME(6)     NOT NULL,
+    UNIQUE KEY token (token),
+    KEY expires_at (expires_at)
+);
+
+CREATE TABLE isuumo.chair_activity
+(
+    chair_id    INTEGER         NOT NULL PRIMARY KEY,
+    views       BIGINT          NOT NULL DEFAULT 0,
+    purchases   BIGINT          NOT NULL DEFAULT 0
+);
+
+CREATE TABLE isuumo.estate_activity
+(
+    estate_id   INTEGER         NOT NULL PRIMARY KEY,
+    views       BIGINT          NOT NULL DEFAULT 0,
+    requests    BIGINT          NOT NULL DEFAULT 0
+);
+
+CREATE TABLE isuumo.popularity_state
+(
+    name            VARCHAR(16)     NOT NULL PRIMARY KEY,
+    recomputed_at   DATETIME(6)     NOT NULL
+);
+
+INSERT INTO isuumo.popularity_state (name, recomputed_at) VALUES ('chair', NOW(6)), ('estate', NOW(6));
+
+CREATE TABLE isuumo.chair_history
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    chair_id    INTEGER         NOT NULL,
+    event       VARCHAR(16)     NOT NULL,
+    price       INTEGER         NOT NULL,
+    stock       INTEGER         NOT NULL,
+    email       VARCHAR(256)    NOT NULL DEFAULT '',
+    created_at  DATETIME(6)     NOT NULL,
+    KEY chair_id (chair_id, id)
+);
+
+CREATE TABLE isuumo.estate_history
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    estate_id   INTEGER         NOT NULL,
+    event       VARCHAR(16)     NOT NULL,
+    rent        INTEGER         NOT NULL,
+    created_at  DATETIME(6)     NOT NULL,
+    KEY estate_id (estate_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS isuumo.webhook_endpoint
+(
+    id          INTEGER         NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    url         VARCHAR(2048)   NOT NULL,
+    secret      VARCHAR(128)    NOT NULL,
+    events      VARCHAR(256)    NOT NULL
+);
+
+CREATE TABLE isuumo.webhook_delivery
+(
+    id              BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    endpoint_id     INTEGER         NOT NULL,
+    event           VARCHAR(32)     NOT NULL,
+    payload         MEDIUMTEXT      NOT NULL,
+    attempts        INTEGER         NOT NULL DEFAULT 0,
+    last_error      VARCHAR(1024)   NOT NULL DEFAULT '',
+    next_attempt_at DATETIME(6)     NULL,
+    KEY endpoint_id (endpoint_id),
+    KEY next_attempt_at (next_attempt_at)
+);